@@ -18,6 +18,7 @@ type Attrs struct {
 	Size    uint64
 	Uid     uint32
 	Gid     uint32
+	Atime   time.Time
 	Mtime   time.Time
 	Ctime   time.Time
 	Crtime  time.Time
@@ -31,6 +32,21 @@ type FsInfo struct {
 	remaining uint64
 }
 
+// QuotaInfo provides quota and usage of a HDFS directory.
+// Quotas are set to -1 if they are not set
+type QuotaInfo struct {
+	NameQuota  int64  `json:"name_quota"`  // max number of files and directories
+	NameUsed   uint64 `json:"name_used"`   // number of files and directories (including the directory itself)
+	SpaceQuota int64  `json:"space_quota"` // max number of bytes, including replication
+	SpaceUsed  uint64 `json:"space_used"`  // number of bytes consumed, including replication
+	Length     uint64 `json:"length"`      // number of bytes in all files
+}
+
+// Returns true if either name or space quota is set
+func (q *QuotaInfo) HasQuota() bool {
+	return q.NameQuota >= 0 || q.SpaceQuota >= 0
+}
+
 // Converts Attrs datastructure into FUSE represnetation
 func (attrs *Attrs) ConvertAttrToFuse(a *fuse.Attr) error {
 	a.Inode = attrs.Inode
@@ -40,6 +56,7 @@ func (attrs *Attrs) ConvertAttrToFuse(a *fuse.Attr) error {
 	}
 	a.Uid = attrs.Uid
 	a.Gid = attrs.Gid
+	a.Atime = attrs.Atime
 	a.Mtime = attrs.Mtime
 	a.Ctime = attrs.Ctime
 	a.Crtime = attrs.Crtime
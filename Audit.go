@@ -0,0 +1,121 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Audit log of the mount, nil if auditing is disabled
+var auditLog *AuditLog
+
+// Audited operations
+const (
+	AuditCreate  = "create"
+	AuditFlush   = "flush"
+	AuditRemove  = "remove"
+	AuditRmtree  = "rmtree" // recursive delete through the control xattr
+	AuditRename  = "rename"
+	AuditMkdir   = "mkdir"
+	AuditMknod   = "mknod"
+	AuditLink    = "link" // hard link emulated by a copy
+	AuditChmod   = "chmod"
+	AuditChown   = "chown"
+	AuditSetattr = "setattr"
+)
+
+// Entry of the audit log, written as one JSON object per line
+type AuditRecord struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Uid     uint32    `json:"uid"`
+	Gid     uint32    `json:"gid"`
+	Pid     uint32    `json:"pid"`
+	Path    string    `json:"path"`               // HDFS path
+	NewPath string    `json:"new_path,omitempty"` // HDFS path of the rename target or of the hard link copy
+	Errno   string    `json:"errno,omitempty"`    // errno returned to the caller, empty on success
+}
+
+// Append-only log of the mutations done through the mount, written
+// independently from the log level. The file is never truncated or rotated
+// by the mount
+// Concurrency: thread safe
+type AuditLog struct {
+	File  *os.File
+	mutex sync.Mutex
+}
+
+// Creates or appends to the audit log file
+func NewAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{File: f}, nil
+}
+
+// Records a mutation requested by the caller of the FUSE request. Mutations
+// without a FUSE request, e.g. flushes through the control socket, are
+// recorded with the identity of the mount process. The paths are the HDFS
+// path, and the new path for renames. Does nothing if auditing is disabled.
+// Failures to write the audit log are logged, but are not reported to the caller
+func (a *AuditLog) Record(op string, hdr *fuse.Header, err error, paths ...string) {
+	if a == nil {
+		return
+	}
+	record := AuditRecord{Time: time.Now().UTC(), Op: op}
+	if hdr != nil {
+		record.Uid, record.Gid, record.Pid = hdr.Uid, hdr.Gid, hdr.Pid
+	} else {
+		record.Uid, record.Gid, record.Pid = uint32(os.Getuid()), uint32(os.Getgid()), uint32(os.Getpid())
+	}
+	if len(paths) > 0 {
+		record.Path = paths[0]
+	}
+	if len(paths) > 1 {
+		record.NewPath = paths[1]
+	}
+	if err != nil {
+		record.Errno = fuse.ToErrno(err).ErrnoName()
+	}
+	data, _ := json.Marshal(record)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, werr := a.File.Write(append(data, '\n')); werr != nil {
+		logerror("Failed to write the audit log", Fields{Operation: op, Path: record.Path, Error: werr})
+	}
+}
+
+// Records the chmod, chown and setattr parts of a FUSE Setattr request
+func (a *AuditLog) RecordSetattr(req *fuse.SetattrRequest, err error, path string) {
+	if a == nil {
+		return
+	}
+	valid := req.Valid &^ (fuse.SetattrHandle | fuse.SetattrLockOwner)
+	if valid.Mode() {
+		a.Record(AuditChmod, &req.Header, err, path)
+	}
+	if valid.Uid() || valid.Gid() {
+		a.Record(AuditChown, &req.Header, err, path)
+	}
+	if valid&^(fuse.SetattrMode|fuse.SetattrUid|fuse.SetattrGid) != 0 {
+		a.Record(AuditSetattr, &req.Header, err, path)
+	}
+}
+
+// Syncs and closes the audit log file
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.File.Sync()
+	return a.File.Close()
+}
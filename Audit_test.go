@@ -0,0 +1,82 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Testing the audit records of mutating FUSE requests
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	auditLog, err = NewAuditLog(dir + "/audit.log")
+	assert.Nil(t, err)
+	defer func() { auditLog = nil }()
+
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	caller := fuse.Header{Pid: 42} // root, ownership changes need a known user
+
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/foo", os.FileMode(0755)|os.ModeDir).Return(nil)
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), "/foo", gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	node, err := root.(*DirINode).Mkdir(nil, &fuse.MkdirRequest{Header: caller, Name: "foo", Mode: os.FileMode(0755) | os.ModeDir})
+	assert.Nil(t, err)
+
+	// chmod and touch in a single request are recorded separately
+	hdfsAccessor.EXPECT().Chmod(gomock.Any(), "/foo", os.FileMode(0700)).Return(nil)
+	hdfsAccessor.EXPECT().SetTimes(gomock.Any(), "/foo", gomock.Any(), gomock.Any()).Return(nil)
+	err = node.(*DirINode).Setattr(nil, &fuse.SetattrRequest{Header: caller, Mode: os.FileMode(0700),
+		Valid: fuse.SetattrMode | fuse.SetattrMtime}, &fuse.SetattrResponse{})
+	assert.Nil(t, err)
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/bar").Return(Attrs{}, syscall.ENOENT)
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/foo", "/bar").Return(nil)
+	assert.Nil(t, root.(*DirINode).Rename(nil, &fuse.RenameRequest{Header: caller, OldName: "foo", NewName: "bar"}, root))
+
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), "/baz").Return(syscall.ENOENT)
+	err = root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Header: caller, Name: "baz"})
+	assert.Equal(t, syscall.ENOENT, err)
+
+	_, err = root.(*DirINode).Mknod(nil, &fuse.MknodRequest{Header: caller, Name: "fifo", Mode: os.ModeNamedPipe | 0644})
+	assert.Equal(t, syscall.EPERM, err)
+
+	hdfsAccessor.EXPECT().RemoveAll(gomock.Any(), "/bar").Return(nil)
+	assert.Nil(t, node.(*DirINode).Setxattr(nil, &fuse.SetxattrRequest{Header: caller, Name: RecursiveDeleteXattr, Xattr: []byte("1")}))
+	assert.Nil(t, auditLog.Close())
+
+	f, err := os.Open(dir + "/audit.log")
+	assert.Nil(t, err)
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record AuditRecord
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	assert.Equal(t, 7, len(records))
+	assert.Equal(t, AuditRecord{Time: records[0].Time, Op: AuditMkdir, Pid: 42, Path: "/foo"}, records[0])
+	assert.Equal(t, AuditChmod, records[1].Op)
+	assert.Equal(t, AuditSetattr, records[2].Op)
+	assert.Equal(t, "/foo", records[3].Path)
+	assert.Equal(t, "/bar", records[3].NewPath)
+	assert.Equal(t, AuditRemove, records[4].Op)
+	assert.Equal(t, "ENOENT", records[4].Errno)
+	assert.False(t, records[4].Time.IsZero())
+	assert.Equal(t, AuditRecord{Time: records[5].Time, Op: AuditMknod, Pid: 42, Path: "/fifo", Errno: "EPERM"}, records[5])
+	assert.Equal(t, AuditRecord{Time: records[6].Time, Op: AuditRmtree, Pid: 42, Path: "/bar"}, records[6])
+}
@@ -0,0 +1,278 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// States of the circuit breaker
+const (
+	CircuitClosed   = "closed"    // operations are sent to the namenode
+	CircuitOpen     = "open"      // operations fail with ENOTCONN without contacting the namenode
+	CircuitHalfOpen = "half-open" // the namenode is being probed, operations still fail
+)
+
+// Minimum number of connection failures opening the circuit, so that a
+// single failure after an idle period does not open it
+const circuitBreakerMinFailures = 3
+
+// Stops sending operations to a dead namenode. Once the connections to the
+// namenode keep failing, without any success, for longer than the threshold,
+// the circuit opens: the operations of all the accessors sharing the breaker
+// fail with ENOTCONN immediately instead of being retried, and cached
+// attributes are served where possible. The namenode is probed periodically
+// (half-open) and the circuit closes once it answers.
+// Concurrency: thread safe
+type CircuitBreaker struct {
+	Accessor      HdfsAccessor  // accessor used for probing, must not be guarded by the circuit breaker
+	Path          string        // path whose attributes are retrieved by the probe
+	Clock         Clock         // interface to clock
+	Threshold     time.Duration // duration of the connection failures opening the circuit
+	ProbeInterval time.Duration // interval between probes while the circuit is open
+	state         string
+	since         time.Time // time the circuit opened
+	failures      int       // connection failures since the last success
+	firstFailure  time.Time // time of the first connection failure since the last success
+	mutex         sync.Mutex
+}
+
+// Creates an instance of CircuitBreaker
+func NewCircuitBreaker(accessor HdfsAccessor, path string, clock Clock, threshold time.Duration, probeInterval time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Accessor: accessor, Path: path, Clock: clock, Threshold: threshold, ProbeInterval: probeInterval, state: CircuitClosed}
+}
+
+// Returns the state of the circuit and the time it opened
+func (cb *CircuitBreaker) State() (string, time.Time) {
+	if cb == nil {
+		return CircuitClosed, time.Time{}
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state, cb.since
+}
+
+// Returns ENOTCONN unless the circuit is closed
+func (cb *CircuitBreaker) Check() error {
+	if state, _ := cb.State(); state != CircuitClosed {
+		return syscall.ENOTCONN
+	}
+	return nil
+}
+
+// Records the result of an operation. Any answer of the namenode, including
+// errors, closes the circuit
+func (cb *CircuitBreaker) Observe(err error) {
+	if cb == nil || err == syscall.EINTR {
+		return // abandoned calls tell nothing about the namenode
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if !isConnectionFailure(err) {
+		cb.failures = 0
+		if cb.state != CircuitClosed {
+			cb.close()
+		}
+		return
+	}
+	now := cb.Clock.Now()
+	if cb.failures == 0 {
+		cb.firstFailure = now
+	}
+	cb.failures++
+	if cb.state == CircuitClosed && cb.failures >= circuitBreakerMinFailures && now.Sub(cb.firstFailure) >= cb.Threshold {
+		cb.state = CircuitOpen
+		cb.since = now
+		logwarn(fmt.Sprintf("Namenode unreachable for %v, failing operations until it is back", now.Sub(cb.firstFailure)),
+			Fields{Operation: NamenodeCircuitBreaker, Retries: cb.failures, Error: err})
+	}
+}
+
+func (cb *CircuitBreaker) close() {
+	cb.state = CircuitClosed
+	loginfo(fmt.Sprintf("Namenode is reachable again after %v", cb.Clock.Now().Sub(cb.since)), Fields{Operation: NamenodeCircuitBreaker})
+}
+
+// Probes the namenode while the circuit is open. Never returns
+func (cb *CircuitBreaker) Run() {
+	for {
+		<-cb.Clock.After(cb.ProbeInterval)
+		if state, _ := cb.State(); state == CircuitOpen {
+			cb.Probe()
+		}
+	}
+}
+
+// Probes the namenode once and returns true if it answered, which closes the circuit
+func (cb *CircuitBreaker) Probe() bool {
+	cb.mutex.Lock()
+	cb.state = CircuitHalfOpen
+	cb.mutex.Unlock()
+
+	_, err := cb.Accessor.Stat(context.Background(), cb.Path)
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if isConnectionFailure(err) {
+		logdebug("Namenode is still unreachable", Fields{Operation: NamenodeCircuitBreaker, Error: err})
+		if cb.state == CircuitHalfOpen {
+			cb.state = CircuitOpen
+		}
+		return false
+	}
+	cb.failures = 0
+	if cb.state != CircuitClosed {
+		cb.close()
+	}
+	return true
+}
+
+// Guards an HdfsAccessor with a circuit breaker: the calls fail with ENOTCONN
+// while the circuit is open, and their results are recorded by the breaker
+type CircuitBreakerHdfsAccessor struct {
+	Impl    HdfsAccessor
+	Breaker *CircuitBreaker
+}
+
+var _ HdfsAccessor = (*CircuitBreakerHdfsAccessor)(nil) // ensure CircuitBreakerHdfsAccessor implements HdfsAccessor
+
+// Creates an instance of CircuitBreakerHdfsAccessor
+func NewCircuitBreakerHdfsAccessor(impl HdfsAccessor, breaker *CircuitBreaker) *CircuitBreakerHdfsAccessor {
+	return &CircuitBreakerHdfsAccessor{Impl: impl, Breaker: breaker}
+}
+
+// Opens HDFS file for reading
+func (cba *CircuitBreakerHdfsAccessor) OpenRead(ctx context.Context, path string) (ReadSeekCloser, error) {
+	if err := cba.Breaker.Check(); err != nil {
+		return nil, err
+	}
+	result, err := cba.Impl.OpenRead(ctx, path)
+	cba.Breaker.Observe(err)
+	return result, err
+}
+
+// Opens HDFS file for writing
+func (cba *CircuitBreakerHdfsAccessor) CreateFile(ctx context.Context, path string, mode os.FileMode, overwrite bool) (HdfsWriter, error) {
+	if err := cba.Breaker.Check(); err != nil {
+		return nil, err
+	}
+	result, err := cba.Impl.CreateFile(ctx, path, mode, overwrite)
+	cba.Breaker.Observe(err)
+	return result, err
+}
+
+// Enumerates HDFS directory
+func (cba *CircuitBreakerHdfsAccessor) ReadDir(ctx context.Context, path string) ([]Attrs, error) {
+	if err := cba.Breaker.Check(); err != nil {
+		return nil, err
+	}
+	result, err := cba.Impl.ReadDir(ctx, path)
+	cba.Breaker.Observe(err)
+	return result, err
+}
+
+// Retrieves file/directory attributes
+func (cba *CircuitBreakerHdfsAccessor) Stat(ctx context.Context, path string) (Attrs, error) {
+	if err := cba.Breaker.Check(); err != nil {
+		return Attrs{}, err
+	}
+	result, err := cba.Impl.Stat(ctx, path)
+	cba.Breaker.Observe(err)
+	return result, err
+}
+
+// Retrieves HDFS usage
+func (cba *CircuitBreakerHdfsAccessor) StatFs(ctx context.Context) (FsInfo, error) {
+	if err := cba.Breaker.Check(); err != nil {
+		return FsInfo{}, err
+	}
+	result, err := cba.Impl.StatFs(ctx)
+	cba.Breaker.Observe(err)
+	return result, err
+}
+
+// Retrieves quota and usage of a directory
+func (cba *CircuitBreakerHdfsAccessor) GetQuota(ctx context.Context, path string) (QuotaInfo, error) {
+	if err := cba.Breaker.Check(); err != nil {
+		return QuotaInfo{}, err
+	}
+	result, err := cba.Impl.GetQuota(ctx, path)
+	cba.Breaker.Observe(err)
+	return result, err
+}
+
+// Creates a directory
+func (cba *CircuitBreakerHdfsAccessor) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	return cba.guard(func() error { return cba.Impl.Mkdir(ctx, path, mode) })
+}
+
+// Removes a file or an empty directory
+func (cba *CircuitBreakerHdfsAccessor) Remove(ctx context.Context, path string) error {
+	return cba.guard(func() error { return cba.Impl.Remove(ctx, path) })
+}
+
+// Removes a file or directory recursively
+func (cba *CircuitBreakerHdfsAccessor) RemoveAll(ctx context.Context, path string) error {
+	return cba.guard(func() error { return cba.Impl.RemoveAll(ctx, path) })
+}
+
+// Renames a file or directory
+func (cba *CircuitBreakerHdfsAccessor) Rename(ctx context.Context, oldPath string, newPath string) error {
+	return cba.guard(func() error { return cba.Impl.Rename(ctx, oldPath, newPath) })
+}
+
+// Ensures HDFS accessor is connected to the HDFS name node
+func (cba *CircuitBreakerHdfsAccessor) EnsureConnected() error {
+	return cba.guard(cba.Impl.EnsureConnected)
+}
+
+// Changes the owner and group of the file
+func (cba *CircuitBreakerHdfsAccessor) Chown(ctx context.Context, path string, owner, group string) error {
+	return cba.guard(func() error { return cba.Impl.Chown(ctx, path, owner, group) })
+}
+
+// Changes the mode of the file
+func (cba *CircuitBreakerHdfsAccessor) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return cba.guard(func() error { return cba.Impl.Chmod(ctx, path, mode) })
+}
+
+// Truncates the file to the given size
+func (cba *CircuitBreakerHdfsAccessor) Truncate(ctx context.Context, path string, size int64) error {
+	return cba.guard(func() error { return cba.Impl.Truncate(ctx, path, size) })
+}
+
+// Changes the access and modification times of the file
+func (cba *CircuitBreakerHdfsAccessor) SetTimes(ctx context.Context, path string, atime time.Time, mtime time.Time) error {
+	return cba.guard(func() error { return cba.Impl.SetTimes(ctx, path, atime, mtime) })
+}
+
+// Creates a snapshot of a snapshottable directory
+func (cba *CircuitBreakerHdfsAccessor) CreateSnapshot(ctx context.Context, path string, name string) error {
+	return cba.guard(func() error { return cba.Impl.CreateSnapshot(ctx, path, name) })
+}
+
+// Deletes a snapshot of a snapshottable directory
+func (cba *CircuitBreakerHdfsAccessor) DeleteSnapshot(ctx context.Context, path string, name string) error {
+	return cba.guard(func() error { return cba.Impl.DeleteSnapshot(ctx, path, name) })
+}
+
+// Close current meta connection if needed
+func (cba *CircuitBreakerHdfsAccessor) Close() error {
+	return cba.Impl.Close()
+}
+
+// Makes a call returning only an error through the circuit breaker
+func (cba *CircuitBreakerHdfsAccessor) guard(call func() error) error {
+	if err := cba.Breaker.Check(); err != nil {
+		return err
+	}
+	err := call()
+	cba.Breaker.Observe(err)
+	return err
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Connection failure reported by the client library
+var connectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+// Testing that the circuit opens after sustained connection failures, fails
+// operations fast while open and closes once a probe reaches the namenode
+func TestCircuitBreaker(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	breaker := NewCircuitBreaker(hdfsAccessor, "/", mockClock, 30*time.Second, 10*time.Second)
+	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(NewCircuitBreakerHdfsAccessor(hdfsAccessor, breaker), atMost2Attempts())
+	hdfsAccessor.EXPECT().Close().Return(nil).AnyTimes()
+
+	// an answer of the namenode, even an error, resets the failures
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/a").Return(Attrs{}, connectionRefused).Times(2)
+	_, err := ftHdfsAccessor.Stat(nil, "/a")
+	assert.NotNil(t, err)
+	mockClock.NotifyTimeElapsed(time.Minute)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/a").Return(Attrs{}, syscall.ENOENT)
+	_, err = ftHdfsAccessor.Stat(nil, "/a")
+	assert.Equal(t, syscall.ENOENT, err)
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/a").DoAndReturn(func(ctx interface{}, path string) (Attrs, error) {
+		mockClock.NotifyTimeElapsed(20 * time.Second)
+		return Attrs{}, connectionRefused
+	}).Times(3)
+	_, err = ftHdfsAccessor.Stat(nil, "/a")
+	assert.NotNil(t, err)
+	state, _ := breaker.State()
+	assert.Equal(t, CircuitClosed, state)
+	_, err = ftHdfsAccessor.Stat(nil, "/a") // third failure, 40s after the first one
+	assert.Equal(t, syscall.ENOTCONN, err)
+	state, since := breaker.State()
+	assert.Equal(t, CircuitOpen, state)
+	assert.Equal(t, mockClock.Now(), since)
+
+	// failing fast without contacting the namenode
+	assert.Equal(t, syscall.ENOTCONN, ftHdfsAccessor.Mkdir(nil, "/b", os.FileMode(0755)))
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/").Return(Attrs{}, connectionRefused)
+	assert.False(t, breaker.Probe())
+	state, _ = breaker.State()
+	assert.Equal(t, CircuitOpen, state)
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/").Return(Attrs{Name: "/"}, nil)
+	assert.True(t, breaker.Probe())
+	assert.Nil(t, breaker.Check())
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/b", os.FileMode(0755)).Return(nil)
+	assert.Nil(t, ftHdfsAccessor.Mkdir(nil, "/b", os.FileMode(0755)))
+}
+
+// Testing that cached attributes are served while the circuit is open
+func TestCircuitBreakerServesCachedAttrs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	breaker := NewCircuitBreaker(hdfsAccessor, "/", mockClock, 0, time.Second)
+	for i := 0; i < circuitBreakerMinFailures; i++ {
+		breaker.Observe(connectionRefused)
+	}
+	assert.Equal(t, syscall.ENOTCONN, breaker.Check())
+
+	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(NewCircuitBreakerHdfsAccessor(hdfsAccessor, breaker), atMost2Attempts())
+	fs, _ := NewFileSystem([]HdfsAccessor{ftHdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	file := root.(*DirINode).NodeFromAttrs(Attrs{Name: "file", Mode: 0644, Size: 42}).(*FileINode)
+	mockClock.NotifyTimeElapsed(time.Minute) // the cached attributes expired
+
+	var attr fuse.Attr
+	assert.Nil(t, file.Attr(nil, &attr))
+	assert.Equal(t, uint64(42), attr.Size)
+	_, err := root.(*DirINode).Lookup(nil, "other")
+	assert.Equal(t, syscall.ENOTCONN, err)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The context of a FUSE request is cancelled when the request is interrupted,
+// e.g. by Ctrl-C. Interrupted requests fail with EINTR
+
+// Returns EINTR if the FUSE request of the context was interrupted
+func interrupted(ctx context.Context) error {
+	if ctx != nil && ctx.Err() != nil {
+		return syscall.EINTR
+	}
+	return nil
+}
+
+// Runs the call in the background and returns EINTR as soon as the context is
+// cancelled. The HDFS client does not support cancellation, an abandoned call
+// completes in the background and its result is dropped: if it succeeds,
+// abandoned (if not nil) is called to release what it returned. The call must
+// not write variables read by the caller after an interruption. Only for
+// idempotent reads: an abandoned mutation may still be applied, so mutations
+// wait for the call in flight and only stop retrying
+func interruptible(ctx context.Context, call func() error, abandoned func()) error {
+	if ctx == nil || ctx.Done() == nil {
+		return call()
+	}
+	if err := interrupted(ctx); err != nil {
+		return err
+	}
+	var mutex sync.Mutex
+	gaveUp := false
+	result := make(chan error, 1)
+	go func() {
+		err := call()
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !gaveUp {
+			result <- err
+		} else if err == nil && abandoned != nil {
+			abandoned()
+		}
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		mutex.Lock()
+		defer mutex.Unlock()
+		select {
+		case err := <-result:
+			return err // completed in the meantime
+		default:
+			gaveUp = true
+			return syscall.EINTR
+		}
+	}
+}
+
+// Calls f in the background if the context is cancelled before stop is
+// called. stop returns false if f was called, after it returned
+func afterCancel(ctx context.Context, f func()) (stop func() bool) {
+	if ctx == nil || ctx.Done() == nil {
+		return func() bool { return true }
+	}
+	const running, stopped, cancelled = 0, 1, 2
+	var state int32
+	stopc := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			if atomic.CompareAndSwapInt32(&state, running, cancelled) {
+				f()
+			}
+		case <-stopc:
+		}
+	}()
+	return func() bool {
+		if atomic.CompareAndSwapInt32(&state, running, stopped) {
+			close(stopc)
+			return true
+		}
+		<-done
+		return false
+	}
+}
+
+// Context with the values of its parent which is never cancelled, for
+// operations which must complete once started, e.g. uploads on close
+type detachedContext struct {
+	parent context.Context
+}
+
+// Returns a context with the values of ctx which is never cancelled
+func detachContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return nil
+	}
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
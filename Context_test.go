@@ -0,0 +1,49 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// Testing that an interrupted call returns EINTR without waiting for the
+// call, and that the result of the abandoned call is released
+func TestInterruptible(t *testing.T) {
+	assert.Nil(t, interruptible(context.Background(), func() error { return nil }, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	abandoned := make(chan struct{})
+	go cancel()
+	err := interruptible(ctx, func() error {
+		<-release
+		return nil
+	}, func() { close(abandoned) })
+	assert.Equal(t, syscall.EINTR, err)
+	close(release)
+	<-abandoned
+
+	// already interrupted, the call is not made
+	called := false
+	err = interruptible(ctx, func() error {
+		called = true
+		return nil
+	}, nil)
+	assert.Equal(t, syscall.EINTR, err)
+	assert.False(t, called)
+}
+
+// Testing that a detached context is not cancelled with its parent
+func TestDetachContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(withFuseRequest(context.Background(), &fuse.ReadRequest{Header: fuse.Header{ID: 3}}))
+	cancel()
+	detached := detachContext(ctx)
+	assert.Nil(t, interrupted(detached))
+	assert.Equal(t, syscall.EINTR, interrupted(ctx))
+	assert.Equal(t, fuse.RequestID(3), requestID(detached))
+}
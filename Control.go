@@ -0,0 +1,370 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Commands of the control socket, also available as CLI subcommands
+var controlCommands = map[string]string{
+	"status":          "reports the state and the configuration of the mount",
+	"list-open-files": "lists the open files, their proxies and pending uploads",
+	"flush":           "uploads the pending changes of all open files",
+	"drop-caches":     "drops the cached attributes and kernel directory entries, optionally under a path",
+	"set-loglevel":    "changes the log level, e.g. set-loglevel debug",
+}
+
+// Request sent over the control socket, one JSON object per line
+type ControlRequest struct {
+	Command string
+	Args    []string
+}
+
+// Response sent over the control socket, one JSON object per line
+type ControlResponse struct {
+	Error  string      `json:",omitempty"`
+	Result interface{} `json:",omitempty"`
+}
+
+// Status reported by the status command
+type MountStatus struct {
+	Version          string
+	MountPoint       string
+	SrcDir           string
+	ReadOnly         bool
+	LogLevel         string
+	SafeMode         bool
+	SafeModeSince    *time.Time `json:",omitempty"`
+	CircuitBreaker   string     // closed, open or half-open
+	CircuitOpenSince *time.Time `json:",omitempty"`
+	OpenFiles        int
+	PendingUploads   int
+	Connectors       []ConnectorStatus
+	Config           map[string]string
+	SlowOperations   []InFlightOp `json:",omitempty"` // FUSE requests and HDFS RPCs in progress for longer than -slowOpThreshold
+}
+
+// Health of an HDFS connector
+type ConnectorStatus struct {
+	Healthy bool
+	Latency string
+	Error   string `json:",omitempty"`
+}
+
+// Open file reported by the list-open-files command
+type OpenFileStatus struct {
+	Path          string
+	Proxy         string // staging, remote or none
+	Handles       int
+	PendingUpload bool  // the file has changes which are not uploaded yet
+	BytesWritten  int64 // bytes written through the handles since they were opened
+}
+
+// Serves the control socket of a mount
+// Concurrency: thread safe
+type ControlServer struct {
+	FileSystem *FileSystem
+	listener   net.Listener
+}
+
+// Returns the path of the control socket of a mount point
+func controlSocketPath(dir string, mountPoint string) string {
+	if abs, err := filepath.Abs(mountPoint); err == nil {
+		mountPoint = abs
+	}
+	return filepath.Join(dir, "hopsfs-mount-"+url.PathEscape(filepath.Clean(mountPoint))+".sock")
+}
+
+// Returns the default directory of the control sockets, private to the user
+func defaultControlDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "hopsfs-mount")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("hopsfs-mount-%d", os.Getuid()))
+}
+
+// Creates the directory of the control socket if needed, and checks that
+// other users cannot replace the socket
+func ensureControlDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != uint32(os.Getuid()) && st.Uid != 0 {
+		return fmt.Errorf("%s is owned by another user", dir)
+	}
+	if fi.Mode()&0022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("%s is writable by other users", dir)
+	}
+	return nil
+}
+
+// Creates the control socket. Only the user running the mount can connect to it
+func NewControlServer(fileSystem *FileSystem, socketPath string) (*ControlServer, error) {
+	if err := ensureControlDir(filepath.Dir(socketPath)); err != nil {
+		return nil, err
+	}
+	os.Remove(socketPath) // left over by a mount which was not shut down cleanly
+	// the socket is created with mode 0600, so that nobody can connect before it is restricted
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	loginfo("Control socket created", Fields{Operation: Control, Path: socketPath})
+	return &ControlServer{FileSystem: fileSystem, listener: listener}, nil
+}
+
+// Accepts connections until the socket is closed
+func (s *ControlServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// Closes and removes the control socket
+func (s *ControlServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req ControlRequest
+		var resp ControlResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("invalid request: %v", err)
+		} else {
+			loginfo("Control command", Fields{Operation: Control, Message: req.Command})
+			result, err := s.Execute(req.Command, req.Args)
+			if err != nil {
+				resp.Error = err.Error()
+			}
+			resp.Result = result
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// Executes a control command
+func (s *ControlServer) Execute(command string, args []string) (interface{}, error) {
+	switch command {
+	case "status":
+		return s.FileSystem.Status(), nil
+	case "list-open-files":
+		return s.FileSystem.OpenFilesStatus(), nil
+	case "flush":
+		return s.FileSystem.FlushOpenFiles()
+	case "drop-caches":
+		p := "/"
+		if len(args) > 0 {
+			p = args[0]
+			// local paths under the mount point are accepted too
+			if rel, err := filepath.Rel(s.FileSystem.MountPoint, p); err == nil && !strings.HasPrefix(rel, "..") {
+				p = rel
+			}
+		}
+		return fmt.Sprintf("%d cached entries dropped", s.FileSystem.DropCaches(p)), nil
+	case "set-loglevel":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a log level")
+		}
+		if err := setLogLevel(args[0]); err != nil {
+			return nil, err
+		}
+		return "log level set to " + args[0], nil
+	}
+	return nil, fmt.Errorf("unknown command %q", command)
+}
+
+// Returns the state and the configuration of the mount
+func (filesystem *FileSystem) Status() MountStatus {
+	status := MountStatus{
+		Version:    VERSION,
+		MountPoint: filesystem.MountPoint,
+		SrcDir:     filesystem.SrcDir,
+		ReadOnly:   filesystem.ReadOnly,
+		LogLevel:   logger.GetLevel().String(),
+		Config:     filesystem.Config,
+	}
+	if active, since := filesystem.SafeMode.Active(); active {
+		status.SafeMode = true
+		status.SafeModeSince = &since
+	}
+	state, openSince := filesystem.CircuitBreaker.State()
+	status.CircuitBreaker = state
+	if state != CircuitClosed {
+		status.CircuitOpenSince = &openSince
+	}
+	for _, f := range filesystem.OpenFilesStatus() {
+		status.OpenFiles++
+		if f.PendingUpload {
+			status.PendingUploads++
+		}
+	}
+	status.SlowOperations = watchdog.SlowOperations()
+	status.Connectors = filesystem.ConnectorsStatus()
+	return status
+}
+
+// Time after which a connector not answering the health probe is reported
+// as unhealthy, so that the status is available while the namenode hangs
+const connectorProbeTimeout = 5 * time.Second
+
+// Returns the health of the HDFS connectors
+func (filesystem *FileSystem) ConnectorsStatus() []ConnectorStatus {
+	var connectors []ConnectorStatus
+	for _, hdfsAccessor := range filesystem.HdfsAccessors {
+		// probing without retries, so that an unhealthy connector is reported quickly,
+		// and bypassing the circuit breaker
+		if ft, ok := hdfsAccessor.(*FaultTolerantHdfsAccessor); ok {
+			hdfsAccessor = ft.Impl
+		}
+		if cb, ok := hdfsAccessor.(*CircuitBreakerHdfsAccessor); ok {
+			hdfsAccessor = cb.Impl
+		}
+		start := time.Now()
+		result := make(chan error, 1)
+		go func(hdfsAccessor HdfsAccessor) {
+			_, err := hdfsAccessor.Stat(context.Background(), filesystem.SrcDir)
+			result <- err
+		}(hdfsAccessor)
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(connectorProbeTimeout):
+			err = fmt.Errorf("no response within %s", connectorProbeTimeout)
+		}
+		connector := ConnectorStatus{Healthy: err == nil, Latency: time.Since(start).String()}
+		if err != nil {
+			connector.Error = err.Error()
+		}
+		connectors = append(connectors, connector)
+	}
+	return connectors
+}
+
+// Returns the open files, their proxies and pending uploads
+func (filesystem *FileSystem) OpenFilesStatus() []OpenFileStatus {
+	var files []OpenFileStatus
+	for _, file := range filesystem.OpenFiles() {
+		f := OpenFileStatus{Path: file.AbsolutePath(), Proxy: "none"}
+		file.lockFileHandles()
+		switch file.fileProxy.(type) {
+		case *LocalRWFileProxy:
+			f.Proxy = "staging"
+		case *RemoteROFileProxy:
+			f.Proxy = "remote"
+		}
+		f.Handles = len(file.activeHandles)
+		for _, handle := range file.activeHandles {
+			// read atomically, without waiting for a handle busy uploading
+			f.BytesWritten += atomic.LoadInt64(&handle.totalBytesWritten)
+			f.PendingUpload = f.PendingUpload || handle.dataChanged()
+		}
+		file.unlockFileHandles()
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// Uploads the pending changes of all open files. Returns the flushed files
+func (filesystem *FileSystem) FlushOpenFiles() ([]string, error) {
+	var flushed []string
+	var errs []string
+	for _, file := range filesystem.OpenFiles() {
+		if err := file.Fsync(context.Background(), nil); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", file.AbsolutePath(), err))
+			continue
+		}
+		flushed = append(flushed, file.AbsolutePath())
+	}
+	if len(errs) > 0 {
+		return flushed, fmt.Errorf("failed to flush %v", errs)
+	}
+	return flushed, nil
+}
+
+// Returns true if the command line argument is a control command
+func isControlCommand(arg string) bool {
+	_, ok := controlCommands[arg]
+	return ok
+}
+
+// Runs a CLI subcommand against the control socket of a running mount.
+// Returns the exit code
+func runControlCommand(command string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	dir := flags.String("controlDir", defaultControlDir(), "directory of the control socket of the mount")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [Options] MountPoint [Args]\n  %s\n\nOptions:\n", os.Args[0], command, controlCommands[command])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	conn, err := net.Dial("unix", controlSocketPath(*dir, flags.Arg(0)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to the mount: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	req, _ := json.Marshal(ControlRequest{Command: command, Args: flags.Args()[1:]})
+	if _, err := conn.Write(append(req, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send the command: %v\n", err)
+		return 1
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the response: %v\n", err)
+		return 1
+	}
+	if resp.Result != nil {
+		if s, ok := resp.Result.(string); ok {
+			fmt.Println(s)
+		} else {
+			out, _ := json.MarshalIndent(resp.Result, "", "  ")
+			fmt.Println(string(out))
+		}
+	}
+	if resp.Error != "" {
+		fmt.Fprintln(os.Stderr, resp.Error)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// Name of the virtual directory in the root of the mount exposing the version,
+// statistics, connection state and configuration of the mount. The directory
+// is not listed by ReadDirAll, but it can be looked up, and it is not subject
+// to the allowed prefixes. It hides an HDFS entry with the same name
+const ControlDirName = ".hopsfs"
+
+// Virtual directory exposing the state of the mount
+type ControlDir struct {
+	FileSystem *FileSystem
+	files      map[string]*ControlFile
+}
+
+// Virtual file of the control directory. Read-only files are generated on
+// each open, writable files act on the data written to them
+type ControlFile struct {
+	Name    string
+	Content func() (interface{}, error) // value returned as JSON by read-only files
+	Write   func(data string) error     // action of writable files
+	uid     uint32                      // user running the mount
+	gid     uint32                      // group of the user running the mount
+}
+
+// Verify that the control directory and files implement the necessary FUSE interfaces
+var _ fs.Node = (*ControlDir)(nil)
+var _ fs.NodeStringLookuper = (*ControlDir)(nil)
+var _ fs.HandleReadDirAller = (*ControlDir)(nil)
+var _ fs.NodeOpener = (*ControlFile)(nil)
+var _ fs.NodeSetattrer = (*ControlFile)(nil)
+
+// Statistics exposed by the stats file
+type MountStats struct {
+	OpenFiles        int
+	PendingUploads   int
+	OpenHandles      float64
+	BytesRead        float64
+	BytesWritten     float64
+	StagingBytes     float64
+	Retries          float64
+	RetriesExhausted float64
+	Cache            map[string]float64 // lookups by cache and result, e.g. "attrs,hit"
+	FuseRequests     map[string]float64 // FUSE requests by operation, e.g. "Lookup"
+	FuseErrors       map[string]float64 // failed FUSE requests by operation and errno, e.g. "Lookup,ENOENT"
+	HdfsErrors       map[string]float64 // failed HDFS RPCs by method and errno, only collected with -metricsAddr
+}
+
+// Connection state exposed by the connection file
+type ConnectionState struct {
+	SafeMode       bool
+	CircuitBreaker string // closed, open or half-open
+	Connectors     []ConnectorStatus
+}
+
+// Returns the control directory of the file system
+func (filesystem *FileSystem) controlDir() *ControlDir {
+	filesystem.nodesLock.Lock()
+	defer filesystem.nodesLock.Unlock()
+	if filesystem.control != nil {
+		return filesystem.control
+	}
+
+	// owned by the user running the mount, not by the owner of the HDFS directory
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	dir := &ControlDir{FileSystem: filesystem, files: make(map[string]*ControlFile)}
+	for _, f := range []*ControlFile{
+		{Name: "version", Content: func() (interface{}, error) {
+			return map[string]string{"Version": VERSION, "GitCommit": GITCOMMIT, "BuildTime": BUILDTIME, "BuiltBy": HOSTNAME}, nil
+		}},
+		{Name: "stats", Content: func() (interface{}, error) { return filesystem.Stats(), nil }},
+		{Name: "connection", Content: func() (interface{}, error) {
+			active, _ := filesystem.SafeMode.Active()
+			circuit, _ := filesystem.CircuitBreaker.State()
+			return ConnectionState{SafeMode: active, CircuitBreaker: circuit, Connectors: filesystem.ConnectorsStatus()}, nil
+		}},
+		{Name: "config", Content: func() (interface{}, error) { return filesystem.Config, nil }},
+		{Name: "invalidate", Write: func(data string) error {
+			// one path relative to the mount point per line
+			for _, p := range strings.Split(data, "\n") {
+				if p = strings.TrimSpace(p); p != "" {
+					filesystem.DropCaches(p)
+				}
+			}
+			return nil
+		}},
+	} {
+		f.uid, f.gid = uid, gid
+		dir.files[f.Name] = f
+	}
+	filesystem.control = dir
+	return dir
+}
+
+// Returns the statistics of the mount
+func (filesystem *FileSystem) Stats() MountStats {
+	stats := MountStats{
+		OpenHandles:      metricValue(metrics.OpenHandles),
+		BytesRead:        metricValue(metrics.BytesRead),
+		BytesWritten:     metricValue(metrics.BytesWritten),
+		StagingBytes:     stagingDirUsage(),
+		Retries:          metricValue(metrics.Retries),
+		RetriesExhausted: metricValue(metrics.RetriesFailed),
+		Cache:            metricValues(metrics.CacheRequests, "cache", "result"),
+		FuseRequests:     metricValues(metrics.FuseRequests, "op"),
+		FuseErrors:       metricValues(metrics.FuseErrors, "op", "errno"),
+		HdfsErrors:       metricValues(metrics.HdfsErrors, "method", "errno"),
+	}
+	for _, f := range filesystem.OpenFilesStatus() {
+		stats.OpenFiles++
+		if f.PendingUpload {
+			stats.PendingUploads++
+		}
+	}
+	return stats
+}
+
+// Returns EPERM if the entry of the directory is the control directory
+func (dir *DirINode) checkNotControlDir(name string, operation string) error {
+	if dir.Parent == nil && name == ControlDirName {
+		logdebug("The control directory can not be modified", Fields{Operation: operation, Path: name})
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// Responds on FUSE request to get the attributes of the control directory
+func (dir *ControlDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	a.Uid, a.Gid = dir.files["version"].uid, dir.files["version"].gid
+	return nil
+}
+
+// Responds on FUSE request to lookup a file of the control directory
+func (dir *ControlDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if f, ok := dir.files[name]; ok {
+		return f, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// Responds on FUSE request to list the control directory
+func (dir *ControlDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries := make([]fuse.Dirent, 0, len(dir.files))
+	for name := range dir.files {
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+// Responds on FUSE request to get the attributes of a control file. The size
+// is not known in advance, the files are read with direct I/O
+func (f *ControlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0444
+	if f.Write != nil {
+		a.Mode = 0200 // writable by the user running the mount only
+	}
+	a.Uid, a.Gid = f.uid, f.gid
+	return nil
+}
+
+// Responds on FUSE request to open a control file. The content of read-only
+// files is generated once per open
+func (f *ControlFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO
+	if f.Write != nil {
+		if req.Flags.IsReadOnly() {
+			return nil, fuse.Errno(syscall.EACCES)
+		}
+		return &controlFileHandle{file: f}, nil
+	}
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	content, err := f.Content()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &controlFileHandle{file: f, data: append(data, '\n')}, nil
+}
+
+// Responds on FUSE Setattr request. Truncating a writable control file,
+// as done by shell redirections, is a no-op
+func (f *ControlFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if f.Write == nil || req.Valid&^(fuse.SetattrSize|fuse.SetattrHandle|fuse.SetattrLockOwner) != 0 {
+		return fuse.Errno(syscall.EPERM)
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// Handle of an open control file
+type controlFileHandle struct {
+	file *ControlFile
+	data []byte // content of read-only files
+}
+
+var _ fs.HandleReadAller = (*controlFileHandle)(nil)
+var _ fs.HandleWriter = (*controlFileHandle)(nil)
+
+// Responds on FUSE Read request of a read-only control file
+func (h *controlFileHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	return h.data, nil
+}
+
+// Responds on FUSE Write request of a writable control file
+func (h *controlFileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	loginfo("Control file written", Fields{Operation: Control, Path: ControlDirName + "/" + h.file.Name, RequestID: requestID(ctx)})
+	if err := h.file.Write(string(req.Data)); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
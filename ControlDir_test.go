@@ -0,0 +1,82 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Testing the virtual control directory in the root of the mount
+func TestControlDir(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	filesystem, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"data"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	filesystem.Config = map[string]string{"readOnly": "false"}
+	root, _ := filesystem.Root()
+	root.(*DirINode).Attrs.Uid, root.(*DirINode).Attrs.Gid = uint32(os.Getuid())+1, uint32(os.Getgid())+1
+
+	// not listed, but available even though it is not under the allowed prefixes
+	hdfsAccessor.EXPECT().ReadDir(gomock.Any(), "/").Return([]Attrs{
+		{Name: "data", Mode: os.ModeDir | 0755},
+		{Name: ControlDirName, Mode: os.ModeDir | 0755}}, nil)
+	entries, err := root.(*DirINode).ReadDirAll(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []fuse.Dirent{{Name: "data", Type: fuse.DT_Dir}}, entries)
+	node, err := root.(*DirINode).Lookup(nil, ControlDirName)
+	assert.Nil(t, err)
+	controlDir := node.(*ControlDir)
+	files, err := controlDir.ReadDirAll(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(files))
+
+	read := func(name string) map[string]interface{} {
+		node, err := controlDir.Lookup(nil, name)
+		assert.Nil(t, err)
+		h, err := node.(*ControlFile).Open(nil, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		assert.Nil(t, err)
+		data, err := h.(fs.HandleReadAller).ReadAll(nil)
+		assert.Nil(t, err)
+		var content map[string]interface{}
+		assert.Nil(t, json.Unmarshal(data, &content))
+		return content
+	}
+	assert.Equal(t, VERSION, read("version")["Version"])
+	assert.Equal(t, "false", read("config")["readOnly"])
+	assert.Contains(t, read("stats"), "OpenFiles")
+
+	// read-only files can not be written
+	node, _ = controlDir.Lookup(nil, "stats")
+	_, err = node.(*ControlFile).Open(nil, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	assert.Equal(t, fuse.Errno(syscall.EACCES), err)
+
+	// writing a path to the invalidate file expires the cached attributes
+	data, err := root.(*DirINode).Lookup(nil, "data")
+	assert.Nil(t, err)
+	data.(*DirINode).Attrs.Expires = mockClock.Now().Add(time.Minute)
+	node, _ = controlDir.Lookup(nil, "invalidate")
+	var attr fuse.Attr
+	assert.Nil(t, node.Attr(nil, &attr))
+	assert.Equal(t, os.FileMode(0200), attr.Mode)
+	// owned by the user running the mount rather than by the owner of the source directory
+	assert.Equal(t, uint32(os.Getuid()), attr.Uid)
+	assert.Equal(t, uint32(os.Getgid()), attr.Gid)
+	h, err := node.(*ControlFile).Open(nil, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	assert.Nil(t, err)
+	resp := &fuse.WriteResponse{}
+	assert.Nil(t, h.(fs.HandleWriter).Write(nil, &fuse.WriteRequest{Data: []byte("data\n")}, resp))
+	assert.Equal(t, 5, resp.Size)
+	assert.True(t, data.(*DirINode).Attrs.Expires.IsZero())
+
+	// the control directory can not be removed
+	assert.Equal(t, syscall.EPERM, root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: ControlDirName, Dir: true}))
+}
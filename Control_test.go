@@ -0,0 +1,118 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	logger "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Testing the commands of the control socket
+func TestControlSocket(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+
+	dir, err := ioutil.TempDir("", "control")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := controlSocketPath(dir, "/mnt/hopsfs")
+	assert.Equal(t, filepath.Join(dir, "hopsfs-mount-%2Fmnt%2Fhopsfs.sock"), socketPath)
+	fs.MountPoint = "/mnt/hopsfs"
+	server, err := NewControlServer(fs, socketPath)
+	assert.Nil(t, err)
+	defer server.Close()
+	go server.Serve()
+	fi, err := os.Stat(socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// a file with pending changes
+	hdfswriter := NewMockHdfsWriter(mockCtrl)
+	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), "/testControl", os.FileMode(0644), false).Return(hdfswriter, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/testControl").Return(Attrs{Name: "testControl", Mode: 0644}, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), "/testControl", gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	root, _ := fs.Root()
+	_, h, err := root.(*DirINode).Create(nil, &fuse.CreateRequest{Name: "testControl",
+		Flags: fuse.OpenWriteOnly | fuse.OpenCreate, Mode: os.FileMode(0644)}, &fuse.CreateResponse{})
+	assert.Nil(t, err)
+	fileHandle := h.(*FileHandle)
+	defer fileHandle.Release(nil, nil)
+	assert.Nil(t, fileHandle.Write(nil, &fuse.WriteRequest{Data: []byte("data")}, &fuse.WriteResponse{}))
+
+	conn, err := net.Dial("unix", socketPath)
+	assert.Nil(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	execute := func(command string, args ...string) ControlResponse {
+		req, _ := json.Marshal(ControlRequest{Command: command, Args: args})
+		_, err := conn.Write(append(req, '\n'))
+		assert.Nil(t, err)
+		line, err := reader.ReadBytes('\n')
+		assert.Nil(t, err)
+		var resp ControlResponse
+		assert.Nil(t, json.Unmarshal(line, &resp))
+		return resp
+	}
+
+	resp := execute("list-open-files")
+	assert.Equal(t, "", resp.Error)
+	files := resp.Result.([]interface{})
+	assert.Equal(t, 1, len(files))
+	file := files[0].(map[string]interface{})
+	assert.Equal(t, "/testControl", file["Path"])
+	assert.Equal(t, "staging", file["Proxy"])
+	assert.Equal(t, true, file["PendingUpload"])
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/").Return(Attrs{Name: "/", Mode: os.ModeDir | 0755}, nil)
+	resp = execute("status")
+	assert.Equal(t, "", resp.Error)
+	status := resp.Result.(map[string]interface{})
+	assert.Equal(t, "/mnt/hopsfs", status["MountPoint"])
+	assert.Equal(t, float64(1), status["PendingUploads"])
+	assert.Equal(t, true, status["Connectors"].([]interface{})[0].(map[string]interface{})["Healthy"])
+
+	level := logger.GetLevel()
+	defer logger.SetLevel(level)
+	resp = execute("set-loglevel", "debug")
+	assert.Equal(t, "", resp.Error)
+	assert.Equal(t, logger.DebugLevel, logger.GetLevel())
+	assert.NotEqual(t, "", execute("set-loglevel", "verbose").Error)
+
+	resp = execute("drop-caches")
+	assert.Equal(t, "", resp.Error)
+	assert.NotEqual(t, "", execute("reboot").Error)
+}
+
+// Testing that the control socket is not created in a directory where other
+// users could replace it
+func TestControlDirWritableByOthers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Chmod(dir, 0777))
+	_, err = NewControlServer(nil, controlSocketPath(dir, "/mnt/hopsfs"))
+	assert.NotNil(t, err)
+
+	// a missing directory is created private
+	private := filepath.Join(dir, "private")
+	assert.Nil(t, os.Chmod(dir, 0700))
+	server, err := NewControlServer(nil, controlSocketPath(private, "/mnt/hopsfs"))
+	assert.Nil(t, err)
+	server.Close()
+	fi, err := os.Stat(private)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
@@ -4,11 +4,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -32,6 +34,16 @@ var _ fs.NodeStringLookuper = (*DirINode)(nil)
 var _ fs.NodeMkdirer = (*DirINode)(nil)
 var _ fs.NodeRemover = (*DirINode)(nil)
 var _ fs.NodeRenamer = (*DirINode)(nil)
+var _ fs.NodeGetxattrer = (*DirINode)(nil)
+var _ fs.NodeListxattrer = (*DirINode)(nil)
+var _ fs.NodeSetxattrer = (*DirINode)(nil)
+
+// Virtual extended attribute exposing quota and usage of a directory in JSON format
+const QuotaXattr = "user.hopsfs.quota"
+
+// Control extended attribute. Setting it to "1" deletes the whole directory subtree
+// with a single recursive HDFS delete, instead of the kernel removing every entry
+const RecursiveDeleteXattr = "user.hopsfs.delete_recursive"
 
 // Returns absolute path of the dir in HDFS namespace
 func (dir *DirINode) AbsolutePath() string {
@@ -52,15 +64,23 @@ func (dir *DirINode) AbsolutePathForChild(name string) string {
 }
 
 // Responds on FUSE request to get directory attributes
-func (dir *DirINode) Attr(ctx context.Context, a *fuse.Attr) error {
+func (dir *DirINode) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	ctx, done := observeFuse(ctx, "Getattr")
+	defer func() { done(err) }()
 	dir.lockMutex()
 	defer dir.unlockMutex()
-	if dir.Parent != nil && dir.FileSystem.Clock.Now().After(dir.Attrs.Expires) {
-		err := dir.Parent.LookupAttrs(dir.Attrs.Name, &dir.Attrs)
-		if err != nil {
+	if dir.Parent == nil {
+		return dir.Attrs.ConvertAttrToFuse(a)
+	}
+	expired := dir.FileSystem.Clock.Now().After(dir.Attrs.Expires)
+	metrics.ObserveCache("attrs", !expired)
+	if expired {
+		err := dir.Parent.LookupAttrs(ctx, dir.Attrs.Name, &dir.Attrs)
+		if err == syscall.ENOTCONN {
+			logdebug("Namenode unreachable, serving cached attributes", Fields{Operation: Stat, Path: dir.AbsolutePath(), RequestID: requestID(ctx)})
+		} else if err != nil {
 			return err
 		}
-
 	}
 	return dir.Attrs.ConvertAttrToFuse(a)
 }
@@ -102,7 +122,13 @@ func (dir *DirINode) EntriesRemove(name string) {
 }
 
 // Responds on FUSE request to lookup the directory
-func (dir *DirINode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+func (dir *DirINode) Lookup(ctx context.Context, name string) (_ fs.Node, err error) {
+	ctx, done := observeFuse(ctx, "Lookup")
+	defer func() { done(err) }()
+	if dir.Parent == nil && name == ControlDirName {
+		return dir.FileSystem.controlDir(), nil
+	}
+
 	dir.lockMutex()
 	defer dir.unlockMutex()
 
@@ -110,12 +136,14 @@ func (dir *DirINode) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		return nil, fuse.ENOENT
 	}
 
-	if node := dir.EntriesGet(name); node != nil {
+	node := dir.EntriesGet(name)
+	metrics.ObserveCache("entries", node != nil)
+	if node != nil {
 		return *node, nil
 	}
 
 	var attrs Attrs
-	err := dir.LookupAttrs(name, &attrs)
+	err = dir.LookupAttrs(ctx, name, &attrs)
 	if err != nil {
 		return nil, err
 	}
@@ -123,21 +151,26 @@ func (dir *DirINode) Lookup(ctx context.Context, name string) (fs.Node, error) {
 }
 
 // Responds on FUSE request to read directory
-func (dir *DirINode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+func (dir *DirINode) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	ctx, done := observeFuse(ctx, "Readdir")
+	defer func() { done(err) }()
 	dir.lockMutex()
 	defer dir.unlockMutex()
 
 	absolutePath := dir.AbsolutePath()
-	loginfo("Read directory", Fields{Operation: ReadDir, Path: absolutePath})
+	loginfo("Read directory", Fields{Operation: ReadDir, Path: absolutePath, RequestID: requestID(ctx)})
 
-	allAttrs, err := dir.FileSystem.getDFSConnector().ReadDir(absolutePath)
+	allAttrs, err := dir.FileSystem.getDFSConnector().ReadDir(ctx, absolutePath)
 	if err != nil {
-		logwarn("Failed to list DFS directory", Fields{Operation: ReadDir, Path: absolutePath, Error: err})
+		logwarn("Failed to list DFS directory", Fields{Operation: ReadDir, Path: absolutePath, Error: err, RequestID: requestID(ctx)})
 		return nil, err
 	}
 
 	entries := make([]fuse.Dirent, 0, len(allAttrs))
 	for _, a := range allAttrs {
+		if dir.Parent == nil && a.Name == ControlDirName {
+			continue // hidden by the control directory
+		}
 		if dir.FileSystem.IsPathAllowed(dir.AbsolutePathForChild(a.Name)) {
 			// Creating Dirent structure as required by FUSE
 			entries = append(entries, fuse.Dirent{
@@ -147,6 +180,7 @@ func (dir *DirINode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			// Speculatively pre-creating child Dir or File node with cached attributes,
 			// since it's highly likely that we will have Lookup() call for this name
 			// This is the key trick which dramatically speeds up 'ls'
+			dir.adjustSnapshotAttrs(&a)
 			dir.NodeFromAttrs(a)
 		}
 	}
@@ -172,40 +206,51 @@ func (dir *DirINode) NodeFromAttrs(attrs Attrs) fs.Node {
 }
 
 // Performs Stat() query on the backend
-func (dir *DirINode) LookupAttrs(name string, attrs *Attrs) error {
+func (dir *DirINode) LookupAttrs(ctx context.Context, name string, attrs *Attrs) error {
 
-	var err error
-	*attrs, err = dir.FileSystem.getDFSConnector().Stat(path.Join(dir.AbsolutePath(), name))
+	result, err := dir.FileSystem.getDFSConnector().Stat(ctx, path.Join(dir.AbsolutePath(), name))
 	if err != nil {
 		// It is a warning as each time new file write tries to stat if the file exists
-		loginfo("stat failed", Fields{Operation: Stat, Path: path.Join(dir.AbsolutePath(), name), Error: err})
+		loginfo("stat failed", Fields{Operation: Stat, Path: path.Join(dir.AbsolutePath(), name), Error: err, RequestID: requestID(ctx)})
 		return err
 	}
 
-	logdebug("Stat successful ", Fields{Operation: Stat, Path: path.Join(dir.AbsolutePath(), name)})
+	logdebug("Stat successful ", Fields{Operation: Stat, Path: path.Join(dir.AbsolutePath(), name), RequestID: requestID(ctx)})
+	*attrs = result
+	dir.adjustSnapshotAttrs(attrs)
 	// expiration time := now + 5 secs // TODO: make configurable
 	attrs.Expires = dir.FileSystem.Clock.Now().Add(5 * time.Second)
 	return nil
 }
 
 // Responds on FUSE Mkdir request
-func (dir *DirINode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+func (dir *DirINode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	ctx, done := observeFuse(ctx, "Mkdir")
+	defer func() { done(err) }()
 	dir.lockMutex()
 	defer dir.unlockMutex()
+	defer func() { auditLog.Record(AuditMkdir, &req.Header, err, dir.AbsolutePathForChild(req.Name)) }()
+
+	if dir.isSnapshotDir() {
+		return dir.createSnapshot(ctx, req.Name)
+	}
+	if err := checkNotInSnapshot(dir.AbsolutePath(), Mkdir); err != nil {
+		return nil, err
+	}
 
-	err := dir.FileSystem.getDFSConnector().Mkdir(dir.AbsolutePathForChild(req.Name), req.Mode)
+	err = dir.FileSystem.getDFSConnector().Mkdir(ctx, dir.AbsolutePathForChild(req.Name), req.Mode)
 	if err != nil {
-		loginfo("mkdir failed", Fields{Operation: Mkdir, Path: path.Join(dir.AbsolutePath(), req.Name), Error: err})
+		loginfo("mkdir failed", Fields{Operation: Mkdir, Path: path.Join(dir.AbsolutePath(), req.Name), Error: err, RequestID: requestID(ctx)})
 		return nil, err
 	}
-	logdebug("mkdir successful", Fields{Operation: Mkdir, Path: path.Join(dir.AbsolutePath(), req.Name)})
+	logdebug("mkdir successful", Fields{Operation: Mkdir, Path: path.Join(dir.AbsolutePath(), req.Name), RequestID: requestID(ctx)})
 
-	err = ChownOp(&dir.Attrs, dir.FileSystem, dir.AbsolutePathForChild(req.Name), req.Uid, req.Gid)
+	err = ChownOp(ctx, &dir.Attrs, dir.FileSystem, dir.AbsolutePathForChild(req.Name), req.Uid, req.Gid)
 	if err != nil {
 		logwarn("Unable to change ownership of new dir", Fields{Operation: Create, Path: dir.AbsolutePathForChild(req.Name),
-			UID: req.Uid, GID: req.Gid, Error: err})
+			UID: req.Uid, GID: req.Gid, Error: err, RequestID: requestID(ctx)})
 		//unable to change the ownership of the directory. so delete it as the operation as a whole failed
-		dir.FileSystem.getDFSConnector().Remove(dir.AbsolutePathForChild(req.Name))
+		dir.FileSystem.getDFSConnector().Remove(ctx, dir.AbsolutePathForChild(req.Name))
 		return nil, err
 	}
 
@@ -213,31 +258,41 @@ func (dir *DirINode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node
 }
 
 // Responds on FUSE Create request
-func (dir *DirINode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+func (dir *DirINode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	ctx, done := observeFuse(ctx, "Create")
+	defer func() { done(err) }()
 	dir.lockMutex()
 	defer dir.unlockMutex()
+	defer func() { auditLog.Record(AuditCreate, &req.Header, err, dir.AbsolutePathForChild(req.Name)) }()
+
+	if err := checkNotInSnapshot(dir.AbsolutePath(), Create); err != nil {
+		return nil, nil, err
+	}
 
-	loginfo("Creating a new file", Fields{Operation: Create, Path: dir.AbsolutePathForChild(req.Name), Mode: req.Mode, Flags: req.Flags})
+	loginfo("Creating a new file", Fields{Operation: Create, Path: dir.AbsolutePathForChild(req.Name), Mode: req.Mode, Flags: req.Flags, RequestID: requestID(ctx)})
 	file := dir.NodeFromAttrs(Attrs{Name: req.Name, Mode: req.Mode}).(*FileINode)
-	handle, err := file.NewFileHandle(false, req.Flags)
+	handle, err := file.NewFileHandle(ctx, false, req.Flags)
 	if err != nil {
-		logerror("File creation failed", Fields{Operation: Create, Path: dir.AbsolutePathForChild(req.Name), Mode: req.Mode, Flags: req.Flags, Error: err})
+		logerror("File creation failed", Fields{Operation: Create, Path: dir.AbsolutePathForChild(req.Name), Mode: req.Mode, Flags: req.Flags, Error: err, RequestID: requestID(ctx)})
 		//TODO remove the entry from the cache
 		return nil, nil, err
 	}
 
+	if isDirectIO(req.Flags) {
+		resp.Flags |= fuse.OpenDirectIO
+	}
 	file.AddHandle(handle)
-	err = ChownOp(&dir.Attrs, dir.FileSystem, dir.AbsolutePathForChild(req.Name), req.Uid, req.Gid)
+	err = ChownOp(ctx, &dir.Attrs, dir.FileSystem, dir.AbsolutePathForChild(req.Name), req.Uid, req.Gid)
 	if err != nil {
 		logwarn("Unable to change ownership of new file", Fields{Operation: Create, Path: dir.AbsolutePathForChild(req.Name),
-			UID: req.Uid, GID: req.Gid, Error: err})
+			UID: req.Uid, GID: req.Gid, Error: err, RequestID: requestID(ctx)})
 		//unable to change the ownership of the file. so delete it as the operation as a whole failed
-		dir.FileSystem.getDFSConnector().Remove(dir.AbsolutePathForChild(req.Name))
+		dir.FileSystem.getDFSConnector().Remove(ctx, dir.AbsolutePathForChild(req.Name))
 		return nil, nil, err
 	}
 
 	//update the attributes of the file now
-	err = dir.LookupAttrs(file.Attrs.Name, &file.Attrs)
+	err = dir.LookupAttrs(ctx, file.Attrs.Name, &file.Attrs)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -246,32 +301,125 @@ func (dir *DirINode) Create(ctx context.Context, req *fuse.CreateRequest, resp *
 }
 
 // Responds on FUSE Remove request
-func (dir *DirINode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+func (dir *DirINode) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	ctx, done := observeFuse(ctx, "Remove")
+	defer func() { done(err) }()
 	dir.lockMutex()
 	defer dir.unlockMutex()
+	defer func() { auditLog.Record(AuditRemove, &req.Header, err, dir.AbsolutePathForChild(req.Name)) }()
+
+	if dir.isSnapshotDir() && req.Dir {
+		return dir.deleteSnapshot(ctx, req.Name)
+	}
 
 	path := dir.AbsolutePathForChild(req.Name)
-	loginfo("Removing path", Fields{Operation: Remove, Path: path})
-	err := dir.FileSystem.getDFSConnector().Remove(path)
+	if err := dir.checkNotControlDir(req.Name, Remove); err != nil {
+		return err
+	}
+	if err := checkNotInSnapshot(path, Remove); err != nil {
+		return err
+	}
+	if err := dir.checkRemoveType(req.Name, req.Dir); err != nil {
+		return err
+	}
+	if dir.FileSystem.shouldMoveToTrash(path, req.Pid) {
+		err = dir.FileSystem.moveToTrash(ctx, path, req.Dir)
+	} else {
+		loginfo("Removing path", Fields{Operation: Remove, Path: path, RequestID: requestID(ctx)})
+		err = dir.FileSystem.getDFSConnector().Remove(ctx, path)
+	}
 	if err == nil {
 		dir.EntriesRemove(req.Name)
 	} else {
-		logwarn("Failed to remove path", Fields{Operation: Remove, Path: path, Error: err})
+		logwarn("Failed to remove path", Fields{Operation: Remove, Path: path, Error: err, RequestID: requestID(ctx)})
 	}
 	return err
 }
 
+// Checks that unlink is not called on a directory and rmdir is not called on a
+// file, using the cached entry. Entries which are not cached are not checked:
+// the kernel checks the type of the node it looked up, and the namenode refuses
+// to remove a non-empty directory
+func (dir *DirINode) checkRemoveType(name string, rmdir bool) error {
+	attrs, ok := dir.cachedAttrs(name)
+	if !ok {
+		return nil
+	}
+	isDir := (attrs.Mode & os.ModeDir) != 0
+	if rmdir && !isDir {
+		return syscall.ENOTDIR
+	}
+	if !rmdir && isDir {
+		return syscall.EISDIR
+	}
+	return nil
+}
+
+// Removes a directory subtree with a single recursive delete
+func (dir *DirINode) removeRecursive(ctx context.Context, name string, pid uint32) error {
+	dir.lockMutex()
+	defer dir.unlockMutex()
+
+	path := dir.AbsolutePathForChild(name)
+	if err := checkNotInSnapshot(path, RemoveAll); err != nil {
+		return err
+	}
+
+	var err error
+	if dir.FileSystem.shouldMoveToTrash(path, pid) {
+		err = dir.FileSystem.moveToTrash(ctx, path, false)
+	} else {
+		loginfo("Removing directory recursively", Fields{Operation: RemoveAll, Path: path, RequestID: requestID(ctx)})
+		err = dir.FileSystem.getDFSConnector().RemoveAll(ctx, path)
+	}
+	if err != nil {
+		logwarn("Failed to remove directory recursively", Fields{Operation: RemoveAll, Path: path, Error: err, RequestID: requestID(ctx)})
+		return err
+	}
+	dir.EntriesRemove(name)
+	dir.FileSystem.invalidateEntry(dir, name)
+	return nil
+}
+
 // Responds on FUSE Rename request
-func (dir *DirINode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+func (dir *DirINode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	ctx, done := observeFuse(ctx, "Rename")
+	defer func() { done(err) }()
 	dir.lockMutex()
 	defer dir.unlockMutex()
 
+	if _, ok := newDir.(*DirINode); !ok {
+		return syscall.EPERM // renaming into the control directory
+	}
+	defer func() {
+		auditLog.Record(AuditRename, &req.Header, err, dir.AbsolutePathForChild(req.OldName), newDir.(*DirINode).AbsolutePathForChild(req.NewName))
+	}()
+	if err := dir.checkNotControlDir(req.OldName, Rename); err != nil {
+		return err
+	}
+	if err := newDir.(*DirINode).checkNotControlDir(req.NewName, Rename); err != nil {
+		return err
+	}
 	oldPath := dir.AbsolutePathForChild(req.OldName)
 	newPath := newDir.(*DirINode).AbsolutePathForChild(req.NewName)
-	loginfo("Renaming to "+newPath, Fields{Operation: Rename, Path: oldPath})
-	err := dir.FileSystem.getDFSConnector().Rename(oldPath, newPath)
+	if err := checkNotInSnapshot(oldPath, Rename); err != nil {
+		return err
+	}
+	if err := checkNotInSnapshot(newPath, Rename); err != nil {
+		return err
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	if err := dir.checkRenameTarget(ctx, req.OldName, newDir.(*DirINode), req.NewName); err != nil {
+		return err
+	}
+	loginfo("Renaming to "+newPath, Fields{Operation: Rename, Path: oldPath, RequestID: requestID(ctx)})
+	err = dir.FileSystem.getDFSConnector().Rename(ctx, oldPath, newPath)
 	if err == nil {
-		// Upon successful rename, updating in-memory representation of the file entry
+		// Upon successful rename, updating in-memory representation of the file entry.
+		// The replaced target, if any, is dropped from the cache
+		newDir.(*DirINode).EntriesRemove(req.NewName)
 		if node := dir.EntriesGet(req.OldName); node != nil {
 			if fnode, ok := (*node).(*FileINode); ok {
 				fnode.Attrs.Name = req.NewName
@@ -287,38 +435,149 @@ func (dir *DirINode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir
 	return err
 }
 
+// Checks if the source can replace the target of a rename. The namenode
+// refuses invalid targets with a generic IOException, so the POSIX rules are
+// enforced here: a directory can only replace an empty directory and a file
+// can only replace a file
+func (dir *DirINode) checkRenameTarget(ctx context.Context, oldName string, newDir *DirINode, newName string) error {
+	target, err := newDir.entryAttrs(ctx, newName)
+	if err == syscall.ENOENT {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	source, err := dir.entryAttrs(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	sourceIsDir := (source.Mode & os.ModeDir) != 0
+	targetIsDir := (target.Mode & os.ModeDir) != 0
+	if sourceIsDir && !targetIsDir {
+		return syscall.ENOTDIR
+	}
+	if !sourceIsDir && targetIsDir {
+		return syscall.EISDIR
+	}
+	if targetIsDir {
+		entries, err := dir.FileSystem.getDFSConnector().ReadDir(ctx, newDir.AbsolutePathForChild(newName))
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	logdebug("Rename replaces existing target", Fields{Operation: Rename, Path: newDir.AbsolutePathForChild(newName), RequestID: requestID(ctx)})
+	return nil
+}
+
+// Returns the attributes of a child from the cache, or stats it if not cached
+func (dir *DirINode) entryAttrs(ctx context.Context, name string) (Attrs, error) {
+	if attrs, ok := dir.cachedAttrs(name); ok {
+		return attrs, nil
+	}
+	return dir.FileSystem.getDFSConnector().Stat(ctx, dir.AbsolutePathForChild(name))
+}
+
+// Returns the attributes of a child if it is cached
+func (dir *DirINode) cachedAttrs(name string) (Attrs, bool) {
+	if node := dir.EntriesGet(name); node != nil {
+		switch n := (*node).(type) {
+		case *FileINode:
+			return n.Attrs, true
+		case *DirINode:
+			return n.Attrs, true
+		}
+	}
+	return Attrs{}, false
+}
+
 // Responds on FUSE Chmod request
-func (dir *DirINode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+func (dir *DirINode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	ctx, done := observeFuse(ctx, "Setattr")
+	defer func() { done(err) }()
 	dir.lockMutex()
 	defer dir.unlockMutex()
+	defer func() { auditLog.RecordSetattr(req, err, dir.AbsolutePath()) }()
 
 	if req.Valid.Size() {
 		return fmt.Errorf("unsupported operation. Can not set size of a directory")
 	}
 
 	path := dir.AbsolutePath()
+	if err := checkNotInSnapshot(path, Setattr); err != nil {
+		return err
+	}
 
 	if req.Valid.Mode() {
-		if err := ChmodOp(&dir.Attrs, dir.FileSystem, path, req, resp); err != nil {
-			logwarn("Setattr (chmod) failed. ", Fields{Operation: Chmod, Path: path, Mode: req.Mode})
+		if err := ChmodOp(ctx, &dir.Attrs, dir.FileSystem, path, req, resp); err != nil {
+			logwarn("Setattr (chmod) failed. ", Fields{Operation: Chmod, Path: path, Mode: req.Mode, RequestID: requestID(ctx)})
 			return err
 		}
 	}
 
 	if req.Valid.Uid() || req.Valid.Gid() {
-		if err := SetAttrChownOp(&dir.Attrs, dir.FileSystem, path, req, resp); err != nil {
-			logwarn("Setattr (chown/chgrp )failed", Fields{Operation: Chmod, Path: path, UID: req.Uid, GID: req.Gid})
+		if err := SetAttrChownOp(ctx, &dir.Attrs, dir.FileSystem, path, req, resp); err != nil {
+			logwarn("Setattr (chown/chgrp )failed", Fields{Operation: Chmod, Path: path, UID: req.Uid, GID: req.Gid, RequestID: requestID(ctx)})
 			return err
 		}
 	}
 
-	if err := UpdateTS(&dir.Attrs, dir.FileSystem, path, req, resp); err != nil {
+	if err := UpdateTS(ctx, &dir.Attrs, dir.FileSystem, path, req, resp); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Responds on FUSE Getxattr request
+func (dir *DirINode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	ctx, done := observeFuse(ctx, "Getxattr")
+	defer func() { done(err) }()
+	if req.Name != QuotaXattr {
+		return fuse.ErrNoXattr
+	}
+
+	path := dir.AbsolutePath()
+	quota, err := dir.FileSystem.getDFSConnector().GetQuota(ctx, path)
+	if err != nil {
+		logwarn("Failed to get quota", Fields{Operation: GetXattr, Path: path, Error: err, RequestID: requestID(ctx)})
 		return err
 	}
+	data, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+	resp.Xattr = data
+	return nil
+}
 
+// Responds on FUSE Listxattr request
+func (dir *DirINode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	ctx, done := observeFuse(ctx, "Listxattr")
+	defer func() { done(err) }()
+	resp.Append(QuotaXattr)
 	return nil
 }
 
+// Responds on FUSE Setxattr request. Only control attributes are supported
+func (dir *DirINode) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	ctx, done := observeFuse(ctx, "Setxattr")
+	defer func() { done(err) }()
+	if req.Name != RecursiveDeleteXattr {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	if string(req.Xattr) != "1" {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if dir.Parent == nil {
+		return fuse.Errno(syscall.EBUSY)
+	}
+	defer func() { auditLog.Record(AuditRmtree, &req.Header, err, dir.AbsolutePath()) }()
+	return dir.Parent.removeRecursive(ctx, dir.Attrs.Name, req.Pid)
+}
+
 func (dir *DirINode) lockMutex() {
 	dir.mutex.Lock()
 }
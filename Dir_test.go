@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"os"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -20,7 +21,7 @@ func TestAttributeCaching(t *testing.T) {
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 	root, _ := fs.Root()
-	hdfsAccessor.EXPECT().Stat("/testDir").Return(Attrs{Name: "testDir", Mode: os.ModeDir | 0757}, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/testDir").Return(Attrs{Name: "testDir", Mode: os.ModeDir | 0757}, nil)
 	dir, err := root.(*DirINode).Lookup(nil, "testDir")
 	assert.Nil(t, err)
 	// Second call to Lookup(), shouldn't re-issue Stat() on backend
@@ -43,7 +44,7 @@ func TestAttributeCaching(t *testing.T) {
 
 	// After 30+31=61 seconds, attempt to query attributes should re-issue a Stat() request to the backend
 	// this time returing different attributes (555 instead of 757)
-	hdfsAccessor.EXPECT().Stat("/testDir").Return(Attrs{Name: "testDir", Mode: os.ModeDir | 0555}, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/testDir").Return(Attrs{Name: "testDir", Mode: os.ModeDir | 0555}, nil)
 	mockClock.NotifyTimeElapsed(4 * time.Second)
 	assert.Nil(t, dir.Attr(nil, &attr))
 	assert.Equal(t, os.ModeDir|0555, attr.Mode)
@@ -59,7 +60,7 @@ func TestReadDirWithFiltering(t *testing.T) {
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"foo", "bar"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 	root, _ := fs.Root()
-	hdfsAccessor.EXPECT().ReadDir("/").Return([]Attrs{
+	hdfsAccessor.EXPECT().ReadDir(gomock.Any(), "/").Return([]Attrs{
 		{Name: "quz", Mode: os.ModeDir},
 		{Name: "foo", Mode: os.ModeDir},
 		{Name: "bar", Mode: os.ModeDir},
@@ -80,7 +81,7 @@ func TestReadDirWithZipExpansionDisabled(t *testing.T) {
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 	root, _ := fs.Root()
-	hdfsAccessor.EXPECT().ReadDir("/").Return([]Attrs{
+	hdfsAccessor.EXPECT().ReadDir(gomock.Any(), "/").Return([]Attrs{
 		{Name: "foo.zipx"},
 		{Name: "dir.zip", Mode: os.ModeDir},
 		{Name: "bar.zip"},
@@ -100,7 +101,7 @@ func TestLookupWithFiltering(t *testing.T) {
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"foo", "bar"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 	root, _ := fs.Root()
-	hdfsAccessor.EXPECT().Stat("/foo").Return(Attrs{Name: "foo", Mode: os.ModeDir}, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/foo").Return(Attrs{Name: "foo", Mode: os.ModeDir}, nil)
 	_, err := root.(*DirINode).Lookup(nil, "foo")
 	assert.Nil(t, err)
 	_, err = root.(*DirINode).Lookup(nil, "qux")
@@ -113,10 +114,10 @@ func TestMkdir(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	mockClock := &MockClock{}
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
-	hdfsAccessor.EXPECT().Chown(dir, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), dir, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"foo", "bar"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 	root, _ := fs.Root()
-	hdfsAccessor.EXPECT().Mkdir(dir, os.FileMode(0757)|os.ModeDir).Return(nil)
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), dir, os.FileMode(0757)|os.ModeDir).Return(nil)
 	node, err := root.(*DirINode).Mkdir(nil, &fuse.MkdirRequest{Name: "foo", Mode: os.FileMode(0757) | os.ModeDir})
 	assert.Nil(t, err)
 	assert.Equal(t, "foo", node.(*DirINode).Attrs.Name)
@@ -128,18 +129,252 @@ func TestSetattr(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	mockClock := &MockClock{}
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
-	hdfsAccessor.EXPECT().Chown(dir, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), dir, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"foo", "bar"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 	root, _ := fs.Root()
-	hdfsAccessor.EXPECT().Mkdir(dir, os.FileMode(0757)|os.ModeDir).Return(nil)
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), dir, os.FileMode(0757)|os.ModeDir).Return(nil)
 	node, _ := root.(*DirINode).Mkdir(nil, &fuse.MkdirRequest{Name: "foo", Mode: os.FileMode(0757) | os.ModeDir})
-	hdfsAccessor.EXPECT().Chmod(dir, os.FileMode(0777)).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().Chmod(gomock.Any(), dir, os.FileMode(0777)).Return(nil).AnyTimes()
 	err := node.(*DirINode).Setattr(nil, &fuse.SetattrRequest{Mode: os.FileMode(0777), Valid: fuse.SetattrMode}, &fuse.SetattrResponse{})
 	assert.Nil(t, err)
 	assert.Equal(t, os.FileMode(0777), node.(*DirINode).Attrs.Mode)
 
-	hdfsAccessor.EXPECT().Chown(dir, "root", gomock.Any()).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), dir, "root", gomock.Any()).Return(nil).AnyTimes()
 	err = node.(*DirINode).Setattr(nil, &fuse.SetattrRequest{Uid: 0, Valid: fuse.SetattrUid}, &fuse.SetattrResponse{})
 	assert.Nil(t, err)
 	assert.Equal(t, uint32(0), node.(*DirINode).Attrs.Uid)
 }
+
+// Testing utimens
+func TestSetTimes(t *testing.T) {
+	dir := "/foo"
+	mockCtrl := gomock.NewController(t)
+	now := time.Unix(1600000000, 0)
+	mockClock := &MockClock{now: now}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	atime := time.Unix(1500000000, 0)
+	mtime := time.Unix(1400000000, 0)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), dir).Return(Attrs{Name: "foo", Mode: os.ModeDir | 0757, Atime: atime, Mtime: mtime}, nil)
+	node, err := root.(*DirINode).Lookup(nil, "foo")
+	assert.Nil(t, err)
+
+	// mtime only, atime is kept
+	newMtime := time.Unix(1450000000, 0)
+	hdfsAccessor.EXPECT().SetTimes(gomock.Any(), dir, atime, newMtime).Return(nil)
+	err = node.(*DirINode).Setattr(nil, &fuse.SetattrRequest{Mtime: newMtime, Valid: fuse.SetattrMtime}, &fuse.SetattrResponse{})
+	assert.Nil(t, err)
+	assert.Equal(t, newMtime, node.(*DirINode).Attrs.Mtime)
+
+	// touch sets both to the current time
+	hdfsAccessor.EXPECT().SetTimes(gomock.Any(), dir, now, now).Return(nil)
+	err = node.(*DirINode).Setattr(nil, &fuse.SetattrRequest{Valid: fuse.SetattrAtime | fuse.SetattrAtimeNow | fuse.SetattrMtime | fuse.SetattrMtimeNow}, &fuse.SetattrResponse{})
+	assert.Nil(t, err)
+	var attr fuse.Attr
+	assert.Nil(t, node.Attr(nil, &attr))
+	assert.Equal(t, now, attr.Atime)
+	assert.Equal(t, now, attr.Mtime)
+
+	// failures are reported and the cache is not updated
+	hdfsAccessor.EXPECT().SetTimes(gomock.Any(), dir, atime, now).Return(syscall.EPERM)
+	err = node.(*DirINode).Setattr(nil, &fuse.SetattrRequest{Atime: atime, Valid: fuse.SetattrAtime}, &fuse.SetattrResponse{})
+	assert.Equal(t, syscall.EPERM, err)
+	assert.Equal(t, now, node.(*DirINode).Attrs.Atime)
+}
+
+// Testing quota extended attribute
+func TestQuotaXattr(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/foo").Return(Attrs{Name: "foo", Mode: os.ModeDir | 0755}, nil)
+	dir, err := root.(*DirINode).Lookup(nil, "foo")
+	assert.Nil(t, err)
+
+	hdfsAccessor.EXPECT().GetQuota(gomock.Any(), "/foo").Return(QuotaInfo{NameQuota: 10, NameUsed: 2, SpaceQuota: -1, SpaceUsed: 30, Length: 10}, nil)
+	resp := &fuse.GetxattrResponse{}
+	err = dir.(*DirINode).Getxattr(nil, &fuse.GetxattrRequest{Name: QuotaXattr}, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name_quota":10,"name_used":2,"space_quota":-1,"space_used":30,"length":10}`, string(resp.Xattr))
+
+	err = dir.(*DirINode).Getxattr(nil, &fuse.GetxattrRequest{Name: "user.other"}, &fuse.GetxattrResponse{})
+	assert.Equal(t, fuse.ErrNoXattr, err)
+}
+
+// Testing creation, deletion and read-only content of snapshots
+func TestSnapshotDir(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/foo").Return(Attrs{Name: "foo", Mode: os.ModeDir | 0750, Uid: 10}, nil)
+	foo, err := root.(*DirINode).Lookup(nil, "foo")
+	assert.Nil(t, err)
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/foo/.snapshot").Return(Attrs{Name: ".snapshot", Mode: os.ModeDir | 0555}, nil)
+	snapshotDir, err := foo.(*DirINode).Lookup(nil, ".snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeDir|0750, snapshotDir.(*DirINode).Attrs.Mode)
+	assert.Equal(t, uint32(10), snapshotDir.(*DirINode).Attrs.Uid)
+
+	hdfsAccessor.EXPECT().CreateSnapshot(gomock.Any(), "/foo", "s1").Return(nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/foo/.snapshot/s1").Return(Attrs{Name: "s1", Mode: os.ModeDir | 0750}, nil)
+	s1, err := snapshotDir.(*DirINode).Mkdir(nil, &fuse.MkdirRequest{Name: "s1", Mode: os.ModeDir | 0755})
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeDir|0550, s1.(*DirINode).Attrs.Mode)
+
+	// content of the snapshots is read-only
+	_, err = s1.(*DirINode).Mkdir(nil, &fuse.MkdirRequest{Name: "bar", Mode: os.ModeDir | 0755})
+	assert.Equal(t, syscall.EROFS, err)
+	err = s1.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "bar"})
+	assert.Equal(t, syscall.EROFS, err)
+	err = snapshotDir.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "s1"})
+	assert.Equal(t, syscall.EROFS, err)
+
+	hdfsAccessor.EXPECT().DeleteSnapshot(gomock.Any(), "/foo", "s1").Return(nil)
+	err = snapshotDir.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "s1", Dir: true})
+	assert.Nil(t, err)
+}
+
+// Testing rmdir/unlink semantics and recursive delete
+func TestRemoveDirectory(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/foo").Return(Attrs{Name: "foo", Mode: os.ModeDir | 0755}, nil)
+	foo, err := root.(*DirINode).Lookup(nil, "foo")
+	assert.Nil(t, err)
+
+	err = root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "foo"})
+	assert.Equal(t, syscall.EISDIR, err)
+
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), "/foo").Return(syscall.ENOTEMPTY)
+	err = root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "foo", Dir: true})
+	assert.Equal(t, syscall.ENOTEMPTY, err)
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/bar").Return(Attrs{Name: "bar"}, nil)
+	_, err = root.(*DirINode).Lookup(nil, "bar")
+	assert.Nil(t, err)
+	err = root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "bar", Dir: true})
+	assert.Equal(t, syscall.ENOTDIR, err)
+
+	// entries which are not cached are removed without a stat
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), "/baz").Return(nil)
+	err = root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "baz"})
+	assert.Nil(t, err)
+
+	err = foo.(*DirINode).Setxattr(nil, &fuse.SetxattrRequest{Name: RecursiveDeleteXattr, Xattr: []byte("0")})
+	assert.Equal(t, fuse.Errno(syscall.EINVAL), err)
+
+	hdfsAccessor.EXPECT().RemoveAll(gomock.Any(), "/foo").Return(nil)
+	err = foo.(*DirINode).Setxattr(nil, &fuse.SetxattrRequest{Name: RecursiveDeleteXattr, Xattr: []byte("1")})
+	assert.Nil(t, err)
+	assert.Nil(t, root.(*DirINode).EntriesGet("foo"))
+}
+
+// Testing rename over an existing target
+func TestRenameOverwrite(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/dir").Return(Attrs{Name: "dir", Mode: os.ModeDir | 0755}, nil)
+	dir, err := root.(*DirINode).Lookup(nil, "dir")
+	assert.Nil(t, err)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/dir/b").Return(Attrs{Name: "b", Mode: 0644, Size: 2}, nil)
+	oldTarget, err := dir.(*DirINode).Lookup(nil, "b")
+	assert.Nil(t, err)
+
+	// file replaces a file, the old target is dropped from the cache of the target directory
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/a").Return(Attrs{Name: "a", Mode: 0644, Size: 1}, nil)
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/a", "/dir/b").Return(nil)
+	err = root.(*DirINode).Rename(nil, &fuse.RenameRequest{OldName: "a", NewName: "b"}, dir)
+	assert.Nil(t, err)
+	assert.Nil(t, dir.(*DirINode).EntriesGet("b"))
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/dir/b").Return(Attrs{Name: "b", Mode: 0644, Size: 1}, nil)
+	newTarget, err := dir.(*DirINode).Lookup(nil, "b")
+	assert.Nil(t, err)
+	assert.NotEqual(t, oldTarget, newTarget)
+
+	// the namenode refuses invalid targets with an IOException, which the
+	// client reports as os.ErrInvalid, the rules are checked before renaming
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/c", gomock.Any()).Return(os.ErrInvalid).AnyTimes()
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/a", gomock.Any()).Return(os.ErrInvalid).AnyTimes()
+
+	// directory can not replace a file
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/c").Return(Attrs{Name: "c", Mode: os.ModeDir | 0755}, nil)
+	err = root.(*DirINode).Rename(nil, &fuse.RenameRequest{OldName: "c", NewName: "b"}, dir)
+	assert.Equal(t, syscall.ENOTDIR, err)
+
+	// file can not replace a directory
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/e").Return(Attrs{Name: "e", Mode: os.ModeDir | 0755}, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/a").Return(Attrs{Name: "a", Mode: 0644}, nil)
+	err = root.(*DirINode).Rename(nil, &fuse.RenameRequest{OldName: "a", NewName: "e"}, root)
+	assert.Equal(t, syscall.EISDIR, err)
+
+	// directory can replace only an empty directory, the cache is kept
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/c").Return(Attrs{Name: "c", Mode: os.ModeDir | 0755}, nil)
+	hdfsAccessor.EXPECT().ReadDir(gomock.Any(), "/dir").Return([]Attrs{{Name: "b"}}, nil)
+	err = root.(*DirINode).Rename(nil, &fuse.RenameRequest{OldName: "c", NewName: "dir"}, root)
+	assert.Equal(t, syscall.ENOTEMPTY, err)
+	assert.Equal(t, dir, *root.(*DirINode).EntriesGet("dir"))
+}
+
+// Testing hard link policies
+func TestLink(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	file := root.(*DirINode).NodeFromAttrs(Attrs{Name: "a", Mode: 0644, Size: 1000})
+
+	_, err := root.(*DirINode).Link(nil, &fuse.LinkRequest{NewName: "b"}, file)
+	assert.Equal(t, syscall.EPERM, err)
+
+	fs.HardLinks = HardLinksENOTSUP
+	_, err = root.(*DirINode).Link(nil, &fuse.LinkRequest{NewName: "b"}, file)
+	assert.Equal(t, syscall.ENOTSUP, err)
+
+	fs.HardLinks = HardLinksCopy
+	content := &MockReadSeekCloserWithPseudoRandomContent{FileSize: 1000}
+	hdfsAccessor.EXPECT().OpenRead(gomock.Any(), "/a").Return(content, nil)
+	hdfswriter := NewMockHdfsWriter(mockCtrl)
+	hdfswriter.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) { return len(b), nil }).MinTimes(1)
+	hdfswriter.EXPECT().Close().Return(nil)
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), "/b", os.FileMode(0644), false).Return(hdfswriter, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/b").Return(Attrs{Name: "b", Mode: 0644, Size: 1000}, nil)
+	node, err := root.(*DirINode).Link(nil, &fuse.LinkRequest{NewName: "b"}, file)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), node.(*FileINode).Attrs.Size)
+}
+
+// Testing mknod
+func TestMknod(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+
+	_, err := root.(*DirINode).Mknod(nil, &fuse.MknodRequest{Name: "fifo", Mode: os.ModeNamedPipe | 0644})
+	assert.Equal(t, syscall.EPERM, err)
+
+	hdfswriter := NewMockHdfsWriter(mockCtrl)
+	hdfswriter.EXPECT().Close().Return(nil)
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), "/file", os.FileMode(0644), false).Return(hdfswriter, nil)
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), "/file", gomock.Any(), gomock.Any()).Return(nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/file").Return(Attrs{Name: "file", Mode: 0644}, nil)
+	node, err := root.(*DirINode).Mknod(nil, &fuse.MknodRequest{Name: "file", Mode: 0644})
+	assert.Nil(t, err)
+	_, ok := node.(*FileINode)
+	assert.True(t, ok)
+}
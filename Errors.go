@@ -0,0 +1,168 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/colinmarc/hdfs/v2"
+)
+
+// Errnos of the HDFS remote exceptions. The client library already translates
+// some exceptions to os errors or errnos, those are handled by
+// unwrapAndTranslateError
+var exceptionErrnos = map[string]syscall.Errno{
+	"java.io.FileNotFoundException":                                                       syscall.ENOENT,
+	"org.apache.hadoop.security.AccessControlException":                                   syscall.EACCES,
+	"org.apache.hadoop.hdfs.protocol.SnapshotAccessControlException":                      syscall.EROFS,
+	"org.apache.hadoop.fs.PathIsNotEmptyDirectoryException":                               syscall.ENOTEMPTY,
+	"org.apache.hadoop.fs.FileAlreadyExistsException":                                     syscall.EEXIST,
+	"org.apache.hadoop.hdfs.protocol.AlreadyBeingCreatedException":                        syscall.EBUSY,
+	"org.apache.hadoop.hdfs.protocol.RecoveryInProgressException":                         syscall.EBUSY,
+	"org.apache.hadoop.hdfs.server.namenode.LeaseExpiredException":                        syscall.ESTALE,
+	"org.apache.hadoop.fs.InvalidPathException":                                           syscall.EINVAL,
+	"org.apache.hadoop.fs.PathIsNotDirectoryException":                                    syscall.ENOTDIR,
+	"org.apache.hadoop.fs.PathIsDirectoryException":                                       syscall.EISDIR,
+	"org.apache.hadoop.hdfs.protocol.QuotaExceededException":                              syscall.EDQUOT,
+	"org.apache.hadoop.hdfs.protocol.DSQuotaExceededException":                            syscall.EDQUOT,
+	"org.apache.hadoop.hdfs.protocol.NSQuotaExceededException":                            syscall.EDQUOT,
+	"org.apache.hadoop.hdfs.protocol.FSLimitException$PathComponentTooLongException":      syscall.ENAMETOOLONG,
+	"org.apache.hadoop.hdfs.protocol.FSLimitException$MaxDirectoryItemsExceededException": syscall.ENOSPC,
+	"org.apache.hadoop.fs.UnresolvedLinkException":                                        syscall.ENOLINK,
+	"org.apache.hadoop.HadoopIllegalArgumentException":                                    syscall.EINVAL,
+	"java.lang.IllegalArgumentException":                                                  syscall.EINVAL,
+	"java.lang.UnsupportedOperationException":                                             syscall.ENOTSUP,
+	"org.apache.hadoop.hdfs.server.namenode.NotReplicatedYetException":                    syscall.EAGAIN,
+	"org.apache.hadoop.ipc.RetriableException":                                            syscall.EAGAIN,
+	"org.apache.hadoop.ipc.StandbyException":                                              syscall.EAGAIN,
+}
+
+const safeModeException = "org.apache.hadoop.hdfs.server.namenode.SafeModeException"
+
+// Error of the mutations rejected because the namenode is in safe mode. It is
+// reported to applications as EROFS but, unlike the other EROFS errors such as
+// writes into snapshots, it makes the mount read-only until the namenode
+// leaves safe mode
+type safeModeError struct{}
+
+var errSafeMode error = safeModeError{}
+
+func (safeModeError) Error() string     { return "namenode is in safe mode" }
+func (safeModeError) Errno() fuse.Errno { return fuse.Errno(syscall.EROFS) }
+
+// Errnos which are returned to the caller without retrying the operation
+var nonRetriableErrnos = map[syscall.Errno]bool{
+	syscall.ENOENT:       true,
+	syscall.EACCES:       true,
+	syscall.EPERM:        true,
+	syscall.ENOTEMPTY:    true,
+	syscall.EEXIST:       true,
+	syscall.EBUSY:        true,
+	syscall.ESTALE:       true,
+	syscall.EINVAL:       true,
+	syscall.ENOTDIR:      true,
+	syscall.EISDIR:       true,
+	syscall.EROFS:        true,
+	syscall.EDQUOT:       true,
+	syscall.ENAMETOOLONG: true,
+	syscall.ENOSPC:       true,
+	syscall.ENOLINK:      true,
+	syscall.ENOTSUP:      true,
+	syscall.EBADF:        true,
+	syscall.EINTR:        true,
+	syscall.ENOTCONN:     true,
+}
+
+// Translates errors returned by the HDFS client to errnos. Errors which have
+// no errno, e.g. connection failures, are returned as they are
+func unwrapAndTranslateError(err error) error {
+	var e error
+	pathError, ok := err.(*os.PathError)
+	if ok {
+		e = pathError.Err
+	} else {
+		e = err
+	}
+
+	switch e {
+	case os.ErrNotExist:
+		return syscall.ENOENT
+	case os.ErrPermission:
+		return syscall.EACCES
+	case os.ErrExist:
+		return syscall.EEXIST
+	case os.ErrClosed:
+		return syscall.EBADF
+	case syscall.EROFS:
+		// the library reports SafeModeException as EROFS
+		return errSafeMode
+	}
+	// os.ErrInvalid is not translated, the library also returns it for
+	// generic java.io.IOException, which are I/O errors rather than EINVAL.
+	// HopsFS reports failed transactions as such exceptions, so they are
+	// retried and then reported as EIO
+
+	switch t := e.(type) {
+	case fuse.Errno:
+		return syscall.Errno(t)
+	case hdfs.Error:
+		if t.Exception() == safeModeException {
+			return errSafeMode
+		}
+		if errno, ok := exceptionErrnos[t.Exception()]; ok {
+			return errno
+		}
+	}
+	return e
+}
+
+func isNonRetriableError(err error) bool {
+	if err == io.EOF ||
+		err == os.ErrNotExist ||
+		err == os.ErrPermission ||
+		err == os.ErrExist ||
+		err == os.ErrClosed {
+		return true
+	}
+	switch t := err.(type) {
+	case safeModeError:
+		return true
+	case fuse.Errno:
+		return nonRetriableErrnos[syscall.Errno(t)]
+	case syscall.Errno:
+		return nonRetriableErrnos[t]
+	}
+	return false
+}
+
+// Returns true for the network errors reaching the namenode, as opposed to
+// the answers of the namenode, including errors like os.ErrInvalid
+func isConnectionFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// the client library reports failed connections to all namenodes as text
+	return strings.Contains(err.Error(), "no available namenodes")
+}
+
+// Returns the name of the errno reported to FUSE for the error, e.g. ENOENT.
+// Errors without an errno are reported as EIO
+func errnoName(err error) string {
+	switch e := err.(type) {
+	case fuse.ErrorNumber:
+		return e.Errno().ErrnoName()
+	case syscall.Errno:
+		return fuse.Errno(e).ErrnoName()
+	}
+	return fuse.EIO.ErrnoName()
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// Remote exception as returned by the HDFS client
+type remoteException struct {
+	exception string
+}
+
+func (e remoteException) Method() string    { return "create" }
+func (e remoteException) Desc() string      { return "ERROR_APPLICATION" }
+func (e remoteException) Exception() string { return e.exception }
+func (e remoteException) Message() string   { return e.exception + ": test" }
+func (e remoteException) Error() string     { return e.Message() }
+
+// Testing translation of HDFS errors to errnos
+func TestUnwrapAndTranslateError(t *testing.T) {
+	connectionError := errors.New("connection refused")
+	tests := []struct {
+		err          error
+		expected     error
+		nonRetriable bool
+	}{
+		{nil, nil, false},
+		{&os.PathError{Op: "stat", Path: "/a", Err: os.ErrNotExist}, syscall.ENOENT, true},
+		{&os.PathError{Op: "mkdir", Path: "/a", Err: os.ErrExist}, syscall.EEXIST, true},
+		{&os.PathError{Op: "chmod", Path: "/a", Err: os.ErrPermission}, syscall.EACCES, true},
+		{os.ErrClosed, syscall.EBADF, true},
+		{fuse.EEXIST, syscall.EEXIST, true},
+		{&os.PathError{Op: "create", Path: "/a", Err: syscall.EDQUOT}, syscall.EDQUOT, true},
+		{&os.PathError{Op: "create", Path: "/a", Err: syscall.EROFS}, errSafeMode, true},
+		{remoteException{"org.apache.hadoop.hdfs.server.namenode.SafeModeException"}, errSafeMode, true},
+		{&os.PathError{Op: "create", Path: "/a", Err: remoteException{"org.apache.hadoop.hdfs.protocol.AlreadyBeingCreatedException"}}, syscall.EBUSY, true},
+		{remoteException{"org.apache.hadoop.hdfs.server.namenode.LeaseExpiredException"}, syscall.ESTALE, true},
+		{remoteException{"org.apache.hadoop.fs.PathIsNotDirectoryException"}, syscall.ENOTDIR, true},
+		{remoteException{"org.apache.hadoop.hdfs.protocol.QuotaExceededException"}, syscall.EDQUOT, true},
+		{remoteException{"org.apache.hadoop.hdfs.protocol.SnapshotAccessControlException"}, syscall.EROFS, true},
+		{remoteException{"org.apache.hadoop.hdfs.protocol.FSLimitException$PathComponentTooLongException"}, syscall.ENAMETOOLONG, true},
+		{remoteException{"org.apache.hadoop.ipc.StandbyException"}, syscall.EAGAIN, false},
+		{&os.PathError{Op: "create", Path: "/a", Err: syscall.EPROTO}, syscall.EPROTO, false},
+		{&os.PathError{Op: "read", Path: "/a", Err: connectionError}, connectionError, false},
+		{&os.PathError{Op: "rename", Path: "/a", Err: os.ErrInvalid}, os.ErrInvalid, false},
+		{remoteException{"java.lang.NullPointerException"}, remoteException{"java.lang.NullPointerException"}, false},
+	}
+	for _, test := range tests {
+		err := unwrapAndTranslateError(test.err)
+		assert.Equal(t, test.expected, err, "%v", test.err)
+		assert.Equal(t, test.nonRetriable, isNonRetriableError(err), "%v", test.err)
+	}
+
+	assert.True(t, isNonRetriableError(io.EOF))
+	assert.True(t, IsSuccessOrNonRetriableError(&os.PathError{Op: "stat", Path: "/a", Err: os.ErrNotExist}))
+	assert.False(t, IsSuccessOrNonRetriableError(connectionError))
+}
+
+// Testing that only network errors count as connection failures
+func TestIsConnectionFailure(t *testing.T) {
+	assert.True(t, isConnectionFailure(connectionRefused))
+	assert.True(t, isConnectionFailure(&os.PathError{Op: "stat", Path: "/a", Err: connectionRefused}))
+	assert.True(t, isConnectionFailure(syscall.ECONNREFUSED))
+	assert.True(t, isConnectionFailure(fmt.Errorf("no available namenodes: %s", connectionRefused)))
+
+	assert.False(t, isConnectionFailure(nil))
+	assert.False(t, isConnectionFailure(&os.PathError{Op: "rename", Path: "/a", Err: os.ErrInvalid}))
+	assert.False(t, isConnectionFailure(syscall.ENOENT))
+	assert.False(t, isConnectionFailure(errSafeMode))
+	assert.False(t, isConnectionFailure(remoteException{"org.apache.hadoop.ipc.StandbyException"}))
+	assert.False(t, isConnectionFailure(errors.New("unexpected response")))
+}
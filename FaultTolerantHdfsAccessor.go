@@ -4,26 +4,30 @@ package main
 
 import (
 	"os"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
-// Adds automatic retry capability to HdfsAccessor with respect to RetryPolicy
+// Adds automatic retry capability to HdfsAccessor with respect to the RetryPolicy of each class of operations
 type FaultTolerantHdfsAccessor struct {
-	Impl        HdfsAccessor
-	RetryPolicy *RetryPolicy
+	Impl          HdfsAccessor
+	RetryPolicies *RetryPolicies
+	SafeMode      *SafeMode // if set, mutations fail with EROFS while the namenode is in safe mode
 }
 
 var _ HdfsAccessor = (*FaultTolerantHdfsAccessor)(nil) // ensure FaultTolerantHdfsAccessor implements HdfsAccessor
 
-// Creates an instance of FaultTolerantHdfsAccessor
+// Creates an instance of FaultTolerantHdfsAccessor using the retry policy for all classes of operations
 func NewFaultTolerantHdfsAccessor(impl HdfsAccessor, retryPolicy *RetryPolicy) *FaultTolerantHdfsAccessor {
 	return &FaultTolerantHdfsAccessor{
-		Impl:        impl,
-		RetryPolicy: retryPolicy}
+		Impl:          impl,
+		RetryPolicies: NewRetryPolicies(retryPolicy)}
 }
 
 // Ensures HDFS accessor is connected to the HDFS name node
 func (fta *FaultTolerantHdfsAccessor) EnsureConnected() error {
-	op := fta.RetryPolicy.StartOperation()
+	op := fta.RetryPolicies.MetadataRead.StartOperation(context.Background())
 	for {
 		err := fta.Impl.EnsureConnected()
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("Connect: %s", err) {
@@ -33,16 +37,16 @@ func (fta *FaultTolerantHdfsAccessor) EnsureConnected() error {
 }
 
 // Opens HDFS file for reading
-func (fta *FaultTolerantHdfsAccessor) OpenRead(path string) (ReadSeekCloser, error) {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) OpenRead(ctx context.Context, path string) (ReadSeekCloser, error) {
+	op := fta.RetryPolicies.MetadataRead.StartOperation(ctx)
 	for {
-		result, err := fta.Impl.OpenRead(path)
+		result, err := fta.Impl.OpenRead(ctx, path)
 		if err == nil {
 			// wrapping returned HdfsReader with FaultTolerantHdfsReader
-			return NewFaultTolerantHdfsReader(path, result, fta.Impl, fta.RetryPolicy), nil
+			return NewFaultTolerantHdfsReader(path, result, fta.Impl, fta.RetryPolicies.DataRead), nil
 		}
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] OpenRead: %s", path, err) {
-			return nil, err
+			return nil, op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -51,18 +55,23 @@ func (fta *FaultTolerantHdfsAccessor) OpenRead(path string) (ReadSeekCloser, err
 }
 
 // Opens HDFS file for writing
-func (fta *FaultTolerantHdfsAccessor) CreateFile(path string, mode os.FileMode, overwrite bool) (HdfsWriter, error) {
+func (fta *FaultTolerantHdfsAccessor) CreateFile(ctx context.Context, path string, mode os.FileMode, overwrite bool) (HdfsWriter, error) {
 	// TODO: implement fault-tolerance. For now re-try-loop is implemented inside FileHandleWriter
-	return fta.Impl.CreateFile(path, mode, overwrite)
+	if err := fta.SafeMode.Check(); err != nil {
+		return nil, err
+	}
+	result, err := fta.Impl.CreateFile(ctx, path, mode, overwrite)
+	fta.SafeMode.Observe(err)
+	return result, err
 }
 
 // Enumerates HDFS directory
-func (fta *FaultTolerantHdfsAccessor) ReadDir(path string) ([]Attrs, error) {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) ReadDir(ctx context.Context, path string) ([]Attrs, error) {
+	op := fta.RetryPolicies.MetadataRead.StartOperation(ctx)
 	for {
-		result, err := fta.Impl.ReadDir(path)
+		result, err := fta.Impl.ReadDir(ctx, path)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] ReadDir: %s", path, err) {
-			return result, err
+			return result, op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -71,12 +80,12 @@ func (fta *FaultTolerantHdfsAccessor) ReadDir(path string) ([]Attrs, error) {
 }
 
 // Retrieves file/directory attributes
-func (fta *FaultTolerantHdfsAccessor) Stat(path string) (Attrs, error) {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) Stat(ctx context.Context, path string) (Attrs, error) {
+	op := fta.RetryPolicies.MetadataRead.StartOperation(ctx)
 	for {
-		result, err := fta.Impl.Stat(path)
+		result, err := fta.Impl.Stat(ctx, path)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] Stat: %s", path, err) {
-			return result, err
+			return result, op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -85,12 +94,26 @@ func (fta *FaultTolerantHdfsAccessor) Stat(path string) (Attrs, error) {
 }
 
 // Retrieves HDFS usage
-func (fta *FaultTolerantHdfsAccessor) StatFs() (FsInfo, error) {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) StatFs(ctx context.Context) (FsInfo, error) {
+	op := fta.RetryPolicies.MetadataRead.StartOperation(ctx)
 	for {
-		result, err := fta.Impl.StatFs()
+		result, err := fta.Impl.StatFs(ctx)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("StatFs: %s", err) {
-			return result, err
+			return result, op.Error(err)
+		} else {
+			// Clean up the bad connection, to let underline connection to get automatic refresh
+			fta.Impl.Close()
+		}
+	}
+}
+
+// Retrieves quota and usage of a directory
+func (fta *FaultTolerantHdfsAccessor) GetQuota(ctx context.Context, path string) (QuotaInfo, error) {
+	op := fta.RetryPolicies.MetadataRead.StartOperation(ctx)
+	for {
+		result, err := fta.Impl.GetQuota(ctx, path)
+		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] GetQuota: %s", path, err) {
+			return result, op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -99,12 +122,16 @@ func (fta *FaultTolerantHdfsAccessor) StatFs() (FsInfo, error) {
 }
 
 // Creates a directory
-func (fta *FaultTolerantHdfsAccessor) Mkdir(path string, mode os.FileMode) error {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
 	for {
-		err := fta.Impl.Mkdir(path, mode)
+		err := fta.Impl.Mkdir(ctx, path, mode)
+		fta.SafeMode.Observe(err)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] Mkdir %s: %s", path, mode, err) {
-			return err
+			return op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -113,12 +140,34 @@ func (fta *FaultTolerantHdfsAccessor) Mkdir(path string, mode os.FileMode) error
 }
 
 // Removes a file or directory
-func (fta *FaultTolerantHdfsAccessor) Remove(path string) error {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) Remove(ctx context.Context, path string) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
 	for {
-		err := fta.Impl.Remove(path)
+		err := fta.Impl.Remove(ctx, path)
+		fta.SafeMode.Observe(err)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] Remove: %s", path, err) {
-			return err
+			return op.Error(err)
+		} else {
+			// Clean up the bad connection, to let underline connection to get automatic refresh
+			fta.Impl.Close()
+		}
+	}
+}
+
+// Removes a file or directory recursively
+func (fta *FaultTolerantHdfsAccessor) RemoveAll(ctx context.Context, path string) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
+	for {
+		err := fta.Impl.RemoveAll(ctx, path)
+		fta.SafeMode.Observe(err)
+		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] RemoveAll: %s", path, err) {
+			return op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -127,12 +176,16 @@ func (fta *FaultTolerantHdfsAccessor) Remove(path string) error {
 }
 
 // Renames file or directory
-func (fta *FaultTolerantHdfsAccessor) Rename(oldPath string, newPath string) error {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) Rename(ctx context.Context, oldPath string, newPath string) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
 	for {
-		err := fta.Impl.Rename(oldPath, newPath)
+		err := fta.Impl.Rename(ctx, oldPath, newPath)
+		fta.SafeMode.Observe(err)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] Rename to %s: %s", oldPath, newPath, err) {
-			return err
+			return op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -141,12 +194,16 @@ func (fta *FaultTolerantHdfsAccessor) Rename(oldPath string, newPath string) err
 }
 
 // Chmod file or directory
-func (fta *FaultTolerantHdfsAccessor) Chmod(path string, mode os.FileMode) error {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
 	for {
-		err := fta.Impl.Chmod(path, mode)
+		err := fta.Impl.Chmod(ctx, path, mode)
+		fta.SafeMode.Observe(err)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("Chmod [%s] to [%d]: %s", path, mode, err) {
-			return err
+			return op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
@@ -155,12 +212,88 @@ func (fta *FaultTolerantHdfsAccessor) Chmod(path string, mode os.FileMode) error
 }
 
 // Chown file or directory
-func (fta *FaultTolerantHdfsAccessor) Chown(path string, user, group string) error {
-	op := fta.RetryPolicy.StartOperation()
+func (fta *FaultTolerantHdfsAccessor) Chown(ctx context.Context, path string, user, group string) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
 	for {
-		err := fta.Impl.Chown(path, user, group)
+		err := fta.Impl.Chown(ctx, path, user, group)
+		fta.SafeMode.Observe(err)
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("Chown [%s] to [%s:%s]: %s", path, user, group, err) {
-			return err
+			return op.Error(err)
+		} else {
+			// Clean up the bad connection, to let underline connection to get automatic refresh
+			fta.Impl.Close()
+		}
+	}
+}
+
+// Truncates the file to the given size in HDFS
+func (fta *FaultTolerantHdfsAccessor) Truncate(ctx context.Context, path string, size int64) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
+	for {
+		err := fta.Impl.Truncate(ctx, path, size)
+		fta.SafeMode.Observe(err)
+		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("Truncate %s to %d bytes: %s", path, size, err) {
+			return op.Error(err)
+		} else {
+			// Clean up the bad connection, to let underline connection to get automatic refresh
+			fta.Impl.Close()
+		}
+	}
+}
+
+// Changes the access and modification times of the file
+func (fta *FaultTolerantHdfsAccessor) SetTimes(ctx context.Context, path string, atime time.Time, mtime time.Time) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
+	for {
+		err := fta.Impl.SetTimes(ctx, path, atime, mtime)
+		fta.SafeMode.Observe(err)
+		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("SetTimes [%s] to [%v:%v]: %s", path, atime, mtime, err) {
+			return op.Error(err)
+		} else {
+			// Clean up the bad connection, to let underline connection to get automatic refresh
+			fta.Impl.Close()
+		}
+	}
+}
+
+// Creates a snapshot of a snapshottable directory
+func (fta *FaultTolerantHdfsAccessor) CreateSnapshot(ctx context.Context, path string, name string) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
+	for {
+		err := fta.Impl.CreateSnapshot(ctx, path, name)
+		fta.SafeMode.Observe(err)
+		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("CreateSnapshot [%s] %s: %s", path, name, err) {
+			return op.Error(err)
+		} else {
+			// Clean up the bad connection, to let underline connection to get automatic refresh
+			fta.Impl.Close()
+		}
+	}
+}
+
+// Deletes a snapshot of a snapshottable directory
+func (fta *FaultTolerantHdfsAccessor) DeleteSnapshot(ctx context.Context, path string, name string) error {
+	if err := fta.SafeMode.Check(); err != nil {
+		return err
+	}
+	op := fta.RetryPolicies.MetadataMutation.StartOperation(ctx)
+	for {
+		err := fta.Impl.DeleteSnapshot(ctx, path, name)
+		fta.SafeMode.Observe(err)
+		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("DeleteSnapshot [%s] %s: %s", path, name, err) {
+			return op.Error(err)
 		} else {
 			// Clean up the bad connection, to let underline connection to get automatic refresh
 			fta.Impl.Close()
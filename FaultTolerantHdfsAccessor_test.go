@@ -6,11 +6,14 @@ package main
 import (
 	"errors"
 	"os"
+	"syscall"
 	"testing"
 	"time"
 
+	"bazil.org/fuse"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 // Testing retry logic for EnsureConnected()
@@ -29,23 +32,64 @@ func TestStatWithRetries(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, atMost2Attempts())
-	hdfsAccessor.EXPECT().Stat("/test/file").Return(Attrs{}, errors.New("Injected failure"))
-	hdfsAccessor.EXPECT().Stat("/test/file").Return(Attrs{Name: "file"}, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/test/file").Return(Attrs{}, errors.New("Injected failure"))
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/test/file").Return(Attrs{Name: "file"}, nil)
 	hdfsAccessor.EXPECT().Close().Return(nil)
-	attrs, err := ftHdfsAccessor.Stat("/test/file")
+	attrs, err := ftHdfsAccessor.Stat(nil, "/test/file")
 	assert.Nil(t, err)
 	assert.Equal(t, "file", attrs.Name)
 }
 
+// Testing that generic IOExceptions, reported as os.ErrInvalid, are retried
+func TestRenameRetriesIOException(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, atMost2Attempts())
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/a", "/b").Return(&os.PathError{Op: "rename", Path: "/a", Err: os.ErrInvalid})
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/a", "/b").Return(nil)
+	hdfsAccessor.EXPECT().Close().Return(nil)
+	assert.Nil(t, ftHdfsAccessor.Rename(nil, "/a", "/b"))
+}
+
+// Testing that an interrupted Stat() fails with EINTR instead of retrying
+func TestStatInterrupted(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, atMost2Attempts())
+	ctx, cancel := context.WithCancel(context.Background())
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/test/file").DoAndReturn(func(ctx context.Context, path string) (Attrs, error) {
+		cancel()
+		return Attrs{}, errors.New("Injected failure")
+	})
+	_, err := ftHdfsAccessor.Stat(ctx, "/test/file")
+	assert.Equal(t, syscall.EINTR, err)
+}
+
+// Testing that metadata reads and mutations are retried with their own policy
+func TestRetryPolicyByOperationClass(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, atMost2Attempts())
+	ftHdfsAccessor.RetryPolicies.MetadataRead = NewNoRetryPolicy()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/test/file").Return(Attrs{}, errors.New("Injected failure"))
+	_, err := ftHdfsAccessor.Stat(nil, "/test/file")
+	assert.NotNil(t, err)
+
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", os.FileMode(0757)).Return(errors.New("Injected failure"))
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", os.FileMode(0757)).Return(nil)
+	hdfsAccessor.EXPECT().Close().Return(nil)
+	assert.Nil(t, ftHdfsAccessor.Mkdir(nil, "/test/dir", os.FileMode(0757)))
+}
+
 // Testing retry logic for Mkdir()
 func TestMkdirWithRetries(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, atMost2Attempts())
-	hdfsAccessor.EXPECT().Mkdir("/test/dir", os.FileMode(0757)).Return(errors.New("Injected failure"))
-	hdfsAccessor.EXPECT().Mkdir("/test/dir", os.FileMode(0757)).Return(nil)
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", os.FileMode(0757)).Return(errors.New("Injected failure"))
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", os.FileMode(0757)).Return(nil)
 	hdfsAccessor.EXPECT().Close().Return(nil)
-	err := ftHdfsAccessor.Mkdir("/test/dir", os.FileMode(0757))
+	err := ftHdfsAccessor.Mkdir(nil, "/test/dir", os.FileMode(0757))
 	assert.Nil(t, err)
 }
 
@@ -56,10 +100,10 @@ func TestReadDirWithRetries(t *testing.T) {
 	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, atMost2Attempts())
 	var result []Attrs
 	var err error
-	hdfsAccessor.EXPECT().ReadDir("/test/dir").Return(nil, errors.New("Injected failure"))
-	hdfsAccessor.EXPECT().ReadDir("/test/dir").Return(make([]Attrs, 10), nil)
+	hdfsAccessor.EXPECT().ReadDir(gomock.Any(), "/test/dir").Return(nil, errors.New("Injected failure"))
+	hdfsAccessor.EXPECT().ReadDir(gomock.Any(), "/test/dir").Return(make([]Attrs, 10), nil)
 	hdfsAccessor.EXPECT().Close().Return(nil)
-	result, err = ftHdfsAccessor.ReadDir("/test/dir")
+	result, err = ftHdfsAccessor.ReadDir(nil, "/test/dir")
 	assert.Nil(t, err)
 	assert.Equal(t, 10, len(result))
 }
@@ -72,10 +116,10 @@ func TestOpenReadWithRetries(t *testing.T) {
 	mockReader := NewMockReadSeekCloser(mockCtrl)
 	var result ReadSeekCloser
 	var err error
-	hdfsAccessor.EXPECT().OpenRead("/test/file").Return(nil, errors.New("Injected failure"))
-	hdfsAccessor.EXPECT().OpenRead("/test/file").Return(mockReader, nil)
+	hdfsAccessor.EXPECT().OpenRead(gomock.Any(), "/test/file").Return(nil, errors.New("Injected failure"))
+	hdfsAccessor.EXPECT().OpenRead(gomock.Any(), "/test/file").Return(mockReader, nil)
 	hdfsAccessor.EXPECT().Close().Return(nil)
-	result, err = ftHdfsAccessor.OpenRead("/test/file")
+	result, err = ftHdfsAccessor.OpenRead(nil, "/test/file")
 	assert.Nil(t, err)
 	assert.Equal(t, mockReader, result.(*FaultTolerantHdfsReader).Impl)
 }
@@ -88,3 +132,49 @@ func atMost2Attempts() *RetryPolicy {
 	rp.TimeLimit = time.Hour
 	return rp
 }
+
+// Testing that mutations fail fast while the namenode is in safe mode
+func TestSafeMode(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{now: time.Unix(1600000000, 0)}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, atMost2Attempts())
+	ftHdfsAccessor.SafeMode = NewSafeMode(hdfsAccessor, "/", mockClock, 10*time.Second)
+
+	// writes into snapshots are rejected with EROFS without entering safe mode
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/.snapshot/s1/dir", os.FileMode(0757)).Return(syscall.EROFS)
+	assert.Equal(t, syscall.EROFS, ftHdfsAccessor.Mkdir(nil, "/test/.snapshot/s1/dir", os.FileMode(0757)))
+	active, since := ftHdfsAccessor.SafeMode.Active()
+	assert.False(t, active)
+
+	// the first rejected mutation enters safe mode
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", os.FileMode(0757)).Return(errSafeMode)
+	assert.Equal(t, errSafeMode, ftHdfsAccessor.Mkdir(nil, "/test/dir", os.FileMode(0757)))
+	active, since = ftHdfsAccessor.SafeMode.Active()
+	assert.True(t, active)
+	assert.Equal(t, mockClock.Now(), since)
+
+	// mutations fail without contacting the namenode, reads are not affected
+	assert.Equal(t, errSafeMode, ftHdfsAccessor.Remove(nil, "/test/dir"))
+	_, err := ftHdfsAccessor.CreateFile(nil, "/test/file", os.FileMode(0644), false)
+	assert.Equal(t, errSafeMode, err)
+	assert.Equal(t, fuse.Errno(syscall.EROFS), fuse.ToErrno(err))
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/test/dir").Return(Attrs{Name: "dir"}, nil)
+	_, err = ftHdfsAccessor.Stat(nil, "/test/dir")
+	assert.Nil(t, err)
+
+	// probing while the namenode is still in safe mode
+	probe := "/" + safeModeProbeName
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), probe, probe).Return(errSafeMode)
+	assert.False(t, ftHdfsAccessor.SafeMode.Poll())
+
+	// IOExceptions, reported as os.ErrInvalid, do not tell if the namenode left safe mode
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), probe, probe).Return(os.ErrInvalid)
+	assert.False(t, ftHdfsAccessor.SafeMode.Poll())
+
+	// the namenode leaves safe mode and refuses the rename of the missing probe
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), probe, probe).Return(syscall.ENOENT)
+	assert.True(t, ftHdfsAccessor.SafeMode.Poll())
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), "/test/dir").Return(nil)
+	assert.Nil(t, ftHdfsAccessor.Remove(nil, "/test/dir"))
+}
@@ -3,6 +3,12 @@
 // Licensed under the MIT license. See LICENSE file in the project root for details.
 package main
 
+import (
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
 // Implements ReadSeekCloser interface with automatic retries (acts as a proxy to HdfsReader)
 type FaultTolerantHdfsReader struct {
 	Path         string
@@ -19,18 +25,18 @@ func NewFaultTolerantHdfsReader(path string, impl ReadSeekCloser, hdfsAccessor H
 }
 
 // Read a chunk of data
-func (ftr *FaultTolerantHdfsReader) Read(buffer []byte) (int, error) {
-	op := ftr.RetryPolicy.StartOperation()
+func (ftr *FaultTolerantHdfsReader) Read(ctx context.Context, buffer []byte) (int, error) {
+	op := ftr.RetryPolicy.StartOperation(ctx)
 	for {
 		var err error
 		if ftr.Impl == nil {
 			// Re-opening the file for read
-			ftr.Impl, err = ftr.HdfsAccessor.OpenRead(ftr.Path)
+			ftr.Impl, err = ftr.HdfsAccessor.OpenRead(ctx, ftr.Path)
 			if err != nil {
 				if op.ShouldRetry("[%s] OpenRead: %s", ftr.Path, err.Error()) {
 					continue
 				} else {
-					return 0, err
+					return 0, op.Error(err)
 				}
 			}
 			// Seeking to the right offset
@@ -42,13 +48,18 @@ func (ftr *FaultTolerantHdfsReader) Read(buffer []byte) (int, error) {
 		}
 		// Performing the read
 		var nr int
-		nr, err = ftr.Impl.Read(buffer)
+		nr, err = ftr.Impl.Read(ctx, buffer)
+		if err == syscall.EINTR {
+			// The interrupted stream may be unusable, it is reopened by the next read
+			ftr.Close()
+			return 0, err
+		}
 		if IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("[%s] Read @%d: %s", ftr.Path, ftr.Offset, err.Error()) {
 			if err == nil {
 				// On successful read, adjusting offset to the actual number of bytes read
 				ftr.Offset += int64(nr)
 			}
-			return nr, err
+			return nr, op.Error(err)
 		}
 		// On failure, we need to close the reader
 		ftr.Close()
@@ -25,23 +25,23 @@ func TestSeekAndReadWithRetries(t *testing.T) {
 	hdfsReader.EXPECT().Seek(int64(1000)).Return(nil)
 	err = ftHdfsReader.Seek(1000)
 	assert.Nil(t, err)
-	hdfsReader.EXPECT().Read(gomock.Any()).Return(60, nil)
-	nr, err = ftHdfsReader.Read(make([]byte, 100))
+	hdfsReader.EXPECT().Read(gomock.Any(), gomock.Any()).Return(60, nil)
+	nr, err = ftHdfsReader.Read(nil, make([]byte, 100))
 	assert.Nil(t, err)
 	assert.Equal(t, 60, nr)
 	// Now the stream should be at position 160
 
 	// Requesting one more read of 200 bytes, but this time it will fail
-	hdfsReader.EXPECT().Read(gomock.Any()).Return(0, errors.New("Injected failure"))
+	hdfsReader.EXPECT().Read(gomock.Any(), gomock.Any()).Return(0, errors.New("Injected failure"))
 	// As a result, ftHdfsReader should close the stream...
 	hdfsReader.EXPECT().Close().Return(nil)
 	// ...and invoke an OpenRead() to get new HdfsReader
 	newHdfsReader := NewMockReadSeekCloser(mockCtrl)
-	hdfsAccessor.EXPECT().OpenRead("/path/to/file").Return(newHdfsReader, nil)
+	hdfsAccessor.EXPECT().OpenRead(gomock.Any(), "/path/to/file").Return(newHdfsReader, nil)
 	// It should seek at corret position (1060), and repeat the read
 	newHdfsReader.EXPECT().Seek(int64(1060)).Return(nil)
-	newHdfsReader.EXPECT().Read(gomock.Any()).Return(150, nil)
-	nr, err = ftHdfsReader.Read(make([]byte, 200))
+	newHdfsReader.EXPECT().Read(gomock.Any(), gomock.Any()).Return(150, nil)
+	nr, err = ftHdfsReader.Read(nil, make([]byte, 200))
 	assert.Nil(t, err)
 	assert.Equal(t, 150, nr)
 }
@@ -55,8 +55,8 @@ func TestNoRetryOnEOF(t *testing.T) {
 
 	var err error
 	var nr int
-	hdfsReader.EXPECT().Read(gomock.Any()).Return(0, io.EOF)
-	nr, err = ftHdfsReader.Read(make([]byte, 100))
+	hdfsReader.EXPECT().Read(gomock.Any(), gomock.Any()).Return(0, io.EOF)
+	nr, err = ftHdfsReader.Read(nil, make([]byte, 100))
 	assert.Equal(t, io.EOF, err)
 	assert.Equal(t, 0, nr)
 }
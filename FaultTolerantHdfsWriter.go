@@ -33,12 +33,6 @@ func (ftw *FaultTolerantHdfsWriter) Flush() error {
 }
 
 // Closes the stream
-func (ftw *FaultTolerantHdfsWriter) Truncate() error {
-	// TODO: implement fault tolerance
-	return ftw.Impl.Truncate()
-}
-
-// Truncate the HDFS file at a given position
 func (ftw *FaultTolerantHdfsWriter) Close() error {
 	// TODO: implement fault tolerance
 	return ftw.Impl.Close()
@@ -6,17 +6,19 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
 )
@@ -30,6 +32,8 @@ type FileINode struct {
 	fileMutex       sync.Mutex    // mutex for file operation such as open, delete
 	fileProxy       FileProxy     // file proxy. Could be LocalRWFileProxy or RemoteFileProxy
 	fileHandleMutex sync.Mutex    // mutex for file handle
+	timesPending    int32         // 1 if times were set while the file was staged, they are re-applied after upload. Accessed atomically
+	locks           LockTable     // advisory locks held on the file
 }
 
 // Verify that *File implements necesary FUSE interfaces
@@ -47,7 +51,9 @@ func (file *FileINode) AbsolutePath() string {
 }
 
 // Responds to the FUSE file attribute request
-func (file *FileINode) Attr(ctx context.Context, a *fuse.Attr) error {
+func (file *FileINode) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	ctx, done := observeFuse(ctx, "Getattr")
+	defer func() { done(err) }()
 	file.lockFile()
 	defer file.unlockFile()
 
@@ -58,16 +64,20 @@ func (file *FileINode) Attr(ctx context.Context, a *fuse.Attr) error {
 	if lrwfp, ok := file.fileProxy.(*LocalRWFileProxy); ok {
 		fileInfo, err := lrwfp.localFile.Stat()
 		if err != nil {
-			logwarn("stat failed on staging file", Fields{Operation: Stat, Path: file.AbsolutePath(), Error: err})
+			logwarn("stat failed on staging file", Fields{Operation: Stat, Path: file.AbsolutePath(), Error: err, RequestID: requestID(ctx)})
 			return err
 		}
 		// update the local cache
 		file.Attrs.Size = uint64(fileInfo.Size())
 		file.Attrs.Mtime = fileInfo.ModTime()
 	} else {
-		if file.FileSystem.Clock.Now().After(file.Attrs.Expires) {
-			err := file.Parent.LookupAttrs(file.Attrs.Name, &file.Attrs)
-			if err != nil {
+		expired := file.FileSystem.Clock.Now().After(file.Attrs.Expires)
+		metrics.ObserveCache("attrs", !expired)
+		if expired {
+			err := file.Parent.LookupAttrs(ctx, file.Attrs.Name, &file.Attrs)
+			if err == syscall.ENOTCONN {
+				logdebug("Namenode unreachable, serving cached attributes", Fields{Operation: Stat, Path: file.AbsolutePath(), RequestID: requestID(ctx)})
+			} else if err != nil {
 				return err
 			}
 		}
@@ -77,26 +87,39 @@ func (file *FileINode) Attr(ctx context.Context, a *fuse.Attr) error {
 }
 
 // Responds to the FUSE file open request (creates new file handle)
-func (file *FileINode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+func (file *FileINode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	ctx, done := observeFuse(ctx, "Open")
+	defer func() { done(err) }()
 	file.lockFile()
 	defer file.unlockFile()
 
-	logdebug("Opening file", Fields{Operation: Open, Path: file.AbsolutePath(), Flags: req.Flags})
-	handle, err := file.NewFileHandle(true, req.Flags)
+	logdebug("Opening file", Fields{Operation: Open, Path: file.AbsolutePath(), Flags: req.Flags, RequestID: requestID(ctx)})
+	if !req.Flags.IsReadOnly() {
+		if err := checkNotInSnapshot(file.AbsolutePath(), Open); err != nil {
+			return nil, err
+		}
+	}
+	handle, err := file.NewFileHandle(ctx, true, req.Flags)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp != nil && isDirectIO(req.Flags) {
+		resp.Flags |= fuse.OpenDirectIO
+	}
 	file.AddHandle(handle)
 	return handle, nil
 }
 
-// Opens file for reading
-func (file *FileINode) OpenRead() (ReadSeekCloser, error) {
-	file.lockFile()
-	defer file.unlockFile()
+// Returns true if the file is opened with O_DIRECT, i.e. the page cache must be bypassed
+func isDirectIO(flags fuse.OpenFlags) bool {
+	return flags&fuse.OpenFlags(syscall.O_DIRECT) != 0
+}
 
-	handle, err := file.Open(nil, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, nil)
+// Opens file for reading
+func (file *FileINode) OpenRead(ctx context.Context) (ReadSeekCloser, error) {
+	// Open locks the file
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -108,6 +131,10 @@ func (file *FileINode) AddHandle(handle *FileHandle) {
 	file.lockFileHandles()
 	defer file.unlockFileHandles()
 	file.activeHandles = append(file.activeHandles, handle)
+	metrics.OpenHandles.Add(1)
+	if len(file.activeHandles) == 1 {
+		file.FileSystem.addOpenFile(file)
+	}
 }
 
 // Unregisters an opened file handle
@@ -121,6 +148,7 @@ func (file *FileINode) RemoveHandle(handle *FileHandle) {
 	for i, h := range file.activeHandles {
 		if h == handle {
 			file.activeHandles = append(file.activeHandles[:i], file.activeHandles[i+1:]...)
+			metrics.OpenHandles.Add(-1)
 			break
 		}
 	}
@@ -128,6 +156,7 @@ func (file *FileINode) RemoveHandle(handle *FileHandle) {
 	//close the staging file if it is the last handle
 	if len(file.activeHandles) == 0 {
 		file.closeStaging()
+		file.FileSystem.removeOpenFile(file)
 	} else {
 		logtrace("Staging file is not closed.", file.logInfo(Fields{Operation: Close}))
 	}
@@ -146,8 +175,10 @@ func (file *FileINode) closeStaging() {
 }
 
 // Responds to the FUSE Fsync request
-func (file *FileINode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
-	loginfo(fmt.Sprintf("Dispatching fsync request to all open handles: %d", len(file.activeHandles)), Fields{Operation: Fsync})
+func (file *FileINode) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	ctx, done := observeFuse(ctx, "Fsync")
+	defer func() { done(err) }()
+	loginfo(fmt.Sprintf("Dispatching fsync request to all open handles: %d", len(file.activeHandles)), Fields{Operation: Fsync, RequestID: requestID(ctx)})
 	file.lockFile()
 	defer file.unlockFile()
 
@@ -167,51 +198,134 @@ func (file *FileINode) InvalidateMetadataCache() {
 }
 
 // Responds on FUSE Chmod request
-func (file *FileINode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+func (file *FileINode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	ctx, done := observeFuse(ctx, "Setattr")
+	defer func() { done(err) }()
 	file.lockFile()
 	defer file.unlockFile()
+	defer func() { auditLog.RecordSetattr(req, err, file.AbsolutePath()) }()
+
+	if err := checkNotInSnapshot(file.AbsolutePath(), Setattr); err != nil {
+		return err
+	}
 
 	if req.Valid.Size() {
-		var err error = nil
-		for _, handle := range file.activeHandles {
-			err := handle.Truncate(int64(req.Size))
-			if err != nil {
-				err = err
-			}
-			resp.Attr.Size = req.Size
-			file.Attrs.Size = req.Size
+		if err := file.truncate(ctx, req.Size); err != nil {
+			return err
 		}
-		return err
+		resp.Attr.Size = req.Size
+		file.Attrs.Size = req.Size
+		return nil
 	}
 
 	path := file.AbsolutePath()
 
 	if req.Valid.Mode() {
-		if err := ChmodOp(&file.Attrs, file.FileSystem, path, req, resp); err != nil {
+		if err := ChmodOp(ctx, &file.Attrs, file.FileSystem, path, req, resp); err != nil {
 			return err
 		}
 	}
 
 	if req.Valid.Uid() || req.Valid.Gid() {
-		if err := SetAttrChownOp(&file.Attrs, file.FileSystem, path, req, resp); err != nil {
+		if err := SetAttrChownOp(ctx, &file.Attrs, file.FileSystem, path, req, resp); err != nil {
 			return err
 		}
 	}
 
-	if err := UpdateTS(&file.Attrs, file.FileSystem, path, req, resp); err != nil {
+	if err := UpdateTS(ctx, &file.Attrs, file.FileSystem, path, req, resp); err != nil {
 		return err
 	}
 
+	if req.Valid.Atime() || req.Valid.Mtime() || req.Valid.AtimeNow() || req.Valid.MtimeNow() {
+		file.setStagingTimes()
+	}
+
 	return nil
 }
 
+// Applies the times of the file to the staging file. Uploading the staging
+// file resets mtime in HDFS, so the times are applied again after the upload
+func (file *FileINode) setStagingTimes() {
+	lrwfp, ok := file.fileProxy.(*LocalRWFileProxy)
+	if !ok {
+		return
+	}
+	tv := []unix.Timeval{unix.NsecToTimeval(file.Attrs.Atime.UnixNano()), unix.NsecToTimeval(file.Attrs.Mtime.UnixNano())}
+	if err := unix.Futimes(int(lrwfp.localFile.Fd()), tv); err != nil {
+		logwarn("Failed to set times of the staging file", file.logInfo(Fields{Operation: SetTimes, Error: err}))
+	}
+	atomic.StoreInt32(&file.timesPending, 1)
+}
+
+// Changes the size of the file. Staged files are truncated locally, otherwise
+// the file is truncated in HDFS without downloading it. HDFS can not extend
+// files, in this case the file is staged and the new size is uploaded
+func (file *FileINode) truncate(ctx context.Context, size uint64) error {
+	if _, ok := file.fileProxy.(*LocalRWFileProxy); ok || size > file.Attrs.Size {
+		return file.truncateStaged(ctx, size)
+	}
+
+	absPath := file.AbsolutePath()
+	hdfsAccessor := file.FileSystem.getDFSConnector()
+	defer file.InvalidateMetadataCache()
+	if size < file.Attrs.Size {
+		if err := hdfsAccessor.Truncate(ctx, absPath, int64(size)); err != nil {
+			logerror("Failed to truncate file", file.logInfo(Fields{Operation: Truncate, Bytes: size, Error: err, RequestID: requestID(ctx)}))
+			return err
+		}
+		loginfo("Truncated file in DFS", file.logInfo(Fields{Operation: Truncate, Bytes: size, RequestID: requestID(ctx)}))
+	}
+
+	// readers must not see the old content
+	if rofp, ok := file.fileProxy.(*RemoteROFileProxy); ok {
+		reader, err := hdfsAccessor.OpenRead(ctx, absPath)
+		if err != nil {
+			logerror("Failed to reopen file after truncate", file.logInfo(Fields{Operation: Truncate, Error: err, RequestID: requestID(ctx)}))
+			return err
+		}
+		rofp.hdfsReader.Close()
+		rofp.hdfsReader = reader
+	}
+	return nil
+}
+
+// Truncates the staging file of the file. If the file is not open then a
+// temporary handle is used to stage the file and upload the result
+func (file *FileINode) truncateStaged(ctx context.Context, size uint64) error {
+	if len(file.activeHandles) > 0 {
+		var retErr error
+		for _, handle := range file.activeHandles {
+			if err := handle.Truncate(ctx, int64(size)); err != nil {
+				retErr = err
+			}
+		}
+		return retErr
+	}
+
+	handle, err := file.NewFileHandle(ctx, true, fuse.OpenReadWrite)
+	if err != nil {
+		return err
+	}
+	file.activeHandles = append(file.activeHandles, handle)
+	defer func() {
+		file.activeHandles = file.activeHandles[:0]
+		file.closeStaging()
+	}()
+
+	if err := handle.Truncate(ctx, int64(size)); err != nil {
+		return err
+	}
+	return handle.copyToDFS(ctx, Truncate)
+}
+
 func (file *FileINode) countActiveHandles() int {
 	file.lockFileHandles()
 	file.unlockFileHandles()
 	return len(file.activeHandles)
 }
 
-func (file *FileINode) createStagingFile(operation string, existsInDFS bool) (*os.File, error) {
+// Creates the staging file. Content of existing files is downloaded
+func (file *FileINode) createStagingFile(ctx context.Context, operation string, existsInDFS bool) (*os.File, error) {
 	if file.fileProxy != nil {
 		return nil, nil // there is already an active handle.
 	}
@@ -220,61 +334,65 @@ func (file *FileINode) createStagingFile(operation string, existsInDFS bool) (*o
 	absPath := file.AbsolutePath()
 	hdfsAccessor := file.FileSystem.getDFSConnector()
 	if !existsInDFS { // it  is a new file so create it in the DFS
-		w, err := hdfsAccessor.CreateFile(absPath, file.Attrs.Mode, false)
+		w, err := hdfsAccessor.CreateFile(ctx, absPath, file.Attrs.Mode, false)
 		if err != nil {
-			logerror("Failed to create file in DFS", file.logInfo(Fields{Operation: operation, Error: err}))
+			logerror("Failed to create file in DFS", file.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 			return nil, err
 		}
-		loginfo("Created an empty file in DFS", file.logInfo(Fields{Operation: operation}))
+		loginfo("Created an empty file in DFS", file.logInfo(Fields{Operation: operation, RequestID: requestID(ctx)}))
 		w.Close()
 	} else {
 		// Request to write to existing file
-		_, err := hdfsAccessor.Stat(absPath)
+		_, err := hdfsAccessor.Stat(ctx, absPath)
 		if err != nil {
-			logerror("Failed to stat file in DFS", file.logInfo(Fields{Operation: operation, Error: err}))
+			logerror("Failed to stat file in DFS", file.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 			return nil, syscall.ENOENT
 		}
 	}
 
 	stagingFile, err := ioutil.TempFile(stagingDir, "stage")
 	if err != nil {
-		logerror("Failed to create staging file", file.logInfo(Fields{Operation: operation, Error: err}))
+		logerror("Failed to create staging file", file.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 		return nil, err
 	}
 	os.Remove(stagingFile.Name())
-	loginfo("Created staging file", file.logInfo(Fields{Operation: operation, TmpFile: stagingFile.Name()}))
+	loginfo("Created staging file", file.logInfo(Fields{Operation: operation, TmpFile: stagingFile.Name(), RequestID: requestID(ctx)}))
 
 	if existsInDFS {
-		if err := file.downloadToStaging(stagingFile, operation); err != nil {
+		if err := file.downloadToStaging(ctx, stagingFile, operation); err != nil {
 			return nil, err
 		}
 	}
 	return stagingFile, nil
 }
 
-func (file *FileINode) downloadToStaging(stagingFile *os.File, operation string) error {
+// Downloads the content of the file to the staging file
+func (file *FileINode) downloadToStaging(ctx context.Context, stagingFile *os.File, operation string) (err error) {
 	hdfsAccessor := file.FileSystem.getDFSConnector()
 	absPath := file.AbsolutePath()
+	ctx, span := StartSpan(ctx, "download", trace.SpanKindInternal)
+	defer func() { EndSpan(span, err) }()
 
-	reader, err := hdfsAccessor.OpenRead(absPath)
+	reader, err := hdfsAccessor.OpenRead(ctx, absPath)
 	if err != nil {
-		logerror("Failed to open file in DFS", file.logInfo(Fields{Operation: operation, Error: err}))
+		logerror("Failed to open file in DFS", file.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 		// TODO remove the staging file if there are no more active handles
 		return err
 	}
 
-	nc, err := io.Copy(stagingFile, reader)
+	nc, err := copySparse(stagingFile, contextReader{ctx, reader})
 	if err != nil {
-		logerror("Failed to copy content to staging file", file.logInfo(Fields{Operation: operation, Error: err}))
+		logerror("Failed to copy content to staging file", file.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 		return err
 	}
 	reader.Close()
-	loginfo(fmt.Sprintf("Downloaded a copy to stating dir. %d bytes copied", nc), file.logInfo(Fields{Operation: operation}))
+	span.SetAttributes(attribute.Int64("bytes", nc))
+	loginfo(fmt.Sprintf("Downloaded a copy to stating dir. %d bytes copied", nc), file.logInfo(Fields{Operation: operation, RequestID: requestID(ctx)}))
 	return nil
 }
 
 // Creates new file handle
-func (file *FileINode) NewFileHandle(existsInDFS bool, flags fuse.OpenFlags) (*FileHandle, error) {
+func (file *FileINode) NewFileHandle(ctx context.Context, existsInDFS bool, flags fuse.OpenFlags) (*FileHandle, error) {
 	file.lockFileHandles()
 	defer file.unlockFileHandles()
 
@@ -287,29 +405,34 @@ func (file *FileINode) NewFileHandle(existsInDFS bool, flags fuse.OpenFlags) (*F
 	if operation == Create {
 		// there must be no existing file handles for create operation
 		if file.fileProxy != nil {
-			logpanic("Unexpected file state during creation", file.logInfo(Fields{Flags: flags}))
+			logpanic("Unexpected file state during creation", file.logInfo(Fields{Flags: flags, RequestID: requestID(ctx)}))
 		}
 		if err := file.checkDiskSpace(); err != nil {
 			return nil, err
 		}
-		stagingFile, err := file.createStagingFile(operation, existsInDFS)
+		stagingFile, err := file.createStagingFile(ctx, operation, existsInDFS)
+		if err == syscall.EEXIST && flags&fuse.OpenExclusive == 0 {
+			// the file has been created by another client. Without O_EXCL the existing file is opened
+			loginfo("File already exists in DFS, opening it", file.logInfo(Fields{Operation: operation, Flags: flags, RequestID: requestID(ctx)}))
+			stagingFile, err = file.createStagingFile(ctx, Open, true)
+		}
 		if err != nil {
 			return nil, err
 		}
 		fh.File.fileProxy = &LocalRWFileProxy{localFile: stagingFile, file: file}
-		loginfo("Opened file, RW handle", fh.logInfo(Fields{Operation: operation, Flags: fh.fileFlags}))
+		loginfo("Opened file, RW handle", fh.logInfo(Fields{Operation: operation, Flags: fh.fileFlags, RequestID: requestID(ctx)}))
 	} else {
 		if file.fileProxy != nil {
 			fh.File.fileProxy = file.fileProxy
-			loginfo("Opened file, Returning existing handle", fh.logInfo(Fields{Operation: operation, Flags: fh.fileFlags}))
+			loginfo("Opened file, Returning existing handle", fh.logInfo(Fields{Operation: operation, Flags: fh.fileFlags, RequestID: requestID(ctx)}))
 		} else {
 			// we alway open the file in RO mode. when the client writes to the file
 			// then we upgrade the handle. However, if the file is already opened in
 			// in RW state then we use the existing RW handle
 			// if file.handle
-			reader, _ := file.FileSystem.getDFSConnector().OpenRead(file.AbsolutePath())
+			reader, _ := file.FileSystem.getDFSConnector().OpenRead(ctx, file.AbsolutePath())
 			fh.File.fileProxy = &RemoteROFileProxy{hdfsReader: reader, file: file}
-			loginfo("Opened file, RO handle", fh.logInfo(Fields{Operation: operation, Flags: fh.fileFlags}))
+			loginfo("Opened file, RO handle", fh.logInfo(Fields{Operation: operation, Flags: fh.fileFlags, RequestID: requestID(ctx)}))
 		}
 	}
 
@@ -317,7 +440,7 @@ func (file *FileINode) NewFileHandle(existsInDFS bool, flags fuse.OpenFlags) (*F
 }
 
 // changes RO file handle to RW
-func (file *FileINode) upgradeHandleForWriting(me *FileHandle) error {
+func (file *FileINode) upgradeHandleForWriting(ctx context.Context, me *FileHandle) error {
 	file.lockFileHandles()
 	defer file.unlockFileHandles()
 
@@ -327,7 +450,7 @@ func (file *FileINode) upgradeHandleForWriting(me *FileHandle) error {
 	} else if _, ok := file.fileProxy.(*RemoteROFileProxy); ok {
 		upgrade = true
 	} else {
-		logpanic("Unrecognized remote file proxy", nil)
+		logpanic("Unrecognized remote file proxy", Fields{RequestID: requestID(ctx)})
 	}
 
 	if !upgrade {
@@ -350,13 +473,13 @@ func (file *FileINode) upgradeHandleForWriting(me *FileHandle) error {
 			return err
 		}
 
-		stagingFile, err := file.createStagingFile("Open", true)
+		stagingFile, err := file.createStagingFile(ctx, "Open", true)
 		if err != nil {
 			return err
 		}
 
 		file.fileProxy = &LocalRWFileProxy{localFile: stagingFile, file: file}
-		loginfo("Open handle upgrade to support RW ", file.logInfo(Fields{Operation: "Open"}))
+		loginfo("Open handle upgrade to support RW ", file.logInfo(Fields{Operation: "Open", RequestID: requestID(ctx)}))
 		return nil
 	}
 }
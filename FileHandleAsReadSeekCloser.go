@@ -4,7 +4,10 @@
 package main
 
 import (
+	"io"
+
 	"bazil.org/fuse"
+	"golang.org/x/net/context"
 )
 
 // Wraps FileHandle exposing it as ReadSeekCloser intrface
@@ -23,10 +26,14 @@ func NewFileHandleAsReadSeekCloser(fileHandle *FileHandle) ReadSeekCloser {
 }
 
 // Reads a chunk of data
-func (fhrs *FileHandleAsReadSeekCloser) Read(buffer []byte) (int, error) {
+func (fhrs *FileHandleAsReadSeekCloser) Read(ctx context.Context, buffer []byte) (int, error) {
 	resp := fuse.ReadResponse{Data: buffer}
-	err := fhrs.FileHandle.Read(nil, &fuse.ReadRequest{Offset: fhrs.Offset, Size: len(buffer)}, &resp)
+	err := fhrs.FileHandle.Read(ctx, &fuse.ReadRequest{Offset: fhrs.Offset, Size: len(buffer)}, &resp)
 	fhrs.Offset += int64(len(resp.Data))
+	if err == nil && len(resp.Data) == 0 && len(buffer) > 0 {
+		// FileHandle reports end of file as an empty read
+		return 0, io.EOF
+	}
 	return len(resp.Data), err
 }
 
@@ -7,11 +7,13 @@ import (
 	"flag"
 	"io"
 	"os"
+	"syscall"
 	"testing"
 
 	"bazil.org/fuse"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func init() {
@@ -28,9 +30,9 @@ func TestReadWriteFile(t *testing.T) {
 	hdfswriter := NewMockHdfsWriter(mockCtrl)
 
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
-	hdfsAccessor.EXPECT().CreateFile(fileName, os.FileMode(0757), gomock.Any()).Return(hdfswriter, nil).AnyTimes()
-	hdfsAccessor.EXPECT().Stat(fileName).Return(Attrs{Name: fileName}, nil).AnyTimes()
-	hdfsAccessor.EXPECT().Chown(fileName, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), gomock.Any()).Return(hdfswriter, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), fileName).Return(Attrs{Name: fileName}, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), fileName, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
 
 	root, _ := fs.Root()
@@ -43,7 +45,7 @@ func TestReadWriteFile(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Test for normal write
-	hdfsAccessor.EXPECT().StatFs().Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
 	err = fileHandle.Write(nil, &fuse.WriteRequest{Data: []byte("hello world"), Offset: int64(0)}, &fuse.WriteResponse{})
 	assert.Nil(t, err)
 	assert.Equal(t, fileHandle.totalBytesWritten, int64(11))
@@ -68,13 +70,13 @@ func TestFaultTolerantWriteFile(t *testing.T) {
 	hdfswriter := NewMockHdfsWriter(mockCtrl)
 
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
-	hdfsAccessor.EXPECT().Stat(fileName).Return(Attrs{Name: fileName, Mode: os.FileMode(0757)}, nil).AnyTimes()
-	hdfsAccessor.EXPECT().Chown(fileName, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), fileName).Return(Attrs{Name: fileName, Mode: os.FileMode(0757)}, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), fileName, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
 
-	hdfsAccessor.EXPECT().StatFs().Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
-	hdfsAccessor.EXPECT().Remove("/testWriteFile_1").Return(nil).AnyTimes()
-	hdfsAccessor.EXPECT().CreateFile(fileName, os.FileMode(0757), gomock.Any()).DoAndReturn(func(path string,
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), "/testWriteFile_1").Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), gomock.Any()).DoAndReturn(func(ctx context.Context, path string,
 		mode os.FileMode, overwrite bool) (HdfsWriter, error) {
 		return hdfswriter, nil
 	}).AnyTimes()
@@ -84,7 +86,7 @@ func TestFaultTolerantWriteFile(t *testing.T) {
 		Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: os.FileMode(0757)}, &fuse.CreateResponse{})
 
 	// Test for newfilehandlewriter
-	hdfsAccessor.EXPECT().CreateFile(fileName, os.FileMode(0757), false).Return(hdfswriter, nil).AnyTimes()
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), false).Return(hdfswriter, nil).AnyTimes()
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
 	writeHandle := h.(*FileHandle)
 	assert.Nil(t, err)
@@ -96,13 +98,13 @@ func TestFaultTolerantWriteFile(t *testing.T) {
 
 	binaryData := make([]byte, 65536)
 	writeHandle.File.fileProxy.SeekToStart()
-	nr, _ := writeHandle.File.fileProxy.Read(binaryData)
+	nr, _ := writeHandle.File.fileProxy.Read(nil, binaryData)
 	binaryData = binaryData[:nr]
 
 	// Mock the EOF error to test the fault tolerant write/flush
 	hdfswriter.EXPECT().Write(binaryData).Return(0, io.EOF).AnyTimes()
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
-	err = writeHandle.FlushAttempt("test_flush")
+	err = writeHandle.FlushAttempt(nil, "test_flush")
 	assert.Equal(t, io.EOF, err)
 
 	// The connection would be closed
@@ -112,11 +114,11 @@ func TestFaultTolerantWriteFile(t *testing.T) {
 	newhdfswriter.EXPECT().Write(binaryData).Return(11, nil).AnyTimes()
 	newhdfswriter.EXPECT().Close().Return(nil).AnyTimes()
 	hdfswriter = newhdfswriter
-	hdfsAccessor.EXPECT().StatFs().Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
-	hdfsAccessor.EXPECT().Remove(fileName).Return(nil).AnyTimes()
-	// hdfsAccessor.EXPECT().CreateFile(fileName, os.FileMode(0757), gomock.Any()).Return(newhdfswriter, nil).AnyTimes()
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), fileName).Return(nil).AnyTimes()
+	// hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), gomock.Any()).Return(newhdfswriter, nil).AnyTimes()
 
-	hdfsAccessor.EXPECT().Remove(fileName).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), fileName).Return(nil).AnyTimes()
 	err = writeHandle.Flush(nil, nil)
 	assert.Nil(t, err)
 
@@ -131,21 +133,21 @@ func TestFlushFile(t *testing.T) {
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	readSeekCloser := NewMockReadSeekCloser(mockCtrl)
 
-	hdfsAccessor.EXPECT().OpenRead("/testWriteFile_2").Return(readSeekCloser, nil).AnyTimes()
-	readSeekCloser.EXPECT().Read(gomock.Any()).Return(0, io.EOF).AnyTimes()
+	hdfsAccessor.EXPECT().OpenRead(gomock.Any(), "/testWriteFile_2").Return(readSeekCloser, nil).AnyTimes()
+	readSeekCloser.EXPECT().Read(gomock.Any(), gomock.Any()).Return(0, io.EOF).AnyTimes()
 	readSeekCloser.EXPECT().Seek(gomock.Any()).Return(nil).AnyTimes()
 	readSeekCloser.EXPECT().Position().Return(int64(0), nil).AnyTimes()
 	readSeekCloser.EXPECT().Close().Return(nil).AnyTimes()
 
 	hdfswriter := NewMockHdfsWriter(mockCtrl)
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
-	hdfsAccessor.EXPECT().StatFs().Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
-	hdfsAccessor.EXPECT().Stat("/testWriteFile_2").Return(Attrs{Name: "testWriteFile_2"}, nil)
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(100), used: uint64(20), remaining: uint64(80)}, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/testWriteFile_2").Return(Attrs{Name: "testWriteFile_2"}, nil)
 	fileName := "/testWriteFile_2"
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 
-	hdfsAccessor.EXPECT().Remove(fileName).Return(nil).AnyTimes()
-	hdfsAccessor.EXPECT().CreateFile(fileName, os.FileMode(0757), true).Return(hdfswriter, nil).AnyTimes()
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), fileName).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), true).Return(hdfswriter, nil).AnyTimes()
 	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
 	hdfswriter.EXPECT().Write([]byte("hello world")).Return(0, nil).AnyTimes()
 
@@ -163,3 +165,78 @@ func TestFlushFile(t *testing.T) {
 	err = fileHandle.Release(nil, nil)
 	assert.Nil(t, err)
 }
+
+// Testing that truncating a file which is not open does not download it
+func TestTruncateInDFS(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fileName := "/testTruncate"
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	root, _ := fs.Root()
+	file := root.(*DirINode).NodeFromAttrs(Attrs{Name: "testTruncate", Mode: os.FileMode(0757), Size: 1000}).(*FileINode)
+
+	// shrinking uses HDFS truncate
+	hdfsAccessor.EXPECT().Truncate(gomock.Any(), fileName, int64(100)).Return(nil)
+	err := file.Setattr(nil, &fuse.SetattrRequest{Size: 100, Valid: fuse.SetattrSize}, &fuse.SetattrResponse{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), file.Attrs.Size)
+
+	// truncating to zero also uses HDFS truncate
+	hdfsAccessor.EXPECT().Truncate(gomock.Any(), fileName, int64(0)).Return(nil)
+	err = file.Setattr(nil, &fuse.SetattrRequest{Size: 0, Valid: fuse.SetattrSize}, &fuse.SetattrResponse{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), file.Attrs.Size)
+	assert.Nil(t, file.fileProxy)
+}
+
+// Testing that O_DIRECT bypasses the page cache and that O_APPEND writes at the offsets of the kernel
+func TestOpenAppend(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fileName := "/testOpenAppend"
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+
+	hdfswriter := NewMockHdfsWriter(mockCtrl)
+	hdfswriter.EXPECT().Close().Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), false).Return(hdfswriter, nil)
+	hdfsAccessor.EXPECT().Chown(gomock.Any(), fileName, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), fileName).Return(Attrs{Name: "testOpenAppend", Mode: os.FileMode(0757)}, nil).AnyTimes()
+
+	root, _ := fs.Root()
+	resp := &fuse.CreateResponse{}
+	_, h, err := root.(*DirINode).Create(nil, &fuse.CreateRequest{Name: "testOpenAppend",
+		Flags: fuse.OpenWriteOnly | fuse.OpenCreate | fuse.OpenAppend | fuse.OpenFlags(syscall.O_DIRECT), Mode: os.FileMode(0757)}, resp)
+	assert.Nil(t, err)
+	assert.NotZero(t, resp.Flags&fuse.OpenDirectIO)
+	fileHandle := h.(*FileHandle)
+
+	assert.Nil(t, fileHandle.Write(nil, &fuse.WriteRequest{Data: []byte("hello "), Offset: 0}, &fuse.WriteResponse{}))
+	assert.Nil(t, fileHandle.Write(nil, &fuse.WriteRequest{Data: []byte("world"), Offset: 6}, &fuse.WriteResponse{}))
+
+	buffer := make([]byte, 64)
+	n, _ := fileHandle.File.fileProxy.ReadAt(nil, buffer, 0)
+	assert.Equal(t, "hello world", string(buffer[:n]))
+
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), fileName).Return(nil)
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), true).Return(hdfswriter, nil)
+	hdfswriter.EXPECT().Write([]byte("hello world")).Return(11, nil)
+	assert.Nil(t, fileHandle.Flush(nil, nil))
+	assert.Nil(t, fileHandle.Release(nil, nil))
+}
+
+// Testing that O_EXCL fails if the file has been created by another client
+func TestCreateExclusive(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fileName := "/testCreateExclusive"
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), fileName, os.FileMode(0757), false).Return(nil, syscall.EEXIST)
+	root, _ := fs.Root()
+	_, _, err := root.(*DirINode).Create(nil, &fuse.CreateRequest{Name: "testCreateExclusive",
+		Flags: fuse.OpenWriteOnly | fuse.OpenCreate | fuse.OpenExclusive, Mode: os.FileMode(0757)}, &fuse.CreateResponse{})
+	assert.Equal(t, syscall.EEXIST, err)
+}
@@ -0,0 +1,288 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"math"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// How often a blocked lock request re-checks the lease held by another mount
+const lockLeasePollInterval = 1 * time.Second
+
+// Advisory lock held on a byte range of a file (the range is inclusive)
+type fileLock struct {
+	owner fuse.LockOwner
+	start uint64
+	end   uint64
+	typ   fuse.LockType
+	pid   int32
+	flock bool // BSD flock lock, otherwise POSIX (fcntl) lock
+}
+
+// Returns true if the locks can not be held at the same time.
+// Same as in Linux, BSD and POSIX locks do not interact
+func (l fileLock) conflicts(o fileLock) bool {
+	return l.owner != o.owner && l.flock == o.flock &&
+		l.start <= o.end && o.start <= l.end &&
+		(l.typ == fuse.LockWrite || o.typ == fuse.LockWrite)
+}
+
+// Table of advisory locks held on a file by the processes using this mount.
+// The cross-host lease of the file, if any, is held while the table has locks
+// or lock requests acquiring it. The lease RPCs are made without holding the
+// mutex of the table, so that a slow namenode does not block the other requests
+// Concurrency: thread safe
+type LockTable struct {
+	locks      []fileLock
+	changed    chan struct{} // closed every time locks are released
+	leased     bool          // the cross-host lease is held
+	pending    int           // lock requests acquiring the lease
+	mutex      sync.Mutex
+	leaseMutex sync.Mutex // serializes the lease RPCs
+}
+
+// Adds the lock, replacing locks of the same owner in the range. Returns EAGAIN
+// if a conflicting lock is held. acquireLease is called before the first lock
+// is added to the table and releaseLease if the lease is no longer needed,
+// they can be nil
+func (t *LockTable) tryLock(l fileLock, acquireLease func() error, releaseLease func()) error {
+	t.mutex.Lock()
+	if t.conflicting(l) {
+		t.mutex.Unlock()
+		return syscall.EAGAIN
+	}
+	if acquireLease != nil && !t.leased {
+		t.pending++
+		t.mutex.Unlock()
+		err := t.syncLease(acquireLease, releaseLease)
+		t.mutex.Lock()
+		t.pending--
+		if err == nil && t.conflicting(l) {
+			err = syscall.EAGAIN // locked by another process while the lease was acquired
+		}
+		if err != nil {
+			t.mutex.Unlock()
+			t.syncLease(nil, releaseLease)
+			return err
+		}
+	}
+	t.removeRange(l.owner, l.flock, l.start, l.end)
+	t.locks = append(t.locks, l)
+	t.mutex.Unlock()
+	return nil
+}
+
+// Waits until the lock is added or the context is canceled
+func (t *LockTable) lockWait(ctx context.Context, l fileLock, acquireLease func() error, releaseLease func(), clock Clock) error {
+	for {
+		changed := t.changedChan()
+		err := t.tryLock(l, acquireLease, releaseLease)
+		if err != syscall.EAGAIN {
+			return err
+		}
+		var poll <-chan time.Time
+		if acquireLease != nil {
+			// the lease held by another mount can not notify us
+			poll = clock.After(lockLeasePollInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-changed:
+		case <-poll:
+		}
+	}
+}
+
+// Releases the locks of the owner in the range. releaseLease is called
+// when the lease is no longer needed, it can be nil
+func (t *LockTable) unlock(owner fuse.LockOwner, flock bool, start uint64, end uint64, releaseLease func()) {
+	t.mutex.Lock()
+	if !t.removeRange(owner, flock, start, end) {
+		t.mutex.Unlock()
+		return
+	}
+	if t.changed != nil {
+		close(t.changed)
+		t.changed = nil
+	}
+	t.mutex.Unlock()
+	t.syncLease(nil, releaseLease)
+}
+
+// Acquires or releases the lease so that it is held only while the table has
+// locks or lock requests acquiring it. Concurrent changes of the table are
+// followed by their own call, so the lease converges to the needed state
+func (t *LockTable) syncLease(acquireLease func() error, releaseLease func()) error {
+	t.leaseMutex.Lock()
+	defer t.leaseMutex.Unlock()
+
+	t.mutex.Lock()
+	needed := len(t.locks) > 0 || t.pending > 0
+	leased := t.leased
+	t.mutex.Unlock()
+
+	if needed && !leased && acquireLease != nil {
+		if err := acquireLease(); err != nil {
+			return err
+		}
+		t.setLeased(true)
+	} else if !needed && leased && releaseLease != nil {
+		releaseLease()
+		t.setLeased(false)
+	}
+	return nil
+}
+
+func (t *LockTable) setLeased(leased bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.leased = leased
+}
+
+// Returns true if a lock conflicting with the given lock is held. Must be
+// called with the mutex held
+func (t *LockTable) conflicting(l fileLock) bool {
+	for _, o := range t.locks {
+		if l.conflicts(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a lock conflicting with the given lock
+func (t *LockTable) query(l fileLock) (fileLock, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, o := range t.locks {
+		if l.conflicts(o) {
+			return o, true
+		}
+	}
+	return fileLock{}, false
+}
+
+// Removes locks of the owner in the range, splitting the locks which overlap it.
+// Returns true if any lock has been changed. Must be called with the mutex held
+func (t *LockTable) removeRange(owner fuse.LockOwner, flock bool, start uint64, end uint64) bool {
+	changed := false
+	locks := t.locks[:0:0]
+	for _, o := range t.locks {
+		if o.owner != owner || o.flock != flock || o.end < start || end < o.start {
+			locks = append(locks, o)
+			continue
+		}
+		changed = true
+		if o.start < start {
+			left := o
+			left.end = start - 1
+			locks = append(locks, left)
+		}
+		if o.end > end {
+			right := o
+			right.start = end + 1
+			locks = append(locks, right)
+		}
+	}
+	t.locks = locks
+	return changed
+}
+
+func (t *LockTable) changedChan() chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.changed == nil {
+		t.changed = make(chan struct{})
+	}
+	return t.changed
+}
+
+// Verify that *FileHandle implements FUSE lock interfaces
+var _ fs.HandleFlockLocker = (*FileHandle)(nil)
+var _ fs.HandlePOSIXLocker = (*FileHandle)(nil)
+
+// Converts the FUSE lock request. flock locks always cover the whole file
+func newFileLock(owner fuse.LockOwner, lock fuse.FileLock, flags fuse.LockFlags) fileLock {
+	l := fileLock{owner: owner, start: lock.Start, end: lock.End, typ: lock.Type, pid: lock.PID, flock: flags&fuse.LockFlock != 0}
+	if l.flock {
+		l.start = 0
+		l.end = math.MaxUint64
+	}
+	return l
+}
+
+// Responds to the FUSE F_SETLK and non-blocking flock requests
+func (fh *FileHandle) Lock(ctx context.Context, req *fuse.LockRequest) (err error) {
+	ctx, done := observeFuse(ctx, "Lock")
+	defer func() { done(err) }()
+	l := newFileLock(req.LockOwner, req.Lock, req.LockFlags)
+	err = fh.File.locks.tryLock(l, fh.File.acquireLockLease(ctx), fh.File.releaseLockLease())
+	logdebug("Lock", fh.logInfo(Fields{Operation: Lock, LockType: l.typ, Offset: l.start, Pid: l.pid, Error: err, RequestID: requestID(ctx)}))
+	return err
+}
+
+// Responds to the FUSE F_SETLKW and blocking flock requests
+func (fh *FileHandle) LockWait(ctx context.Context, req *fuse.LockWaitRequest) (err error) {
+	ctx, done := observeFuse(ctx, "LockWait")
+	defer func() { done(err) }()
+	l := newFileLock(req.LockOwner, req.Lock, req.LockFlags)
+	logdebug("Waiting for lock", fh.logInfo(Fields{Operation: Lock, LockType: l.typ, Offset: l.start, Pid: l.pid, RequestID: requestID(ctx)}))
+	return fh.File.locks.lockWait(ctx, l, fh.File.acquireLockLease(ctx), fh.File.releaseLockLease(), fh.File.FileSystem.Clock)
+}
+
+// Responds to the FUSE unlock requests
+func (fh *FileHandle) Unlock(ctx context.Context, req *fuse.UnlockRequest) (err error) {
+	ctx, done := observeFuse(ctx, "Unlock")
+	defer func() { done(err) }()
+	l := newFileLock(req.LockOwner, req.Lock, req.LockFlags)
+	logdebug("Unlock", fh.logInfo(Fields{Operation: Lock, Offset: l.start, Pid: l.pid, RequestID: requestID(ctx)}))
+	fh.File.locks.unlock(l.owner, l.flock, l.start, l.end, fh.File.releaseLockLease())
+	return nil
+}
+
+// Responds to the FUSE F_GETLK requests
+func (fh *FileHandle) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) (err error) {
+	ctx, done := observeFuse(ctx, "QueryLock")
+	defer func() { done(err) }()
+	l := newFileLock(req.LockOwner, req.Lock, req.LockFlags)
+	if o, found := fh.File.locks.query(l); found {
+		resp.Lock = fuse.FileLock{Start: o.start, End: o.end, Type: o.typ, PID: o.pid}
+	}
+	return nil
+}
+
+// Releases all POSIX (on any close) or flock (on the last close) locks of the owner
+func (fh *FileHandle) releaseLocks(owner fuse.LockOwner, flock bool) {
+	fh.File.locks.unlock(owner, flock, 0, math.MaxUint64, fh.File.releaseLockLease())
+}
+
+// Returns the function acquiring the cross-host lease of the file, or nil
+// if leases are disabled
+func (file *FileINode) acquireLockLease(ctx context.Context) func() error {
+	leases := file.FileSystem.LockLeases
+	if leases == nil {
+		return nil
+	}
+	path := file.AbsolutePath()
+	return func() error { return leases.Acquire(ctx, path) }
+}
+
+// Returns the function releasing the cross-host lease of the file, or nil
+// if leases are disabled
+func (file *FileINode) releaseLockLease() func() {
+	leases := file.FileSystem.LockLeases
+	if leases == nil {
+		return nil
+	}
+	path := file.AbsolutePath()
+	return func() { leases.Release(path) }
+}
@@ -0,0 +1,185 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"math"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// Testing POSIX and flock lock semantics
+func TestLockTable(t *testing.T) {
+	var table LockTable
+
+	// read locks are shared, write locks are exclusive
+	assert.Nil(t, table.tryLock(fileLock{owner: 1, start: 0, end: 99, typ: fuse.LockRead}, nil, nil))
+	assert.Nil(t, table.tryLock(fileLock{owner: 2, start: 50, end: 149, typ: fuse.LockRead}, nil, nil))
+	assert.Equal(t, syscall.EAGAIN, table.tryLock(fileLock{owner: 3, start: 90, end: 99, typ: fuse.LockWrite}, nil, nil))
+	assert.Nil(t, table.tryLock(fileLock{owner: 3, start: 150, end: 199, typ: fuse.LockWrite}, nil, nil))
+
+	// flock and POSIX locks do not interact
+	assert.Nil(t, table.tryLock(fileLock{owner: 4, start: 0, end: math.MaxUint64, typ: fuse.LockWrite, flock: true}, nil, nil))
+
+	// unlocking a part of the range splits the lock
+	table.unlock(2, false, 60, 139, nil)
+	o, found := table.query(fileLock{owner: 5, start: 100, end: 200, typ: fuse.LockWrite})
+	assert.True(t, found)
+	assert.Equal(t, fuse.LockOwner(2), o.owner)
+	assert.Equal(t, uint64(140), o.start)
+	table.unlock(2, false, 0, math.MaxUint64, nil)
+	o, found = table.query(fileLock{owner: 5, start: 100, end: 149, typ: fuse.LockWrite})
+	assert.False(t, found)
+
+	// the owner upgrades its own lock
+	assert.Nil(t, table.tryLock(fileLock{owner: 1, start: 0, end: 99, typ: fuse.LockWrite}, nil, nil))
+	_, found = table.query(fileLock{owner: 5, start: 0, end: 0, typ: fuse.LockRead})
+	assert.True(t, found)
+}
+
+// Testing blocking lock requests
+func TestLockWait(t *testing.T) {
+	var table LockTable
+	clock := &pollClock{polls: make(chan chan time.Time)}
+	acquireLease := func() error { return nil }
+	assert.Nil(t, table.tryLock(fileLock{owner: 1, start: 0, end: 10, typ: fuse.LockWrite}, nil, nil))
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- table.lockWait(context.Background(), fileLock{owner: 2, start: 5, end: 5, typ: fuse.LockRead}, acquireLease, func() {}, clock)
+	}()
+	// the request waits and polls while the conflicting lock is held
+	poll := <-clock.polls
+	poll <- time.Time{}
+	<-clock.polls
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while a conflicting lock is held")
+	default:
+	}
+	table.unlock(1, false, 0, math.MaxUint64, nil)
+	assert.Nil(t, <-acquired)
+
+	// interrupted requests return EINTR
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := table.lockWait(ctx, fileLock{owner: 3, start: 0, end: 10, typ: fuse.LockWrite}, nil, nil, clock)
+	assert.Equal(t, syscall.EINTR, err)
+}
+
+// Clock handing the channels of the polls of waiting lock requests to the test
+type pollClock struct {
+	MockClock
+	polls chan chan time.Time
+}
+
+func (c *pollClock) After(d time.Duration) <-chan time.Time {
+	poll := make(chan time.Time, 1)
+	c.polls <- poll
+	return poll
+}
+
+// Testing that the lease RPCs are made without blocking the lock table
+func TestLockLeaseOutsideMutex(t *testing.T) {
+	table := &LockTable{}
+	acquiring := make(chan struct{})
+	proceed := make(chan struct{})
+	acquire := func() error { close(acquiring); <-proceed; return nil }
+	released := 0
+	release := func() { released++ }
+
+	locked := make(chan error)
+	go func() {
+		locked <- table.tryLock(fileLock{owner: 1, start: 0, end: 9, typ: fuse.LockWrite}, acquire, release)
+	}()
+	<-acquiring
+	_, found := table.query(fileLock{owner: 2, start: 0, end: 9, typ: fuse.LockWrite})
+	assert.False(t, found)
+	close(proceed)
+	assert.Nil(t, <-locked)
+
+	// the lease is held until the last lock is released
+	assert.Nil(t, table.tryLock(fileLock{owner: 1, start: 20, end: 29, typ: fuse.LockWrite}, acquire, release))
+	table.unlock(1, false, 0, 9, release)
+	assert.Equal(t, 0, released)
+	table.unlock(1, false, 0, math.MaxUint64, release)
+	assert.Equal(t, 1, released)
+}
+
+// Testing cross-host lock leases
+func TestLockLeases(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{now: time.Unix(1600000000, 0)}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	leases := NewLockLeases(fs, "/locks", time.Minute)
+	leasePath := "/locks/%2Fdata%2Fdb.sqlite.lock"
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/locks").Return(Attrs{Name: "locks", Mode: os.ModeDir | 0755}, nil).AnyTimes()
+
+	// lease held by another mount, its mtime is set with the clock of that mount
+	mtime := mockClock.Now().Add(-time.Hour)
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), leasePath, os.FileMode(0644), false).Return(nil, syscall.EEXIST).Times(4)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), leasePath).Return(Attrs{Name: "lease", Mtime: mtime}, nil).Times(2)
+	assert.Equal(t, syscall.EAGAIN, leases.Acquire(nil, "/data/db.sqlite"))
+	mockClock.NotifyTimeElapsed(30 * time.Second)
+	assert.Equal(t, syscall.EAGAIN, leases.Acquire(nil, "/data/db.sqlite"))
+
+	// the other mount refreshes the lease
+	mockClock.NotifyTimeElapsed(40 * time.Second)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), leasePath).Return(Attrs{Name: "lease", Mtime: mtime.Add(20 * time.Second)}, nil).Times(2)
+	assert.Equal(t, syscall.EAGAIN, leases.Acquire(nil, "/data/db.sqlite"))
+	mockClock.NotifyTimeElapsed(50 * time.Second)
+	assert.Equal(t, syscall.EAGAIN, leases.Acquire(nil, "/data/db.sqlite"))
+
+	// lease not refreshed within the TTL is taken over
+	mockClock.NotifyTimeElapsed(10 * time.Second)
+	hdfswriter := NewMockHdfsWriter(mockCtrl)
+	hdfswriter.EXPECT().Write(gomock.Any()).Return(10, nil)
+	hdfswriter.EXPECT().Close().Return(nil)
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), leasePath, os.FileMode(0644), false).Return(nil, syscall.EEXIST)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), leasePath).Return(Attrs{Name: "lease", Mtime: mtime.Add(20 * time.Second)}, nil)
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), leasePath).Return(nil)
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), leasePath, os.FileMode(0644), false).Return(hdfswriter, nil)
+	assert.Nil(t, leases.Acquire(nil, "/data/db.sqlite"))
+	assert.Empty(t, leases.observed)
+
+	hdfsAccessor.EXPECT().SetTimes(gomock.Any(), leasePath, mockClock.Now(), mockClock.Now()).Return(nil)
+	leases.Refresh()
+
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), leasePath).Return(nil)
+	leases.Release("/data/db.sqlite")
+	assert.Empty(t, leases.leases)
+}
+
+// Testing that the lease RPCs of a file do not block the leases of other files
+func TestLockLeasesOutsideMutex(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{now: time.Unix(1600000000, 0)}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	leases := NewLockLeases(fs, "/locks", time.Minute)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/locks").Return(Attrs{Name: "locks", Mode: os.ModeDir | 0755}, nil).AnyTimes()
+
+	// the lease of b is acquired and released while the namenode creates the lease of a
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), "/locks/%2Fa.lock", os.FileMode(0644), false).DoAndReturn(
+		func(ctx context.Context, path string, mode os.FileMode, overwrite bool) (HdfsWriter, error) {
+			assert.Nil(t, leases.Acquire(nil, "/b"))
+			leases.Release("/b")
+			return nil, syscall.EEXIST
+		})
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/locks/%2Fa.lock").Return(Attrs{Name: "lease", Mtime: mockClock.Now()}, nil)
+	hdfswriter := NewMockHdfsWriter(mockCtrl)
+	hdfswriter.EXPECT().Write(gomock.Any()).Return(10, nil)
+	hdfswriter.EXPECT().Close().Return(nil)
+	hdfsAccessor.EXPECT().CreateFile(gomock.Any(), "/locks/%2Fb.lock", os.FileMode(0644), false).Return(hdfswriter, nil)
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), "/locks/%2Fb.lock").Return(nil)
+	assert.Equal(t, syscall.EAGAIN, leases.Acquire(nil, "/a"))
+	assert.Empty(t, leases.leases)
+}
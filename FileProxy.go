@@ -3,12 +3,14 @@
 
 package main
 
+import "golang.org/x/net/context"
+
 type FileProxy interface {
 	Truncate(size int64) (int64, error)
 	WriteAt(b []byte, off int64) (n int, err error)
-	ReadAt(b []byte, off int64) (n int, err error)
+	ReadAt(ctx context.Context, b []byte, off int64) (n int, err error)
 	SeekToStart() (err error)
-	Read(b []byte) (n int, err error)
+	Read(ctx context.Context, b []byte) (n int, err error)
 	Close() error
 	Sync() error
 }
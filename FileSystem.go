@@ -16,23 +16,59 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
 	"strings"
 	"sync"
+	"time"
+
+	"logicalclocks.com/hopsfs-mount/ugcache"
 )
 
 type FileSystem struct {
 	HdfsAccessors      []HdfsAccessor // Interface to access HDFS
 	hdfsAccessorsIndex int
-	SrcDir             string       // Src directory that will mounted
-	AllowedPrefixes    []string     // List of allowed path prefixes (only those prefixes are exposed via mountpoint)
-	ReadOnly           bool         // Indicates whether mount filesystem with readonly
-	Mounted            bool         // True if filesystem is mounted
-	RetryPolicy        *RetryPolicy // Retry policy
-	Clock              Clock        // interface to get wall clock time
-	FsInfo             FsInfo       // Usage of HDFS, including capacity, remaining, used sizes.
+	SrcDir             string            // Src directory that will mounted
+	AllowedPrefixes    []string          // List of allowed path prefixes (only those prefixes are exposed via mountpoint)
+	ReadOnly           bool              // Indicates whether mount filesystem with readonly
+	Mounted            bool              // True if filesystem is mounted
+	RetryPolicies      *RetryPolicies    // Retry policies by class of operations, uploads are retried with the Upload policy
+	Clock              Clock             // interface to get wall clock time
+	FsInfo             FsInfo            // Usage of HDFS, including capacity, remaining, used sizes.
+	QuotaStatfs        bool              // Report quota of SrcDir (or the closest ancestor with a quota) in Statfs
+	TrashPrefixes      []string          // Removals under these path prefixes are moved to the HDFS trash
+	Server             *fs.Server        // FUSE server, used to invalidate kernel caches. Can be nil
+	LockLeases         *LockLeases       // Coordinates file locks with other mounts. Can be nil
+	HardLinks          string            // Hard link policy, see HardLinksEPERM, HardLinksENOTSUP and HardLinksCopy
+	SafeMode           *SafeMode         // Safe mode state of the namenode. Can be nil
+	CircuitBreaker     *CircuitBreaker   // Fails operations fast while the namenode is unreachable. Can be nil
+	MountPoint         string            // Local mount point, reported by the status
+	Config             map[string]string // Effective configuration (command line flags), reported by the status
 
 	closeOnUnmount     []io.Closer // list of opened files (zip archives) to be closed on unmount
 	closeOnUnmountLock sync.Mutex  // mutex to protet closeOnUnmount
+
+	root      *DirINode           // root directory, the cached nodes are reachable from it
+	openFiles map[*FileINode]bool // files with open handles
+	control   *ControlDir         // virtual control directory, created on first lookup
+	nodesLock sync.Mutex          // mutex to protect root, openFiles and control
+
+	quota quotaCache // quota reported by statfs
+}
+
+// How long the quota reported by statfs is cached, df calls statfs often
+const quotaCacheTTL = 5 * time.Second
+
+// How long the closest ancestor of SrcDir with a quota is cached, before
+// looking for it again
+const quotaRootCacheTTL = 1 * time.Minute
+
+// Quota of the closest ancestor of SrcDir with a quota, cached
+type quotaCache struct {
+	path        string    // quota root, "/" if no ancestor has a quota
+	quota       QuotaInfo // quota and usage of the quota root
+	expires     time.Time // expiration of the quota and usage
+	rootExpires time.Time // expiration of the quota root
+	mutex       sync.Mutex
 }
 
 // Verify that *FileSystem implements necesary FUSE interfaces
@@ -46,7 +82,7 @@ func NewFileSystem(hdfsAccessors []HdfsAccessor, srcDir string, allowedPrefixes
 		Mounted:         false,
 		AllowedPrefixes: allowedPrefixes,
 		ReadOnly:        readOnly,
-		RetryPolicy:     retryPolicy,
+		RetryPolicies:   NewRetryPolicies(retryPolicy),
 		Clock:           clock,
 		SrcDir:          srcDir}, nil
 }
@@ -98,7 +134,7 @@ func (filesystem *FileSystem) Root() (fs.Node, error) {
 	uid64, _ := strconv.ParseUint(cu.Uid, 10, 32)
 	gid64, _ := strconv.ParseUint(cu.Gid, 10, 32)
 
-	return &DirINode{FileSystem: filesystem, Parent: nil, Attrs: Attrs{
+	root := &DirINode{FileSystem: filesystem, Parent: nil, Attrs: Attrs{
 		Inode:  1,
 		Uid:    uint32(uid64),
 		Gid:    uint32(gid64),
@@ -106,7 +142,101 @@ func (filesystem *FileSystem) Root() (fs.Node, error) {
 		Mtime:  filesystem.Clock.Now(),
 		Ctime:  filesystem.Clock.Now(),
 		Crtime: filesystem.Clock.Now()},
-	}, nil
+	}
+	filesystem.nodesLock.Lock()
+	filesystem.root = root
+	filesystem.nodesLock.Unlock()
+	return root, nil
+}
+
+// Registers a file with open handles
+func (filesystem *FileSystem) addOpenFile(file *FileINode) {
+	filesystem.nodesLock.Lock()
+	defer filesystem.nodesLock.Unlock()
+	if filesystem.openFiles == nil {
+		filesystem.openFiles = make(map[*FileINode]bool)
+	}
+	filesystem.openFiles[file] = true
+}
+
+// Unregisters a file whose last handle has been closed
+func (filesystem *FileSystem) removeOpenFile(file *FileINode) {
+	filesystem.nodesLock.Lock()
+	defer filesystem.nodesLock.Unlock()
+	delete(filesystem.openFiles, file)
+}
+
+// Returns the files with open handles
+func (filesystem *FileSystem) OpenFiles() []*FileINode {
+	filesystem.nodesLock.Lock()
+	defer filesystem.nodesLock.Unlock()
+	files := make([]*FileINode, 0, len(filesystem.openFiles))
+	for file := range filesystem.openFiles {
+		files = append(files, file)
+	}
+	return files
+}
+
+// Expires the cached attributes of the path and of the nodes under it, and
+// invalidates the kernel cache of their directory entries. The path is
+// relative to the mount point. Returns the number of cached entries
+func (filesystem *FileSystem) DropCaches(p string) int {
+	filesystem.nodesLock.Lock()
+	root := filesystem.root
+	filesystem.nodesLock.Unlock()
+	p = path.Clean("/" + p)
+	if p == "/" {
+		ugcache.Clear()
+	}
+	if root == nil {
+		return 0
+	}
+
+	// looking up the cached node of the path
+	var node fs.Node = root
+	for _, name := range strings.Split(p, "/")[1:] {
+		if name == "" {
+			break // root
+		}
+		dir, ok := node.(*DirINode)
+		if !ok {
+			return 0
+		}
+		dir.lockMutex()
+		entry := dir.Entries[name]
+		dir.unlockMutex()
+		if entry == nil {
+			return 0
+		}
+		node = *entry
+	}
+
+	count := 0
+	if file, ok := node.(*FileINode); ok {
+		file.InvalidateMetadataCache()
+		filesystem.invalidateEntry(file.Parent, file.Attrs.Name)
+		return 1
+	}
+	dirs := []*DirINode{node.(*DirINode)}
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		dir.lockMutex()
+		dir.Attrs.Expires = time.Time{}
+		for name, node := range dir.Entries {
+			switch n := (*node).(type) {
+			case *DirINode:
+				dirs = append(dirs, n)
+			case *FileINode:
+				n.InvalidateMetadataCache()
+			}
+			filesystem.invalidateEntry(dir, name)
+			count++
+		}
+		dir.unlockMutex()
+	}
+	loginfo(fmt.Sprintf("Dropped %d cached entries", count), Fields{Operation: Invalidate, Path: p})
+	return count
 }
 
 // Returns if given absoute path allowed by any of the prefixes
@@ -114,7 +244,13 @@ func (filesystem *FileSystem) IsPathAllowed(path string) bool {
 	if path == "/" {
 		return true
 	}
-	for _, prefix := range filesystem.AllowedPrefixes {
+	return hasPathPrefix(path, filesystem.AllowedPrefixes)
+}
+
+// Returns true if given absolute path matches any of the prefixes.
+// Prefixes are relative to the root, "*" matches all paths
+func hasPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
 		if prefix == "*" {
 			return true
 		}
@@ -135,19 +271,115 @@ func (filesystem *FileSystem) CloseOnUnmount(file io.Closer) {
 
 // Statfs is called to obtain file system metadata.
 // It should write that data to resp.
-func (filesystem *FileSystem) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
-	fsInfo, err := filesystem.getDFSConnector().StatFs()
+func (filesystem *FileSystem) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
+	ctx, done := observeFuse(ctx, "Statfs")
+	defer func() { done(err) }()
+	fsInfo, err := filesystem.getDFSConnector().StatFs(ctx)
 	if err != nil {
-		logwarn("Stat DFS failed", Fields{Operation: StatFS, Error: err})
+		logwarn("Stat DFS failed", Fields{Operation: StatFS, Error: err, RequestID: requestID(ctx)})
 		return err
 	}
 	resp.Bsize = 1024
 	resp.Bfree = fsInfo.remaining / uint64(resp.Bsize)
 	resp.Bavail = resp.Bfree
 	resp.Blocks = fsInfo.capacity / uint64(resp.Bsize)
+
+	if !filesystem.QuotaStatfs {
+		return nil
+	}
+
+	quotaPath, quota, err := filesystem.cachedQuota(ctx)
+	if err != nil {
+		logwarn("Failed to get quota", Fields{Operation: StatFS, Path: filesystem.SrcDir, Error: err, RequestID: requestID(ctx)})
+		return err
+	}
+	if quota.SpaceQuota >= 0 {
+		resp.Blocks = uint64(quota.SpaceQuota) / uint64(resp.Bsize)
+		free := uint64(0)
+		if uint64(quota.SpaceQuota) > quota.SpaceUsed {
+			free = uint64(quota.SpaceQuota) - quota.SpaceUsed
+		}
+		// the cluster may have less space left than the quota allows
+		if free > fsInfo.remaining {
+			free = fsInfo.remaining
+		}
+		resp.Bfree = free / uint64(resp.Bsize)
+		resp.Bavail = resp.Bfree
+	}
+	if quota.NameQuota >= 0 {
+		resp.Files = uint64(quota.NameQuota)
+		if uint64(quota.NameQuota) > quota.NameUsed {
+			resp.Ffree = uint64(quota.NameQuota) - quota.NameUsed
+		}
+	}
+	logdebug("Reporting quota", Fields{Operation: StatFS, Path: quotaPath, RequestID: requestID(ctx)})
 	return nil
 }
 
+// Returns the quota of SrcDir or of its closest ancestor that has a quota. The
+// result is cached, and once it expires only the quota root found previously is
+// queried again, until the root itself expires. If no ancestor has a quota, the
+// result is cached until the root expires
+func (filesystem *FileSystem) cachedQuota(ctx context.Context) (string, QuotaInfo, error) {
+	c := &filesystem.quota
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := filesystem.Clock.Now()
+	if now.Before(c.expires) {
+		return c.path, c.quota, nil
+	}
+	if c.path != "" && c.path != "/" && now.Before(c.rootExpires) {
+		quota, err := filesystem.getDFSConnector().GetQuota(ctx, c.path)
+		if err != nil {
+			return c.path, QuotaInfo{}, err
+		}
+		if quota.HasQuota() {
+			c.quota, c.expires = quota, now.Add(quotaCacheTTL)
+			return c.path, quota, nil
+		}
+	}
+	quotaPath, quota, err := filesystem.lookupQuota(ctx, filesystem.SrcDir)
+	if err != nil {
+		return quotaPath, quota, err
+	}
+	c.path, c.quota = quotaPath, quota
+	c.expires, c.rootExpires = now.Add(quotaCacheTTL), now.Add(quotaRootCacheTTL)
+	if quotaPath == "/" {
+		// no ancestor has a quota, there is no usage to refresh until the root expires
+		c.expires = c.rootExpires
+	}
+	return quotaPath, quota, nil
+}
+
+// Returns quota of the given directory or of its closest ancestor that has a quota.
+// The root directory is never queried as computing its usage is expensive.
+// If no quota is found, then QuotaInfo with unset quotas is returned
+func (filesystem *FileSystem) lookupQuota(ctx context.Context, dir string) (string, QuotaInfo, error) {
+	for p := path.Clean(dir); p != "/"; p = path.Dir(p) {
+		quota, err := filesystem.getDFSConnector().GetQuota(ctx, p)
+		if err != nil {
+			return p, QuotaInfo{}, err
+		}
+		if quota.HasQuota() {
+			return p, quota, nil
+		}
+	}
+	return "/", QuotaInfo{NameQuota: -1, SpaceQuota: -1}, nil
+}
+
+// Asynchronously invalidates the kernel cache of a directory entry
+func (filesystem *FileSystem) invalidateEntry(parent fs.Node, name string) {
+	if filesystem.Server == nil {
+		return
+	}
+	go func() {
+		err := filesystem.Server.InvalidateEntry(parent, name)
+		if err != nil && err != fuse.ErrNotCached {
+			logwarn("Failed to invalidate kernel cache", Fields{Operation: Invalidate, Path: name, Error: err})
+		}
+	}()
+}
+
 func (filesystem *FileSystem) getDFSConnector() HdfsAccessor {
 	filesystem.hdfsAccessorsIndex = filesystem.hdfsAccessorsIndex + 1
 	index := filesystem.hdfsAccessorsIndex % len(filesystem.HdfsAccessors)
@@ -5,6 +5,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"bazil.org/fuse"
 	"github.com/golang/mock/gomock"
@@ -36,10 +37,80 @@ func TestStatfs(t *testing.T) {
 	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
 	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
 
-	hdfsAccessor.EXPECT().StatFs().Return(FsInfo{capacity: uint64(10240), remaining: uint64(1024)}, nil)
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(10240), remaining: uint64(1024)}, nil)
 	fsInfo := &fuse.StatfsResponse{}
 	err := fs.Statfs(nil, &fuse.StatfsRequest{}, fsInfo)
 	assert.Nil(t, err)
 	assert.Equal(t, uint64(10), fsInfo.Blocks)
 	assert.Equal(t, uint64(1), fsInfo.Bfree)
 }
+
+func TestStatfsWithQuota(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/Projects/demo/Resources", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	fs.QuotaStatfs = true
+
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(1024000), remaining: uint64(512000)}, nil)
+	hdfsAccessor.EXPECT().GetQuota(gomock.Any(), "/Projects/demo/Resources").Return(QuotaInfo{NameQuota: -1, SpaceQuota: -1}, nil)
+	hdfsAccessor.EXPECT().GetQuota(gomock.Any(), "/Projects/demo").Return(QuotaInfo{NameQuota: 100, NameUsed: 40, SpaceQuota: 10240, SpaceUsed: 2048}, nil)
+	fsInfo := &fuse.StatfsResponse{}
+	err := fs.Statfs(nil, &fuse.StatfsRequest{}, fsInfo)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), fsInfo.Blocks)
+	assert.Equal(t, uint64(8), fsInfo.Bfree)
+	assert.Equal(t, uint64(100), fsInfo.Files)
+	assert.Equal(t, uint64(60), fsInfo.Ffree)
+}
+
+// Testing that the quota root and its quota are cached
+func TestStatfsQuotaCache(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/Projects/demo/Resources", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	fs.QuotaStatfs = true
+
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(1024000), remaining: uint64(512000)}, nil).Times(4)
+	hdfsAccessor.EXPECT().GetQuota(gomock.Any(), "/Projects/demo/Resources").Return(QuotaInfo{NameQuota: -1, SpaceQuota: -1}, nil).Times(2)
+	hdfsAccessor.EXPECT().GetQuota(gomock.Any(), "/Projects/demo").Return(QuotaInfo{NameQuota: 100, NameUsed: 40, SpaceQuota: 10240, SpaceUsed: 2048}, nil).Times(3)
+	statfs := func() *fuse.StatfsResponse {
+		fsInfo := &fuse.StatfsResponse{}
+		assert.Nil(t, fs.Statfs(nil, &fuse.StatfsRequest{}, fsInfo))
+		return fsInfo
+	}
+	statfs()
+	assert.Equal(t, uint64(60), statfs().Ffree) // cached
+
+	// the usage of the quota root is refreshed
+	mockClock.NotifyTimeElapsed(10 * time.Second)
+	assert.Equal(t, uint64(60), statfs().Ffree)
+
+	// the quota root is looked up again
+	mockClock.NotifyTimeElapsed(2 * time.Minute)
+	assert.Equal(t, uint64(60), statfs().Ffree)
+}
+
+func TestStatfsWithoutQuota(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/Projects", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	fs.QuotaStatfs = true
+
+	hdfsAccessor.EXPECT().StatFs(gomock.Any()).Return(FsInfo{capacity: uint64(10240), remaining: uint64(1024)}, nil).Times(3)
+	hdfsAccessor.EXPECT().GetQuota(gomock.Any(), "/Projects").Return(QuotaInfo{NameQuota: -1, SpaceQuota: -1}, nil).Times(2)
+	fsInfo := &fuse.StatfsResponse{}
+	err := fs.Statfs(nil, &fuse.StatfsRequest{}, fsInfo)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), fsInfo.Blocks)
+	assert.Equal(t, uint64(1), fsInfo.Bfree)
+	assert.Equal(t, uint64(0), fsInfo.Files)
+
+	// the absence of quota is cached as long as the quota root
+	mockClock.NotifyTimeElapsed(10 * time.Second)
+	assert.Nil(t, fs.Statfs(nil, &fuse.StatfsRequest{}, fsInfo))
+	mockClock.NotifyTimeElapsed(2 * time.Minute)
+	assert.Nil(t, fs.Statfs(nil, &fuse.StatfsRequest{}, fsInfo))
+}
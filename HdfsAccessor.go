@@ -5,15 +5,15 @@ package main
 
 import (
 	"fmt"
-	"io"
+	"math"
 	"os"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"bazil.org/fuse"
 	"github.com/colinmarc/hdfs/v2"
+	"golang.org/x/net/context"
 	"logicalclocks.com/hopsfs-mount/ugcache"
 )
 
@@ -23,27 +23,39 @@ var hadoopUserName string = os.Getenv("HADOOP_USER_NAME")
 var hadoopUserID uint32 = 0
 
 type HdfsAccessor interface {
-	OpenRead(path string) (ReadSeekCloser, error) // Opens HDFS file for reading
-	CreateFile(path string,
+	OpenRead(ctx context.Context, path string) (ReadSeekCloser, error) // Opens HDFS file for reading
+	CreateFile(ctx context.Context, path string,
 		mode os.FileMode, overwrite bool) (HdfsWriter, error) // Opens HDFS file for writing
-	ReadDir(path string) ([]Attrs, error)         // Enumerates HDFS directory
-	Stat(path string) (Attrs, error)              // Retrieves file/directory attributes
-	StatFs() (FsInfo, error)                      // Retrieves HDFS usage
-	Mkdir(path string, mode os.FileMode) error    // Creates a directory
-	Remove(path string) error                     // Removes a file or directory
-	Rename(oldPath string, newPath string) error  // Renames a file or directory
-	EnsureConnected() error                       // Ensures HDFS accessor is connected to the HDFS name node
-	Chown(path string, owner, group string) error // Changes the owner and group of the file
-	Chmod(path string, mode os.FileMode) error    // Changes the mode of the file
-	Close() error                                 // Close current meta connection if needed
+	ReadDir(ctx context.Context, path string) ([]Attrs, error)                         // Enumerates HDFS directory
+	Stat(ctx context.Context, path string) (Attrs, error)                              // Retrieves file/directory attributes
+	StatFs(ctx context.Context) (FsInfo, error)                                        // Retrieves HDFS usage
+	GetQuota(ctx context.Context, path string) (QuotaInfo, error)                      // Retrieves quota and usage of a directory
+	Mkdir(ctx context.Context, path string, mode os.FileMode) error                    // Creates a directory
+	Remove(ctx context.Context, path string) error                                     // Removes a file or an empty directory
+	RemoveAll(ctx context.Context, path string) error                                  // Removes a file or directory recursively
+	Rename(ctx context.Context, oldPath string, newPath string) error                  // Renames a file or directory
+	EnsureConnected() error                                                            // Ensures HDFS accessor is connected to the HDFS name node
+	Chown(ctx context.Context, path string, owner, group string) error                 // Changes the owner and group of the file
+	Chmod(ctx context.Context, path string, mode os.FileMode) error                    // Changes the mode of the file
+	Truncate(ctx context.Context, path string, size int64) error                       // Truncates the file to the given size, the file must not grow
+	SetTimes(ctx context.Context, path string, atime time.Time, mtime time.Time) error // Changes the access and modification times of the file
+	CreateSnapshot(ctx context.Context, path string, name string) error                // Creates a snapshot of a snapshottable directory
+	DeleteSnapshot(ctx context.Context, path string, name string) error                // Deletes a snapshot of a snapshottable directory
+	Close() error                                                                      // Close current meta connection if needed
 }
 
+// Bounds the wait for the recovery of the last block after truncating a file
+// in the middle of a block
+const truncateRecoveryTimeout = time.Minute
+const truncateRecoveryPollInterval = 500 * time.Millisecond
+
 type TLSConfig struct {
 	TLS bool // enable/disable using tls
 	// if TLS is set then also set the following parameters
 	RootCABundle      string
 	ClientCertificate string
 	ClientKey         string
+	CertWatcher       *TLSCertWatcher // if set, connections are rebuilt when the TLS material changes
 }
 
 type hdfsAccessorImpl struct {
@@ -52,6 +64,7 @@ type hdfsAccessorImpl struct {
 	MetadataClient      *hdfs.Client // HDFS client used for metadata operations
 	MetadataClientMutex sync.Mutex   // Serializing all metadata operations for simplicity (for now), TODO: allow N concurrent operations
 	TLSConfig           TLSConfig    // enable/disable using tls
+	certGeneration      uint64       // generation of the TLS material used by MetadataClient
 }
 
 var _ HdfsAccessor = (*hdfsAccessorImpl)(nil) // ensure hdfsAccessorImpl implements HdfsAccessor
@@ -70,6 +83,20 @@ func NewHdfsAccessor(nameNodeAddresses string, clock Clock, tlsConfig TLSConfig)
 
 // Ensures that metadata client is connected
 func (dfs *hdfsAccessorImpl) EnsureConnected() error {
+	dfs.lockHadoopClient()
+	defer dfs.unlockHadoopClient()
+	return dfs.connectIfNeeded()
+}
+
+// Connects the metadata client if it is not connected yet. If the TLS material
+// has been rotated since the client was connected, the client is rebuilt.
+// Must be called with MetadataClientMutex held
+func (dfs *hdfsAccessorImpl) connectIfNeeded() error {
+	if dfs.MetadataClient != nil && dfs.certGeneration != dfs.TLSConfig.CertWatcher.Generation() {
+		loginfo("TLS material has changed. Reconnecting to the name node", Fields{Operation: TLSReload})
+		dfs.MetadataClient.Close()
+		dfs.MetadataClient = nil
+	}
 	if dfs.MetadataClient != nil {
 		return nil
 	}
@@ -78,11 +105,13 @@ func (dfs *hdfsAccessorImpl) EnsureConnected() error {
 
 // Establishes connection to the name node (assigns MetadataClient field)
 func (dfs *hdfsAccessorImpl) ConnectMetadataClient() error {
+	generation := dfs.TLSConfig.CertWatcher.Generation()
 	client, err := dfs.ConnectToNameNode()
 	if err != nil {
 		return err
 	}
 	dfs.MetadataClient = client
+	dfs.certGeneration = generation
 	return nil
 }
 
@@ -149,15 +178,25 @@ func (dfs *hdfsAccessorImpl) connectToNameNodeImpl() (*hdfs.Client, error) {
 }
 
 // Opens HDFS file for reading
-func (dfs *hdfsAccessorImpl) OpenRead(path string) (ReadSeekCloser, error) {
+func (dfs *hdfsAccessorImpl) OpenRead(ctx context.Context, path string) (ReadSeekCloser, error) {
+	var reader ReadSeekCloser
+	err := interruptible(ctx, func() (err error) {
+		reader, err = dfs.openRead(ctx, path)
+		return err
+	}, func() { reader.Close() })
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (dfs *hdfsAccessorImpl) openRead(ctx context.Context, path string) (ReadSeekCloser, error) {
 	// Blocking read. This is to reduce the connections pressue on hadoop-name-node
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return nil, err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return nil, err
 	}
 	reader, err := dfs.MetadataClient.Open(path)
 	if err != nil {
@@ -167,14 +206,12 @@ func (dfs *hdfsAccessorImpl) OpenRead(path string) (ReadSeekCloser, error) {
 }
 
 // Creates new HDFS file
-func (dfs *hdfsAccessorImpl) CreateFile(path string, mode os.FileMode, overwrite bool) (HdfsWriter, error) {
+func (dfs *hdfsAccessorImpl) CreateFile(ctx context.Context, path string, mode os.FileMode, overwrite bool) (HdfsWriter, error) {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return nil, err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return nil, err
 	}
 	writer, err := dfs.MetadataClient.CreateFile(path, 3, 64*1024*1024, mode, overwrite)
 	if err != nil {
@@ -185,14 +222,24 @@ func (dfs *hdfsAccessorImpl) CreateFile(path string, mode os.FileMode, overwrite
 }
 
 // Enumerates HDFS directory
-func (dfs *hdfsAccessorImpl) ReadDir(path string) ([]Attrs, error) {
+func (dfs *hdfsAccessorImpl) ReadDir(ctx context.Context, path string) ([]Attrs, error) {
+	var attrs []Attrs
+	err := interruptible(ctx, func() (err error) {
+		attrs, err = dfs.readDir(ctx, path)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+func (dfs *hdfsAccessorImpl) readDir(ctx context.Context, path string) ([]Attrs, error) {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return nil, err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return nil, err
 	}
 	files, err := dfs.MetadataClient.ReadDir(path)
 	if err != nil {
@@ -213,14 +260,24 @@ func (dfs *hdfsAccessorImpl) ReadDir(path string) ([]Attrs, error) {
 }
 
 // Retrieves file/directory attributes
-func (dfs *hdfsAccessorImpl) Stat(path string) (Attrs, error) {
+func (dfs *hdfsAccessorImpl) Stat(ctx context.Context, path string) (Attrs, error) {
+	var attrs Attrs
+	err := interruptible(ctx, func() (err error) {
+		attrs, err = dfs.stat(ctx, path)
+		return err
+	}, nil)
+	if err != nil {
+		return Attrs{}, err
+	}
+	return attrs, nil
+}
+
+func (dfs *hdfsAccessorImpl) stat(ctx context.Context, path string) (Attrs, error) {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return Attrs{}, err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return Attrs{}, err
 	}
 
 	fileInfo, err := dfs.MetadataClient.Stat(path)
@@ -238,14 +295,24 @@ func (dfs *hdfsAccessorImpl) Stat(path string) (Attrs, error) {
 }
 
 // Retrieves HDFS usages
-func (dfs *hdfsAccessorImpl) StatFs() (FsInfo, error) {
+func (dfs *hdfsAccessorImpl) StatFs(ctx context.Context) (FsInfo, error) {
+	var fsInfo FsInfo
+	err := interruptible(ctx, func() (err error) {
+		fsInfo, err = dfs.statFs(ctx)
+		return err
+	}, nil)
+	if err != nil {
+		return FsInfo{}, err
+	}
+	return fsInfo, nil
+}
+
+func (dfs *hdfsAccessorImpl) statFs(ctx context.Context) (FsInfo, error) {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return FsInfo{}, err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return FsInfo{}, err
 	}
 
 	fsInfo, err := dfs.MetadataClient.StatFs()
@@ -259,6 +326,51 @@ func (dfs *hdfsAccessorImpl) StatFs() (FsInfo, error) {
 	return dfs.AttrsFromFsInfo(fsInfo), nil
 }
 
+// Retrieves quota and usage of a directory
+func (dfs *hdfsAccessorImpl) GetQuota(ctx context.Context, path string) (QuotaInfo, error) {
+	var quota QuotaInfo
+	err := interruptible(ctx, func() (err error) {
+		quota, err = dfs.getQuota(ctx, path)
+		return err
+	}, nil)
+	if err != nil {
+		return QuotaInfo{}, err
+	}
+	return quota, nil
+}
+
+func (dfs *hdfsAccessorImpl) getQuota(ctx context.Context, path string) (QuotaInfo, error) {
+	dfs.lockHadoopClient()
+	defer dfs.unlockHadoopClient()
+
+	if err := dfs.connectIfNeeded(); err != nil {
+		return QuotaInfo{}, err
+	}
+
+	cs, err := dfs.MetadataClient.GetContentSummary(path)
+	if err != nil {
+		if IsSuccessOrNonRetriableError(err) {
+			return QuotaInfo{}, unwrapAndTranslateError(err)
+		}
+		dfs.MetadataClient = nil
+		return QuotaInfo{}, unwrapAndTranslateError(err)
+	}
+	return QuotaInfo{
+		NameQuota:  quotaOrUnlimited(int64(cs.NameQuota())),
+		NameUsed:   uint64(cs.FileCount() + cs.DirectoryCount()),
+		SpaceQuota: quotaOrUnlimited(cs.SpaceQuota()),
+		SpaceUsed:  uint64(cs.SizeAfterReplication()),
+		Length:     uint64(cs.Size())}, nil
+}
+
+// HDFS reports -1 for unset quotas, and Long.MAX_VALUE for the root directory
+func quotaOrUnlimited(quota int64) int64 {
+	if quota < 0 || quota == math.MaxInt64 {
+		return -1
+	}
+	return quota
+}
+
 // Converts os.FileInfo + underlying proto-buf data into Attrs structure
 func (dfs *hdfsAccessorImpl) AttrsFromFileInfo(fileInfo os.FileInfo) Attrs {
 	// protoBufDatr := fileInfo.Sys().(*hadoop_hdfs.HdfsFileStatusProto)
@@ -269,6 +381,7 @@ func (dfs *hdfsAccessorImpl) AttrsFromFileInfo(fileInfo os.FileInfo) Attrs {
 	}
 
 	modificationTime := time.Unix(int64(fi.ModificationTime())/1000, 0)
+	accessTime := fi.AccessTime()
 	gid := ugcache.LookupGid(fi.OwnerGroup())
 	if fi.OwnerGroup() != "root" && gid == 0 {
 		logwarn(fmt.Sprintf("Unable to find group id for group: %s, returning gid: 0", fi.OwnerGroup()), nil)
@@ -285,6 +398,7 @@ func (dfs *hdfsAccessorImpl) AttrsFromFileInfo(fileInfo os.FileInfo) Attrs {
 		Mode:   mode,
 		Size:   fi.Length(),
 		Uid:    uid,
+		Atime:  accessTime,
 		Mtime:  modificationTime,
 		Ctime:  modificationTime,
 		Crtime: modificationTime,
@@ -311,117 +425,146 @@ func IsSuccessOrNonRetriableError(err error) bool {
 	return isNonRetriableError(unwrapAndTranslateError(err))
 }
 
-func unwrapAndTranslateError(err error) error {
-	var e error
-	pathError, ok := err.(*os.PathError)
-	if ok {
-		e = pathError.Err
-	} else {
-		e = err
-	}
+// Creates a directory
+func (dfs *hdfsAccessorImpl) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	dfs.lockHadoopClient()
+	defer dfs.unlockHadoopClient()
 
-	if e == os.ErrNotExist {
-		return syscall.ENOENT
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
 	}
-	if e == os.ErrPermission {
-		return syscall.EPERM
+	return unwrapAndTranslateError(dfs.MetadataClient.Mkdir(path, mode))
+}
+
+// Removes file or directory
+func (dfs *hdfsAccessorImpl) Remove(ctx context.Context, path string) error {
+	dfs.lockHadoopClient()
+	defer dfs.unlockHadoopClient()
+
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
 	}
-	if e == os.ErrExist {
-		return syscall.EEXIST
+	return unwrapAndTranslateError(dfs.MetadataClient.Remove(path))
+}
+
+// Removes file or directory recursively with a single RPC
+func (dfs *hdfsAccessorImpl) RemoveAll(ctx context.Context, path string) error {
+	dfs.lockHadoopClient()
+	defer dfs.unlockHadoopClient()
+
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
 	}
+	return unwrapAndTranslateError(dfs.MetadataClient.RemoveAll(path))
+}
+
+// Renames file or directory
+func (dfs *hdfsAccessorImpl) Rename(ctx context.Context, oldPath string, newPath string) error {
+	dfs.lockHadoopClient()
+	defer dfs.unlockHadoopClient()
 
-	return e
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
+	}
+	return unwrapAndTranslateError(dfs.MetadataClient.Rename(oldPath, newPath))
 }
 
-func isNonRetriableError(err error) bool {
-	if err == io.EOF ||
-		err == fuse.EEXIST ||
-		err == syscall.ENOENT ||
-		err == syscall.EACCES ||
-		err == syscall.ENOTEMPTY ||
-		err == syscall.EEXIST ||
-		err == syscall.EROFS ||
-		err == syscall.EDQUOT ||
-		err == syscall.ENOLINK ||
-		err == os.ErrNotExist ||
-		err == os.ErrPermission ||
-		err == os.ErrExist ||
-		err == os.ErrClosed {
-		return true
-	} else {
-		return false
+// Changes the mode of the file
+func (dfs *hdfsAccessorImpl) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	dfs.lockHadoopClient()
+	defer dfs.unlockHadoopClient()
+
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
 	}
+	return unwrapAndTranslateError(dfs.MetadataClient.Chmod(path, mode))
 }
 
-// Creates a directory
-func (dfs *hdfsAccessorImpl) Mkdir(path string, mode os.FileMode) error {
+// Changes the owner and group of the file
+func (dfs *hdfsAccessorImpl) Chown(ctx context.Context, path string, user, group string) error {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
+	}
+	return unwrapAndTranslateError(dfs.MetadataClient.Chown(path, user, group))
+}
+
+// Truncates the file to the given size in HDFS
+func (dfs *hdfsAccessorImpl) Truncate(ctx context.Context, path string, size int64) error {
+	done, err := dfs.truncateOnce(path, size)
+	if err != nil || done {
+		return err
+	}
+	// the last block has to be recovered before the file can be written again.
+	// Truncating to the same size fails with EBUSY until the recovery completes
+	logdebug("Truncate is waiting for block recovery", Fields{Operation: Truncate, Path: path, Bytes: size, RequestID: requestID(ctx)})
+	deadline := dfs.Clock.Now().Add(truncateRecoveryTimeout)
+	for dfs.Clock.Now().Before(deadline) {
+		<-dfs.Clock.After(truncateRecoveryPollInterval)
+		done, err = dfs.truncateOnce(path, size)
+		if err != nil && err != syscall.EBUSY {
 			return err
 		}
-	}
-	err := dfs.MetadataClient.Mkdir(path, mode)
-	if err != nil {
-		if strings.HasSuffix(err.Error(), "file already exists") {
-			err = fuse.EEXIST
+		if done {
+			return nil
 		}
 	}
-	return err
+	logwarn("Timed out waiting for block recovery after truncate", Fields{Operation: Truncate, Path: path, Bytes: size, RequestID: requestID(ctx)})
+	return syscall.EBUSY
 }
 
-// Removes file or directory
-func (dfs *hdfsAccessorImpl) Remove(path string) error {
+func (dfs *hdfsAccessorImpl) truncateOnce(path string, size int64) (bool, error) {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return false, err
 	}
-	return dfs.MetadataClient.Remove(path)
+	done, err := dfs.MetadataClient.Truncate(path, size)
+	return done, unwrapAndTranslateError(err)
 }
 
-// Renames file or directory
-func (dfs *hdfsAccessorImpl) Rename(oldPath string, newPath string) error {
+// Changes the access and modification times of the file
+func (dfs *hdfsAccessorImpl) SetTimes(ctx context.Context, path string, atime time.Time, mtime time.Time) error {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
 	}
-	return dfs.MetadataClient.Rename(oldPath, newPath)
+	return unwrapAndTranslateError(dfs.MetadataClient.Chtimes(path, atime, mtime))
 }
 
-// Changes the mode of the file
-func (dfs *hdfsAccessorImpl) Chmod(path string, mode os.FileMode) error {
+// Creates a snapshot of a snapshottable directory
+func (dfs *hdfsAccessorImpl) CreateSnapshot(ctx context.Context, path string, name string) error {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
+	}
+	_, err := dfs.MetadataClient.CreateSnapshot(path, name)
+	if err != nil {
+		return unwrapAndTranslateError(err)
 	}
-	return dfs.MetadataClient.Chmod(path, mode)
+	return nil
 }
 
-// Changes the owner and group of the file
-func (dfs *hdfsAccessorImpl) Chown(path string, user, group string) error {
+// Deletes a snapshot of a snapshottable directory
+func (dfs *hdfsAccessorImpl) DeleteSnapshot(ctx context.Context, path string, name string) error {
 	dfs.lockHadoopClient()
 	defer dfs.unlockHadoopClient()
 
-	if dfs.MetadataClient == nil {
-		if err := dfs.ConnectMetadataClient(); err != nil {
-			return err
-		}
+	if err := dfs.connectIfNeeded(); err != nil {
+		return err
 	}
-	return dfs.MetadataClient.Chown(path, user, group)
+	err := dfs.MetadataClient.DeleteSnapshot(path, name)
+	if err != nil {
+		return unwrapAndTranslateError(err)
+	}
+	return nil
 }
 
 // Close current connection if needed
@@ -4,8 +4,11 @@ package main
 
 import (
 	"errors"
+	"syscall"
+	"time"
 
 	"github.com/colinmarc/hdfs/v2"
+	"golang.org/x/net/context"
 )
 
 // Allows to open an HDFS file as a seekable read-only stream
@@ -21,9 +24,16 @@ func NewHdfsReader(backendReader *hdfs.FileReader) ReadSeekCloser {
 	return &HdfsReader{BackendReader: backendReader}
 }
 
-// Read a chunk of data
-func (hr *HdfsReader) Read(buffer []byte) (int, error) {
-	return hr.BackendReader.Read(buffer)
+// Read a chunk of data. A read blocked on a datanode is aborted by setting
+// a deadline in the past once ctx is cancelled
+func (hr *HdfsReader) Read(ctx context.Context, buffer []byte) (int, error) {
+	stop := afterCancel(ctx, func() { hr.BackendReader.SetDeadline(time.Now()) })
+	n, err := hr.BackendReader.Read(buffer)
+	if !stop() {
+		hr.BackendReader.SetDeadline(time.Time{})
+		return n, syscall.EINTR
+	}
+	return n, err
 }
 
 // Seeks to a given position
@@ -15,7 +15,6 @@ type HdfsWriter interface {
 	Write(buffer []byte) (int, error) // Writes chunk of data
 	Flush() error                     // Flushes all the data
 	Close() error                     // Closes the stream
-	Truncate() error                  // Truncate the HDFS file at a given position
 }
 
 type hdfsWriterImpl struct {
@@ -36,7 +35,8 @@ func (w *hdfsWriterImpl) Seek(pos int64) error {
 
 // Writes chunk of data
 func (w *hdfsWriterImpl) Write(buffer []byte) (int, error) {
-	return w.BackendWriter.Write(buffer)
+	n, err := w.BackendWriter.Write(buffer)
+	return n, unwrapAndTranslateError(err)
 }
 
 // Flushes all the data
@@ -45,11 +45,6 @@ func (w *hdfsWriterImpl) Flush() error {
 }
 
 // Closes the stream
-func (w *hdfsWriterImpl) Truncate() error {
-	return errors.New("Truncate is not implemented")
-}
-
-// Truncate the HDFS file at a given position
 func (w *hdfsWriterImpl) Close() error {
-	return w.BackendWriter.Close()
+	return unwrapAndTranslateError(w.BackendWriter.Close())
 }
@@ -5,9 +5,11 @@ package main
 import (
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 )
 
@@ -17,7 +19,7 @@ type FileHandle struct {
 	mutex             sync.Mutex     // all operations on the handle are serialized to simplify invariants
 	fileFlags         fuse.OpenFlags // flags used to creat the file
 	tatalBytesRead    int64
-	totalBytesWritten int64
+	totalBytesWritten int64 // accessed atomically, read by list-open-files without the handle lock
 	fhID              int64 // file handle id. for debugging only
 }
 
@@ -30,56 +32,61 @@ var _ fs.NodeFsyncer = (*FileHandle)(nil)
 var _ fs.HandleFlusher = (*FileHandle)(nil)
 
 func (fh *FileHandle) dataChanged() bool {
-	if fh.totalBytesWritten > 0 {
+	if atomic.LoadInt64(&fh.totalBytesWritten) > 0 {
 		return true
 	} else {
 		return false
 	}
 }
 
-func (fh *FileHandle) Truncate(size int64) error {
+func (fh *FileHandle) Truncate(ctx context.Context, size int64) error {
 	fh.lockHandle()
 	defer fh.unlockHandle()
 
 	// as an optimization the file is initially opened in readonly mode
-	fh.File.upgradeHandleForWriting(fh)
+	fh.File.upgradeHandleForWriting(ctx, fh)
 
 	sizeChanged, err := fh.File.fileProxy.Truncate(size)
 	if err != nil {
-		logerror("Failed to truncate file", fh.logInfo(Fields{Operation: Truncate, Bytes: size, Error: err}))
+		logerror("Failed to truncate file", fh.logInfo(Fields{Operation: Truncate, Bytes: size, Error: err, RequestID: requestID(ctx)}))
 		return err
 	}
 
-	fh.totalBytesWritten += sizeChanged
+	atomic.AddInt64(&fh.totalBytesWritten, sizeChanged)
 
-	loginfo("Truncated file", fh.logInfo(Fields{Operation: Truncate, Bytes: size}))
+	loginfo("Truncated file", fh.logInfo(Fields{Operation: Truncate, Bytes: size, RequestID: requestID(ctx)}))
 	return nil
 }
 
 // Returns attributes of the file associated with this handle
-func (fh *FileHandle) Attr(ctx context.Context, a *fuse.Attr) error {
+func (fh *FileHandle) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	ctx, done := observeFuse(ctx, "Getattr")
+	defer func() { done(err) }()
 	fh.lockHandle()
 	defer fh.unlockHandle()
 	return fh.File.Attr(ctx, a)
 }
 
 // Responds to FUSE Read request
-func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	ctx, done := observeFuse(ctx, "Read")
+	defer func() { done(err) }()
 	fh.lockHandle()
 	defer fh.unlockHandle()
 
 	buf := resp.Data[0:req.Size]
-	nr, err := fh.File.fileProxy.ReadAt(buf, req.Offset)
+	nr, err := fh.File.fileProxy.ReadAt(ctx, buf, req.Offset)
 	resp.Data = buf[0:nr]
 	fh.tatalBytesRead += int64(nr)
+	metrics.BytesRead.Add(float64(nr))
 
 	if err != nil {
 		if err == io.EOF {
 			// EOF isn't a error, reporting successful read to FUSE
-			logdebug("Completed reading", fh.logInfo(Fields{Operation: Read, Error: err, Bytes: nr}))
+			logdebug("Completed reading", fh.logInfo(Fields{Operation: Read, Error: err, Bytes: nr, RequestID: requestID(ctx)}))
 			return nil
 		} else {
-			logerror("Failed to read", fh.logInfo(Fields{Operation: Read, Error: err, Bytes: nr}))
+			logerror("Failed to read", fh.logInfo(Fields{Operation: Read, Error: err, Bytes: nr, RequestID: requestID(ctx)}))
 			return err
 		}
 	}
@@ -87,135 +94,185 @@ func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fus
 }
 
 // Responds to FUSE Write request
-func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	ctx, done := observeFuse(ctx, "Write")
+	defer func() { done(err) }()
 	fh.lockHandle()
 	defer fh.unlockHandle()
 
 	// as an optimization the file is initially opened in readonly mode
-	fh.File.upgradeHandleForWriting(fh)
+	fh.File.upgradeHandleForWriting(ctx, fh)
 
 	nw, err := fh.File.fileProxy.WriteAt(req.Data, req.Offset)
 	resp.Size = nw
-	fh.totalBytesWritten += int64(nw)
+	atomic.AddInt64(&fh.totalBytesWritten, int64(nw))
+	metrics.BytesWritten.Add(float64(nw))
+	atomic.StoreInt32(&fh.File.timesPending, 0) // new data, mtime is set by the upload
 	if err != nil {
-		logerror("Failed to write to staging file", fh.logInfo(Fields{Operation: Write, Error: err}))
+		logerror("Failed to write to staging file", fh.logInfo(Fields{Operation: Write, Error: err, RequestID: requestID(ctx)}))
 		return err
 	} else {
-		logdebug("Write data to staging file", fh.logInfo(Fields{Operation: Write, Bytes: nw, ReqOffset: req.Offset}))
+		logdebug("Write data to staging file", fh.logInfo(Fields{Operation: Write, Bytes: nw, ReqOffset: req.Offset, RequestID: requestID(ctx)}))
 		return nil
 	}
 }
 
-func (fh *FileHandle) copyToDFS(operation string) error {
-	if fh.totalBytesWritten == 0 { // Nothing to do
+// Uploads the staging file. The upload is not interrupted with the FUSE
+// request, e.g. when the process closing the file is killed, so that the
+// changes are not lost
+func (fh *FileHandle) copyToDFS(ctx context.Context, operation string) (err error) {
+	if atomic.LoadInt64(&fh.totalBytesWritten) == 0 { // Nothing to do
 		return nil
 	}
 	defer fh.File.InvalidateMetadataCache()
+	ctx, span := StartSpan(detachContext(ctx), "upload", trace.SpanKindInternal)
+	defer func() { EndSpan(span, err) }()
 
-	logdebug("Uploading to DFS", fh.logInfo(Fields{Operation: Write, Bytes: TotalBytesWritten}))
+	logdebug("Uploading to DFS", fh.logInfo(Fields{Operation: Write, Bytes: TotalBytesWritten, RequestID: requestID(ctx)}))
 
-	op := fh.File.FileSystem.RetryPolicy.StartOperation()
+	op := fh.File.FileSystem.RetryPolicies.Upload.StartOperation(ctx)
 	for {
-		err := fh.FlushAttempt(operation)
+		err := fh.FlushAttempt(ctx, operation)
+		if err == nil {
+			fh.restoreTimes(ctx, operation)
+		}
 		if err != io.EOF || IsSuccessOrNonRetriableError(err) || !op.ShouldRetry("Flush() %s", err) {
 			return err
 		}
 		// Reconnect and try again
 		fh.File.FileSystem.getDFSConnector().Close()
-		logwarn("Failed to copy file to DFS", fh.logInfo(Fields{Operation: operation}))
+		logwarn("Failed to copy file to DFS", fh.logInfo(Fields{Operation: operation, RequestID: requestID(ctx)}))
 	}
 }
 
-func (fh *FileHandle) FlushAttempt(operation string) error {
+// Applies the times set by utimens while the file was staged to the uploaded
+// file. The times stay pending if they can not be applied
+func (fh *FileHandle) restoreTimes(ctx context.Context, operation string) {
+	if !atomic.CompareAndSwapInt32(&fh.File.timesPending, 1, 0) {
+		return
+	}
+	attrs := fh.File.Attrs
+	err := fh.File.FileSystem.getDFSConnector().SetTimes(ctx, fh.File.AbsolutePath(), attrs.Atime, attrs.Mtime)
+	if err != nil {
+		logwarn("Failed to restore times after upload", fh.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
+		atomic.StoreInt32(&fh.File.timesPending, 1)
+	}
+}
+
+func (fh *FileHandle) FlushAttempt(ctx context.Context, operation string) error {
 	hdfsAccessor := fh.File.FileSystem.getDFSConnector()
 	//delete the file and then rewrite.
 	//note we can not rely on the overwrite functionality of CreateFile API.
 	//For example if the file has permission set to 444 then we can not overwrite it
-	err := hdfsAccessor.Remove(fh.File.AbsolutePath())
+	err := hdfsAccessor.Remove(ctx, fh.File.AbsolutePath())
 	if err != nil {
 		// may be this is a retry and the file has already been deleted
 		// log error and continue
-		logwarn("Unable to delete the file during flush.", fh.logInfo(Fields{Operation: operation, Error: err}))
+		logwarn("Unable to delete the file during flush.", fh.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 	}
 
-	w, err := hdfsAccessor.CreateFile(fh.File.AbsolutePath(), fh.File.Attrs.Mode, true)
+	w, err := hdfsAccessor.CreateFile(ctx, fh.File.AbsolutePath(), fh.File.Attrs.Mode, true)
 	if err != nil {
-		logerror("Error creating file in DFS", fh.logInfo(Fields{Operation: operation, Error: err}))
+		logerror("Error creating file in DFS", fh.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 		return err
 	}
 
 	//open the file for reading and upload to DFS
 	err = fh.File.fileProxy.SeekToStart()
 	if err != nil {
-		logerror("Unable to seek to the begenning of the temp file", fh.logInfo(Fields{Operation: operation, Error: err}))
+		logerror("Unable to seek to the begenning of the temp file", fh.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 		return err
 	}
 
 	b := make([]byte, 65536)
 	written := 0
 	for {
-		nr, err := fh.File.fileProxy.Read(b)
+		nr, err := fh.File.fileProxy.Read(ctx, b)
 		if err != nil {
 			if err != io.EOF {
-				logerror("Failed to read from staging file", fh.logInfo(Fields{Operation: operation, Error: err}))
+				logerror("Failed to read from staging file", fh.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 			}
 			break
 		}
-		b = b[:nr]
-
-		nw, err := w.Write(b)
+		nw, err := w.Write(b[:nr])
 		if err != nil {
-			logerror("Failed to write to DFS", fh.logInfo(Fields{Operation: operation, Error: err}))
+			logerror("Failed to write to DFS", fh.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 			w.Close()
 			return err
 		}
-		logtrace("Written to DFS", fh.logInfo(Fields{Operation: operation, Bytes: nw}))
+		logtrace("Written to DFS", fh.logInfo(Fields{Operation: operation, Bytes: nw, RequestID: requestID(ctx)}))
 		written += nw
 	}
 
 	err = w.Close()
 	if err != nil {
-		logerror("Failed to close file in DFS", fh.logInfo(Fields{Operation: operation, Error: err}))
+		logerror("Failed to close file in DFS", fh.logInfo(Fields{Operation: operation, Error: err, RequestID: requestID(ctx)}))
 		return err
 	}
-	loginfo("Uploaded to DFS", fh.logInfo(Fields{Operation: operation, Bytes: written}))
+	loginfo("Uploaded to DFS", fh.logInfo(Fields{Operation: operation, Bytes: written, RequestID: requestID(ctx)}))
 	return nil
 }
 
 // Responds to the FUSE Flush request
-func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	ctx, done := observeFuse(ctx, "Flush")
+	defer func() { done(err) }()
 	fh.lockHandle()
 	defer fh.unlockHandle()
+	if req != nil {
+		// POSIX locks are released on any close of the file
+		defer fh.releaseLocks(req.LockOwner, false)
+	}
 	if fh.dataChanged() {
-		loginfo("Flush file", fh.logInfo(Fields{Operation: Flush}))
-		return fh.copyToDFS(Flush)
+		loginfo("Flush file", fh.logInfo(Fields{Operation: Flush, RequestID: requestID(ctx)}))
+		err := fh.copyToDFS(ctx, Flush)
+		var hdr *fuse.Header
+		if req != nil {
+			hdr = &req.Header
+		}
+		auditLog.Record(AuditFlush, hdr, err, fh.File.AbsolutePath())
+		return err
 	} else {
 		return nil
 	}
 }
 
 // Responds to the FUSE Fsync request
-func (fh *FileHandle) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+func (fh *FileHandle) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	ctx, done := observeFuse(ctx, "Fsync")
+	defer func() { done(err) }()
 	fh.lockHandle()
 	defer fh.unlockHandle()
 	if fh.dataChanged() {
-		loginfo("Fsync file", fh.logInfo(Fields{Operation: Fsync}))
-		return fh.copyToDFS(Fsync)
+		loginfo("Fsync file", fh.logInfo(Fields{Operation: Fsync, RequestID: requestID(ctx)}))
+		err := fh.copyToDFS(ctx, Fsync)
+		var hdr *fuse.Header
+		if req != nil {
+			hdr = &req.Header
+		}
+		auditLog.Record(AuditFlush, hdr, err, fh.File.AbsolutePath())
+		return err
 	} else {
 		return nil
 	}
 }
 
 // Closes the handle
-func (fh *FileHandle) Release(_ context.Context, _ *fuse.ReleaseRequest) error {
+func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	_, done := observeFuse(ctx, "Release")
+	defer func() { done(err) }()
 	fh.lockHandle()
 	defer fh.unlockHandle()
 
+	if req != nil && req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		fh.releaseLocks(req.LockOwner, true)
+	}
+
 	//close the file handle if it is the last handle
 	fh.File.InvalidateMetadataCache()
 	fh.File.RemoveHandle(fh)
 
-	loginfo("Closed file handle ", fh.logInfo(Fields{Operation: Close, Flags: fh.fileFlags, TotalBytesRead: fh.tatalBytesRead, TotalBytesWritten: fh.totalBytesWritten}))
+	loginfo("Closed file handle ", fh.logInfo(Fields{Operation: Close, Flags: fh.fileFlags, TotalBytesRead: fh.tatalBytesRead, TotalBytesWritten: atomic.LoadInt64(&fh.totalBytesWritten)}))
 	return nil
 }
 
@@ -0,0 +1,49 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+type fuseOpKey struct{}
+
+// Starts the instrumentation of a FUSE handler: the request is recorded in
+// the metrics, traced as a span and tracked by the watchdog. The handlers
+// end it with their result:
+//
+//	ctx, done := observeFuse(ctx, "Lookup")
+//	defer func() { done(err) }()
+//
+// Handlers called by other handlers are not recorded again
+func observeFuse(ctx context.Context, op string) (context.Context, func(error)) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if ctx.Value(fuseOpKey{}) != nil {
+		return ctx, func(error) {}
+	}
+	ctx = context.WithValue(ctx, fuseOpKey{}, op)
+	start := time.Now()
+	ctx, span := StartSpan(ctx, "fuse."+op, trace.SpanKindServer)
+	details := ""
+	if req := fuseRequest(ctx); req != nil {
+		details = req.String()
+		hdr := req.Hdr()
+		span.SetAttributes(
+			attribute.String("fuse.request", details),
+			attribute.Int64("fuse.uid", int64(hdr.Uid)),
+			attribute.Int64("fuse.gid", int64(hdr.Gid)),
+			attribute.Int64("fuse.pid", int64(hdr.Pid)))
+	}
+	end := watchdog.Start(ctx, WatchdogFuse, op, details)
+	return ctx, func(err error) {
+		end()
+		metrics.ObserveFuse(op, start, err)
+		EndSpan(span, err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// Records latencies and errors of the HdfsAccessor methods in the metrics,
+// traces each call as a child span of the span of the context and tracks
+// the calls in progress in the watchdog
+type InstrumentedHdfsAccessor struct {
+	Impl HdfsAccessor
+}
+
+var _ HdfsAccessor = (*InstrumentedHdfsAccessor)(nil) // ensure InstrumentedHdfsAccessor implements HdfsAccessor
+
+// Creates an instance of InstrumentedHdfsAccessor
+func NewInstrumentedHdfsAccessor(impl HdfsAccessor) *InstrumentedHdfsAccessor {
+	return &InstrumentedHdfsAccessor{Impl: impl}
+}
+
+// Starts the span of a call, the returned function records the result
+func (ia *InstrumentedHdfsAccessor) observe(ctx context.Context, method string, path string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := StartSpan(ctx, "hdfs."+method, trace.SpanKindClient)
+	if path != "" {
+		span.SetAttributes(attribute.String("hdfs.path", path))
+	}
+	end := watchdog.Start(ctx, WatchdogHdfs, method, path)
+	return ctx, func(err error) {
+		end()
+		metrics.ObserveHdfs(method, start, err)
+		EndSpan(span, err)
+	}
+}
+
+// Opens HDFS file for reading
+func (ia *InstrumentedHdfsAccessor) OpenRead(ctx context.Context, path string) (ReadSeekCloser, error) {
+	ctx, done := ia.observe(ctx, "OpenRead", path)
+	result, err := ia.Impl.OpenRead(ctx, path)
+	done(err)
+	return result, err
+}
+
+// Opens HDFS file for writing
+func (ia *InstrumentedHdfsAccessor) CreateFile(ctx context.Context, path string, mode os.FileMode, overwrite bool) (HdfsWriter, error) {
+	ctx, done := ia.observe(ctx, "CreateFile", path)
+	result, err := ia.Impl.CreateFile(ctx, path, mode, overwrite)
+	done(err)
+	return result, err
+}
+
+// Enumerates HDFS directory
+func (ia *InstrumentedHdfsAccessor) ReadDir(ctx context.Context, path string) ([]Attrs, error) {
+	ctx, done := ia.observe(ctx, "ReadDir", path)
+	result, err := ia.Impl.ReadDir(ctx, path)
+	done(err)
+	return result, err
+}
+
+// Retrieves file/directory attributes
+func (ia *InstrumentedHdfsAccessor) Stat(ctx context.Context, path string) (Attrs, error) {
+	ctx, done := ia.observe(ctx, "Stat", path)
+	result, err := ia.Impl.Stat(ctx, path)
+	done(err)
+	return result, err
+}
+
+// Retrieves HDFS usage
+func (ia *InstrumentedHdfsAccessor) StatFs(ctx context.Context) (FsInfo, error) {
+	ctx, done := ia.observe(ctx, "StatFs", "")
+	result, err := ia.Impl.StatFs(ctx)
+	done(err)
+	return result, err
+}
+
+// Retrieves quota and usage of a directory
+func (ia *InstrumentedHdfsAccessor) GetQuota(ctx context.Context, path string) (QuotaInfo, error) {
+	ctx, done := ia.observe(ctx, "GetQuota", path)
+	result, err := ia.Impl.GetQuota(ctx, path)
+	done(err)
+	return result, err
+}
+
+// Creates a directory
+func (ia *InstrumentedHdfsAccessor) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	ctx, done := ia.observe(ctx, "Mkdir", path)
+	err := ia.Impl.Mkdir(ctx, path, mode)
+	done(err)
+	return err
+}
+
+// Removes a file or an empty directory
+func (ia *InstrumentedHdfsAccessor) Remove(ctx context.Context, path string) error {
+	ctx, done := ia.observe(ctx, "Remove", path)
+	err := ia.Impl.Remove(ctx, path)
+	done(err)
+	return err
+}
+
+// Removes a file or directory recursively
+func (ia *InstrumentedHdfsAccessor) RemoveAll(ctx context.Context, path string) error {
+	ctx, done := ia.observe(ctx, "RemoveAll", path)
+	err := ia.Impl.RemoveAll(ctx, path)
+	done(err)
+	return err
+}
+
+// Renames a file or directory
+func (ia *InstrumentedHdfsAccessor) Rename(ctx context.Context, oldPath string, newPath string) error {
+	ctx, done := ia.observe(ctx, "Rename", oldPath)
+	err := ia.Impl.Rename(ctx, oldPath, newPath)
+	done(err)
+	return err
+}
+
+// Ensures HDFS accessor is connected to the HDFS name node
+func (ia *InstrumentedHdfsAccessor) EnsureConnected() error {
+	start := time.Now()
+	err := ia.Impl.EnsureConnected()
+	metrics.ObserveHdfs("EnsureConnected", start, err)
+	return err
+}
+
+// Changes the owner and group of the file
+func (ia *InstrumentedHdfsAccessor) Chown(ctx context.Context, path string, owner, group string) error {
+	ctx, done := ia.observe(ctx, "Chown", path)
+	err := ia.Impl.Chown(ctx, path, owner, group)
+	done(err)
+	return err
+}
+
+// Changes the mode of the file
+func (ia *InstrumentedHdfsAccessor) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	ctx, done := ia.observe(ctx, "Chmod", path)
+	err := ia.Impl.Chmod(ctx, path, mode)
+	done(err)
+	return err
+}
+
+// Truncates the file to the given size
+func (ia *InstrumentedHdfsAccessor) Truncate(ctx context.Context, path string, size int64) error {
+	ctx, done := ia.observe(ctx, "Truncate", path)
+	err := ia.Impl.Truncate(ctx, path, size)
+	done(err)
+	return err
+}
+
+// Changes the access and modification times of the file
+func (ia *InstrumentedHdfsAccessor) SetTimes(ctx context.Context, path string, atime time.Time, mtime time.Time) error {
+	ctx, done := ia.observe(ctx, "SetTimes", path)
+	err := ia.Impl.SetTimes(ctx, path, atime, mtime)
+	done(err)
+	return err
+}
+
+// Creates a snapshot of a snapshottable directory
+func (ia *InstrumentedHdfsAccessor) CreateSnapshot(ctx context.Context, path string, name string) error {
+	ctx, done := ia.observe(ctx, "CreateSnapshot", path)
+	err := ia.Impl.CreateSnapshot(ctx, path, name)
+	done(err)
+	return err
+}
+
+// Deletes a snapshot of a snapshottable directory
+func (ia *InstrumentedHdfsAccessor) DeleteSnapshot(ctx context.Context, path string, name string) error {
+	ctx, done := ia.observe(ctx, "DeleteSnapshot", path)
+	err := ia.Impl.DeleteSnapshot(ctx, path, name)
+	done(err)
+	return err
+}
+
+// Close current meta connection if needed
+func (ia *InstrumentedHdfsAccessor) Close() error {
+	return ia.Impl.Close()
+}
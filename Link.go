@@ -0,0 +1,135 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// Policies for hard links, HDFS does not support them
+const (
+	HardLinksEPERM   = "eperm"   // link(2) fails with EPERM, as on file systems without hard links
+	HardLinksENOTSUP = "enotsup" // link(2) fails with ENOTSUP
+	HardLinksCopy    = "copy"    // link(2) creates a copy of the file
+)
+
+// Verify that *DirINode implements the FUSE link and mknod interfaces
+var _ fs.NodeLinker = (*DirINode)(nil)
+var _ fs.NodeMknoder = (*DirINode)(nil)
+
+// Returns an error if the hard link policy is not known
+func ValidateHardLinks(policy string) error {
+	switch policy {
+	case HardLinksEPERM, HardLinksENOTSUP, HardLinksCopy:
+		return nil
+	}
+	return fmt.Errorf("unknown hard link policy %q, expected %s, %s or %s", policy, HardLinksEPERM, HardLinksENOTSUP, HardLinksCopy)
+}
+
+// Responds on FUSE Link request according to the hard link policy of the file system
+func (dir *DirINode) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (_ fs.Node, err error) {
+	ctx, done := observeFuse(ctx, "Link")
+	defer func() { done(err) }()
+	dir.lockMutex()
+	defer dir.unlockMutex()
+
+	newPath := dir.AbsolutePathForChild(req.NewName)
+	if err := checkNotInSnapshot(newPath, Link); err != nil {
+		return nil, err
+	}
+
+	switch dir.FileSystem.HardLinks {
+	case HardLinksCopy:
+	case HardLinksENOTSUP:
+		logdebug("Hard links are not supported", Fields{Operation: Link, Path: newPath, RequestID: requestID(ctx)})
+		return nil, syscall.ENOTSUP
+	default:
+		logdebug("Hard links are not supported", Fields{Operation: Link, Path: newPath, RequestID: requestID(ctx)})
+		return nil, syscall.EPERM
+	}
+
+	file, ok := old.(*FileINode)
+	if !ok {
+		// hard links to directories are not allowed
+		return nil, syscall.EPERM
+	}
+	defer func() { auditLog.Record(AuditLink, &req.Header, err, file.AbsolutePath(), newPath) }()
+	logwarn("Emulating hard link by copying "+file.AbsolutePath(), Fields{Operation: Link, Path: newPath, RequestID: requestID(ctx)})
+
+	reader, err := file.OpenRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hdfsAccessor := dir.FileSystem.getDFSConnector()
+	w, err := hdfsAccessor.CreateFile(ctx, newPath, file.Attrs.Mode, false)
+	if err != nil {
+		logwarn("Failed to create copy", Fields{Operation: Link, Path: newPath, Error: err, RequestID: requestID(ctx)})
+		return nil, err
+	}
+	nc, err := io.Copy(w, contextReader{ctx, reader})
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logwarn("Failed to copy file", Fields{Operation: Link, Path: newPath, Error: err, RequestID: requestID(ctx)})
+		hdfsAccessor.Remove(ctx, newPath)
+		return nil, err
+	}
+	loginfo(fmt.Sprintf("Hard link emulated. %d bytes copied", nc), Fields{Operation: Link, Path: newPath, RequestID: requestID(ctx)})
+
+	var attrs Attrs
+	if err := dir.LookupAttrs(ctx, req.NewName, &attrs); err != nil {
+		return nil, err
+	}
+	return dir.NodeFromAttrs(attrs), nil
+}
+
+// Responds on FUSE Mknod request. Only regular files can be created, HDFS
+// has no FIFOs, sockets or device files
+func (dir *DirINode) Mknod(ctx context.Context, req *fuse.MknodRequest) (_ fs.Node, err error) {
+	ctx, done := observeFuse(ctx, "Mknod")
+	defer func() { done(err) }()
+	dir.lockMutex()
+	defer dir.unlockMutex()
+
+	path := dir.AbsolutePathForChild(req.Name)
+	defer func() { auditLog.Record(AuditMknod, &req.Header, err, path) }()
+	if err := checkNotInSnapshot(path, Mknod); err != nil {
+		return nil, err
+	}
+	if req.Mode&os.ModeType != 0 {
+		logdebug("Unsupported node type", Fields{Operation: Mknod, Path: path, Mode: req.Mode, RequestID: requestID(ctx)})
+		return nil, syscall.EPERM
+	}
+
+	hdfsAccessor := dir.FileSystem.getDFSConnector()
+	w, err := hdfsAccessor.CreateFile(ctx, path, req.Mode, false)
+	if err != nil {
+		logwarn("Failed to create file", Fields{Operation: Mknod, Path: path, Error: err, RequestID: requestID(ctx)})
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := ChownOp(ctx, &dir.Attrs, dir.FileSystem, path, req.Uid, req.Gid); err != nil {
+		logwarn("Unable to change ownership of new file", Fields{Operation: Mknod, Path: path, UID: req.Uid, GID: req.Gid, Error: err, RequestID: requestID(ctx)})
+		hdfsAccessor.Remove(ctx, path)
+		return nil, err
+	}
+
+	var attrs Attrs
+	if err := dir.LookupAttrs(ctx, req.Name, &attrs); err != nil {
+		return nil, err
+	}
+	return dir.NodeFromAttrs(attrs), nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"math"
 	"os"
+
+	"golang.org/x/net/context"
 )
 
 type LocalRWFileProxy struct {
@@ -40,7 +42,7 @@ func (p *LocalRWFileProxy) WriteAt(b []byte, off int64) (n int, err error) {
 	return p.localFile.WriteAt(b, off)
 }
 
-func (p *LocalRWFileProxy) ReadAt(b []byte, off int64) (n int, err error) {
+func (p *LocalRWFileProxy) ReadAt(ctx context.Context, b []byte, off int64) (n int, err error) {
 	p.file.lockFileHandles()
 	defer p.file.unlockFileHandles()
 	n, err = p.localFile.ReadAt(b, off)
@@ -55,10 +57,10 @@ func (p *LocalRWFileProxy) SeekToStart() (err error) {
 	return
 }
 
-func (p *LocalRWFileProxy) Read(b []byte) (n int, err error) {
+func (p *LocalRWFileProxy) Read(ctx context.Context, b []byte) (n int, err error) {
 	p.file.lockFileHandles()
 	defer p.file.unlockFileHandles()
-	return p.localFile.Read(b)
+	return readSparse(p.localFile, b)
 }
 
 func (p *LocalRWFileProxy) Close() error {
@@ -0,0 +1,234 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Represents advisory locks as lease files in HDFS, so that mounts on different
+// hosts coordinate. A mount holds the lease of a file while any process on the
+// host has a lock on it; a lease is exclusive for the whole file. Leases are
+// refreshed periodically, leases of crashed mounts expire after the TTL.
+// The mtime of a lease is set with the clock of the mount holding it, so it is
+// not compared with the local clock: a lease expires once its mtime has not
+// changed for the TTL, measured locally from the first time it was seen.
+// The RPCs are made without holding the mutex, a lease of a file serializes
+// only the RPCs on its own lease file
+// Concurrency: thread safe
+type LockLeases struct {
+	FileSystem *FileSystem                 // file system used to access HDFS
+	Dir        string                      // HDFS directory of the lease files
+	TTL        time.Duration               // leases not refreshed within the TTL are considered expired
+	leases     map[string]*lockLease       // leases held or being acquired by this mount, by file
+	observed   map[string]leaseObservation // leases held by other mounts, by file
+	mutex      sync.Mutex                  // guards the maps
+}
+
+// Lease of a file held by this mount
+type lockLease struct {
+	refs    int        // holders and calls using the lease, guarded by the mutex of LockLeases
+	holders int        // holders of the lease
+	mutex   sync.Mutex // guards holders and serializes the RPCs on the lease file
+}
+
+// Lease held by another mount, as seen by this mount
+type leaseObservation struct {
+	mtime   time.Time // mtime of the lease file
+	since   time.Time // local time the mtime was first seen
+	checked time.Time // local time the lease was last checked
+}
+
+// Creates an instance of LockLeases
+func NewLockLeases(fileSystem *FileSystem, dir string, ttl time.Duration) *LockLeases {
+	return &LockLeases{
+		FileSystem: fileSystem,
+		Dir:        dir,
+		TTL:        ttl,
+		leases:     make(map[string]*lockLease),
+		observed:   make(map[string]leaseObservation)}
+}
+
+// Returns the path of the lease file of a file
+func (l *LockLeases) leasePath(file string) string {
+	return path.Join(l.Dir, url.PathEscape(file)+".lock")
+}
+
+// Returns the lease of the file with a new reference. The lease is created
+// if needed, otherwise nil is returned if the file has no lease
+func (l *LockLeases) ref(file string, create bool) *lockLease {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lease := l.leases[file]
+	if lease == nil {
+		if !create {
+			return nil
+		}
+		lease = &lockLease{}
+		l.leases[file] = lease
+	}
+	lease.refs++
+	return lease
+}
+
+// Drops references to the lease of the file, the lease is forgotten with the last one
+func (l *LockLeases) unref(file string, lease *lockLease, refs int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lease.refs -= refs
+	if lease.refs == 0 {
+		delete(l.leases, file)
+	}
+}
+
+// Acquires the lease of the file. Returns EAGAIN if the lease is held by another mount
+func (l *LockLeases) Acquire(ctx context.Context, file string) error {
+	lease := l.ref(file, true)
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+
+	if lease.holders > 0 {
+		lease.holders++ // the reference is kept by the holder
+		return nil
+	}
+	if err := l.acquire(ctx, file); err != nil {
+		l.unref(file, lease, 1)
+		return err
+	}
+	lease.holders = 1
+	return nil
+}
+
+// Creates the lease file, or takes it over if it has expired
+func (l *LockLeases) acquire(ctx context.Context, file string) error {
+	hdfsAccessor := l.FileSystem.getDFSConnector()
+	leasePath := l.leasePath(file)
+	err := l.create(ctx, leasePath)
+	if err == syscall.EEXIST {
+		attrs, statErr := hdfsAccessor.Stat(ctx, leasePath)
+		if statErr != nil || !l.expired(file, attrs.Mtime) {
+			logdebug("Lock lease is held by another mount", Fields{Operation: Lock, Path: file, RequestID: requestID(ctx)})
+			return syscall.EAGAIN
+		}
+		logwarn("Taking over expired lock lease", Fields{Operation: Lock, Path: file, Mtime: attrs.Mtime, RequestID: requestID(ctx)})
+		if err := hdfsAccessor.Remove(ctx, leasePath); err != nil && err != syscall.ENOENT {
+			return err
+		}
+		err = l.create(ctx, leasePath)
+		if err == syscall.EEXIST {
+			return syscall.EAGAIN
+		}
+	}
+	if err != nil {
+		logwarn("Failed to create lock lease", Fields{Operation: Lock, Path: leasePath, Error: err, RequestID: requestID(ctx)})
+		return err
+	}
+	l.mutex.Lock()
+	delete(l.observed, file)
+	l.mutex.Unlock()
+	loginfo("Acquired lock lease", Fields{Operation: Lock, Path: file, RequestID: requestID(ctx)})
+	return nil
+}
+
+// Returns true if the lease of another mount has expired, i.e. its mtime
+// has not changed for the TTL
+func (l *LockLeases) expired(file string, mtime time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.FileSystem.Clock.Now()
+	o, ok := l.observed[file]
+	if !ok || !o.mtime.Equal(mtime) {
+		o = leaseObservation{mtime: mtime, since: now}
+	}
+	o.checked = now
+	l.observed[file] = o
+	return now.Sub(o.since) >= l.TTL
+}
+
+// Releases the lease of the file
+func (l *LockLeases) Release(file string) {
+	lease := l.ref(file, false)
+	if lease == nil {
+		return
+	}
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+
+	if lease.holders == 0 {
+		l.unref(file, lease, 1)
+		return
+	}
+	lease.holders--
+	defer l.unref(file, lease, 2) // own reference and the one of the holder
+	if lease.holders > 0 {
+		return
+	}
+	if err := l.FileSystem.getDFSConnector().Remove(context.Background(), l.leasePath(file)); err != nil {
+		logwarn("Failed to remove lock lease", Fields{Operation: Lock, Path: file, Error: err})
+		return
+	}
+	loginfo("Released lock lease", Fields{Operation: Lock, Path: file})
+}
+
+// Refreshes the held leases. Never returns
+func (l *LockLeases) Run() {
+	for {
+		<-l.FileSystem.Clock.After(l.TTL / 3)
+		l.Refresh()
+	}
+}
+
+// Refreshes the held leases once, and forgets the leases of other mounts
+// which are no longer checked
+func (l *LockLeases) Refresh() {
+	now := l.FileSystem.Clock.Now()
+	l.mutex.Lock()
+	leases := make(map[string]*lockLease, len(l.leases))
+	for file, lease := range l.leases {
+		lease.refs++
+		leases[file] = lease
+	}
+	for file, o := range l.observed {
+		if now.Sub(o.checked) > l.TTL {
+			delete(l.observed, file)
+		}
+	}
+	l.mutex.Unlock()
+
+	for file, lease := range leases {
+		lease.mutex.Lock()
+		if lease.holders > 0 {
+			if err := l.FileSystem.getDFSConnector().SetTimes(context.Background(), l.leasePath(file), now, now); err != nil {
+				logwarn("Failed to refresh lock lease", Fields{Operation: Lock, Path: file, Error: err})
+			}
+		}
+		lease.mutex.Unlock()
+		l.unref(file, lease, 1)
+	}
+}
+
+// Creates the lease file, recording the owner of the lease for diagnostics
+func (l *LockLeases) create(ctx context.Context, leasePath string) error {
+	hdfsAccessor := l.FileSystem.getDFSConnector()
+	if err := mkdirAll(ctx, hdfsAccessor, l.Dir); err != nil {
+		return err
+	}
+	w, err := hdfsAccessor.CreateFile(ctx, leasePath, 0644, false)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	if _, err := w.Write([]byte(fmt.Sprintf("%s:%d\n", hostname, os.Getpid()))); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -8,71 +8,101 @@ import (
 	"os"
 	"runtime"
 
+	"bazil.org/fuse"
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	logger "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // bunch of constants for logging
 const (
-	Path              = "path"
-	Operation         = "op"
-	Mode              = "mode"
-	Flags             = "flags"
-	Bytes             = "bytes"
-	ReadDir           = "read_dir"
-	Read              = "read"
-	ReadArch          = "read_archive"
-	OpenArch          = "open_archive"
-	ReadHandle        = "create_read_handle"
-	Write             = "write"
-	WriteHandle       = "create_write_handle"
-	Open              = "open"
-	Remove            = "remove"
-	Create            = "create"
-	Rename            = "rename"
-	Chmod             = "chmod"
-	Chown             = "chown"
-	Fsync             = "fsync"
-	Flush             = "flush"
-	Close             = "close"
-	Stat              = "stat"
-	Mkdir             = "mkdir"
-	StatFS            = "statfs"
-	UID               = "uid"
-	GID               = "gid"
-	User              = "user"
-	Group             = "group"
-	Holes             = "holes"
-	Seeks             = "seeks"
-	HardSeeks         = "hard_seeks"
-	CacheHits         = "cache_hits"
-	TmpFile           = "tmp_file"
-	Archive           = "zip_file"
-	Error             = "error"
-	Offset            = "offset"
-	RetryingPolicy    = "retry_policy"
-	Message           = "msg"
-	Retries           = "retries"
-	Diag              = "diag"
-	Delay             = "delay"
-	Entries           = "entries"
-	Truncate          = "truncate"
-	TotalBytesRead    = "total_bytes_read"
-	TotalBytesWritten = "total_bytes_written"
-	FileSize          = "file_size"
-	Line              = "line"
-	ReqOffset         = "req_offset"
-	FileHandleID      = "file_handle_id"
+	Path                   = "path"
+	Operation              = "op"
+	Mode                   = "mode"
+	Flags                  = "flags"
+	Bytes                  = "bytes"
+	ReadDir                = "read_dir"
+	Read                   = "read"
+	ReadArch               = "read_archive"
+	OpenArch               = "open_archive"
+	ReadHandle             = "create_read_handle"
+	Write                  = "write"
+	WriteHandle            = "create_write_handle"
+	Open                   = "open"
+	Remove                 = "remove"
+	Create                 = "create"
+	Rename                 = "rename"
+	Chmod                  = "chmod"
+	Chown                  = "chown"
+	Fsync                  = "fsync"
+	Flush                  = "flush"
+	Close                  = "close"
+	Stat                   = "stat"
+	Mkdir                  = "mkdir"
+	StatFS                 = "statfs"
+	GetXattr               = "getxattr"
+	Setattr                = "setattr"
+	CreateSnapshot         = "create_snapshot"
+	DeleteSnapshot         = "delete_snapshot"
+	Snapshot               = "snapshot"
+	Pid                    = "pid"
+	Invalidate             = "invalidate"
+	RemoveAll              = "remove_all"
+	SetTimes               = "set_times"
+	Atime                  = "atime"
+	Mtime                  = "mtime"
+	Lock                   = "lock"
+	LockType               = "lock_type"
+	UID                    = "uid"
+	GID                    = "gid"
+	User                   = "user"
+	Group                  = "group"
+	Holes                  = "holes"
+	Seeks                  = "seeks"
+	HardSeeks              = "hard_seeks"
+	CacheHits              = "cache_hits"
+	TmpFile                = "tmp_file"
+	Archive                = "zip_file"
+	Error                  = "error"
+	Offset                 = "offset"
+	RetryingPolicy         = "retry_policy"
+	Message                = "msg"
+	Retries                = "retries"
+	Diag                   = "diag"
+	Delay                  = "delay"
+	Entries                = "entries"
+	Truncate               = "truncate"
+	Link                   = "link"
+	Mknod                  = "mknod"
+	NamenodeSafeMode       = "safe_mode"
+	NamenodeCircuitBreaker = "circuit_breaker"
+	Control                = "control"
+	Trace                  = "trace"
+	TotalBytesRead         = "total_bytes_read"
+	TotalBytesWritten      = "total_bytes_written"
+	FileSize               = "file_size"
+	Line                   = "line"
+	ReqOffset              = "req_offset"
+	FileHandleID           = "file_handle_id"
+	TLSReload              = "tls_reload"
+	Expires                = "expires"
+	RequestID              = "req_id"
+	Stack                  = "stack"
 )
 
 var ReportCaller = true
 
+// Rotation of the log file
+var logMaxSize = 100   // megabytes
+var logMaxBackups = 10 // number of rotated files kept
+var logMaxAge = 30     // days
+
 func init() {
-	initLogger("fatal", false, "")
+	initLogger("fatal", false, "", "text")
 }
 
-func initLogger(l string, reportCaller bool, lfile string) {
+func initLogger(l string, reportCaller bool, lfile string, format string) {
 	ReportCaller = reportCaller
 	lvl, err := logger.ParseLevel(l)
 	if err != nil {
@@ -84,15 +114,21 @@ func initLogger(l string, reportCaller bool, lfile string) {
 	// Can be any io.Writer, see below for File example
 	// TODO log to file and log cutting
 
-	//Json output
-	//logger.SetFormatter(&logger.JSONFormatter{})
-
-	//set custom formatter github.com/antonfisher/nested-logrus-formatter
-	logger.SetFormatter(&nested.Formatter{
-		HideKeys:       false,
-		NoFieldsColors: true,
-		FieldsOrder:    []string{Operation, Path, Bytes, TotalBytesRead, TotalBytesWritten},
-	})
+	switch format {
+	case "json":
+		// one JSON object per line, for log pipelines
+		logger.SetFormatter(&logger.JSONFormatter{})
+	default:
+		if format != "text" {
+			logger.Errorf("Invalid log format %s ", format)
+		}
+		//set custom formatter github.com/antonfisher/nested-logrus-formatter
+		logger.SetFormatter(&nested.Formatter{
+			HideKeys:       false,
+			NoFieldsColors: true,
+			FieldsOrder:    []string{RequestID, Operation, Path, Bytes, TotalBytesRead, TotalBytesWritten},
+		})
+	}
 
 	// Only log the warning severity or above.
 	logger.SetLevel(lvl)
@@ -101,17 +137,54 @@ func initLogger(l string, reportCaller bool, lfile string) {
 	if lfile != "" {
 		logger.SetOutput(&lumberjack.Logger{
 			Filename:   lfile,
-			MaxSize:    100, // megabytes
-			MaxBackups: 10,
-			MaxAge:     30, //days
+			MaxSize:    logMaxSize, // megabytes
+			MaxBackups: logMaxBackups,
+			MaxAge:     logMaxAge, //days
 		})
 	} else {
 		logger.SetOutput(os.Stdout)
 	}
 }
 
+// Changes the log level of the running process
+func setLogLevel(l string) error {
+	lvl, err := logger.ParseLevel(l)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(lvl)
+	logLevel = lvl.String()
+	return nil
+}
+
 type Fields logger.Fields
 
+type fuseRequestKey struct{}
+
+// Returns the context of a FUSE request carrying the request, to be set as
+// fs.Config.WithContext. Its ID is logged as RequestID with requestID(ctx)
+func withFuseRequest(ctx context.Context, req fuse.Request) context.Context {
+	return context.WithValue(ctx, fuseRequestKey{}, req)
+}
+
+// Returns the FUSE request of the context, nil outside of FUSE requests
+func fuseRequest(ctx context.Context) fuse.Request {
+	if ctx == nil {
+		return nil
+	}
+	req, _ := ctx.Value(fuseRequestKey{}).(fuse.Request)
+	return req
+}
+
+// Returns the ID of the FUSE request of the context, 0 outside of FUSE
+// requests. Zero IDs are not logged
+func requestID(ctx context.Context) fuse.RequestID {
+	if req := fuseRequest(ctx); req != nil {
+		return req.Hdr().ID
+	}
+	return 0
+}
+
 func logtrace(msg string, f Fields) {
 	logmessage(logger.TraceLevel, msg, f)
 }
@@ -141,6 +214,9 @@ func logpanic(msg string, f Fields) {
 }
 
 func logmessage(lvl logger.Level, msg string, f Fields) {
+	if id, ok := f[RequestID]; ok && id == fuse.RequestID(0) {
+		delete(f, RequestID)
+	}
 	if ReportCaller {
 		_, file, line, _ := runtime.Caller(2)
 		if f == nil {
@@ -0,0 +1,40 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	logger "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// Testing that the JSON log entries carry the ID of the FUSE request
+func TestLogRequestID(t *testing.T) {
+	initLogger("info", false, "", "json")
+	defer initLogger("fatal", false, "", "text")
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(os.Stdout)
+
+	ctx := withFuseRequest(context.Background(), &fuse.MkdirRequest{Header: fuse.Header{ID: 42}})
+	loginfo("Created directory", Fields{Operation: Mkdir, Path: "/dir", RequestID: requestID(ctx)})
+	loginfo("Outside of a request", Fields{Operation: Mkdir, RequestID: requestID(nil)})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "Created directory", entry["msg"])
+	assert.Equal(t, "/dir", entry[Path])
+	assert.Equal(t, float64(42), entry[RequestID])
+	entry = nil
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.NotContains(t, entry, RequestID)
+}
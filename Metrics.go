@@ -0,0 +1,178 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics of the mount, exposed in the Prometheus text format
+var metrics = NewMetrics()
+
+// Latency buckets in seconds, from 100µs to 60s
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// Collection of the metrics of the mount
+// Concurrency: thread safe
+type Metrics struct {
+	Registry      *prometheus.Registry
+	FuseRequests  *prometheus.CounterVec   // FUSE requests by operation
+	FuseErrors    *prometheus.CounterVec   // failed FUSE requests by operation and errno
+	FuseLatency   *prometheus.HistogramVec // FUSE request latencies by operation
+	HdfsLatency   *prometheus.HistogramVec // HDFS RPC latencies by method
+	HdfsErrors    *prometheus.CounterVec   // failed HDFS RPCs by method and errno
+	Retries       prometheus.Counter       // retries of failed operations
+	RetriesFailed prometheus.Counter       // operations which failed after all retries
+	BytesRead     prometheus.Counter       // bytes read through file handles
+	BytesWritten  prometheus.Counter       // bytes written through file handles
+	OpenHandles   prometheus.Gauge         // open file handles
+	CacheRequests *prometheus.CounterVec   // attribute and entry cache lookups by cache and result
+}
+
+// Creates an instance of Metrics
+func NewMetrics() *Metrics {
+	m := &Metrics{Registry: prometheus.NewRegistry()}
+	m.FuseRequests = m.newCounterVec("hopsfs_mount_fuse_requests_total", "FUSE requests by operation", "op")
+	m.FuseErrors = m.newCounterVec("hopsfs_mount_fuse_errors_total", "Failed FUSE requests by operation and errno", "op", "errno")
+	m.FuseLatency = m.newHistogramVec("hopsfs_mount_fuse_request_duration_seconds", "Latency of FUSE requests by operation", "op")
+	m.HdfsLatency = m.newHistogramVec("hopsfs_mount_hdfs_request_duration_seconds", "Latency of HDFS RPCs by method", "method")
+	m.HdfsErrors = m.newCounterVec("hopsfs_mount_hdfs_errors_total", "Failed HDFS RPCs by method and errno", "method", "errno")
+	m.Retries = m.newCounter("hopsfs_mount_retries_total", "Retries of failed operations")
+	m.RetriesFailed = m.newCounter("hopsfs_mount_retries_exhausted_total", "Operations which failed after all retries")
+	m.BytesRead = m.newCounter("hopsfs_mount_read_bytes_total", "Bytes read through file handles")
+	m.BytesWritten = m.newCounter("hopsfs_mount_written_bytes_total", "Bytes written through file handles")
+	m.OpenHandles = prometheus.NewGauge(prometheus.GaugeOpts{Name: "hopsfs_mount_open_handles", Help: "Open file handles"})
+	m.Registry.MustRegister(m.OpenHandles)
+	m.CacheRequests = m.newCounterVec("hopsfs_mount_cache_requests_total", "Attribute and directory entry cache lookups by result", "cache", "result")
+	m.AddGaugeFunc("hopsfs_mount_staging_bytes", "Disk space used by the staging files", stagingDirUsage)
+	return m
+}
+
+func (m *Metrics) newCounter(name string, help string) prometheus.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	m.Registry.MustRegister(c)
+	return c
+}
+
+func (m *Metrics) newCounterVec(name string, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	m.Registry.MustRegister(c)
+	return c
+}
+
+func (m *Metrics) newHistogramVec(name string, help string, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: latencyBuckets}, labels)
+	m.Registry.MustRegister(h)
+	return h
+}
+
+// Adds a gauge whose value is computed when the metrics are collected
+func (m *Metrics) AddGaugeFunc(name string, help string, fn func() float64) {
+	m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, fn))
+}
+
+// Records a cache lookup
+func (m *Metrics) ObserveCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.CacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// Records an HDFS RPC
+func (m *Metrics) ObserveHdfs(method string, start time.Time, err error) {
+	m.HdfsLatency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.HdfsErrors.WithLabelValues(method, errnoName(err)).Inc()
+	}
+}
+
+// Records a FUSE request served by a handler, see observeFuse
+func (m *Metrics) ObserveFuse(op string, start time.Time, err error) {
+	m.FuseRequests.WithLabelValues(op).Inc()
+	if err != nil {
+		m.FuseErrors.WithLabelValues(op, errnoName(err)).Inc()
+	}
+	m.FuseLatency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// Serves the metrics on http://<addr>/metrics. Never returns
+func (m *Metrics) ListenAndServe(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+	loginfo(fmt.Sprintf("Serving metrics on %s/metrics", addr), nil)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logerror(fmt.Sprintf("Metrics listener failed. Error: %v", err), nil)
+	}
+}
+
+// Returns the current value of a counter or a gauge
+func metricValue(metric prometheus.Metric) float64 {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return math.NaN()
+	}
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.Gauge.GetValue()
+}
+
+// Returns the values of a counter vector by the comma separated values of
+// the given labels, e.g. "Lookup,ENOENT"
+func metricValues(collector prometheus.Collector, labels ...string) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+	values := make(map[string]float64)
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		labelValues := make([]string, len(labels))
+		for _, pair := range m.Label {
+			for i, name := range labels {
+				if pair.GetName() == name {
+					labelValues[i] = pair.GetValue()
+				}
+			}
+		}
+		values[strings.Join(labelValues, ",")] = m.Counter.GetValue()
+	}
+	return values
+}
+
+// Returns the disk space allocated by the staging files
+func stagingDirUsage() float64 {
+	files, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return math.NaN()
+	}
+	var usage int64
+	for _, fi := range files {
+		if match, _ := filepath.Match("stage*", fi.Name()); !match || !fi.Mode().IsRegular() {
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			usage += st.Blocks * 512
+		} else {
+			usage += fi.Size()
+		}
+	}
+	return float64(usage)
+}
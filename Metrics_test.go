@@ -0,0 +1,69 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the number of observations of a histogram
+func histogramCount(observer prometheus.Observer) uint64 {
+	var m dto.Metric
+	observer.(prometheus.Metric).Write(&m)
+	return m.Histogram.GetSampleCount()
+}
+
+// Testing the metrics served on /metrics
+func TestMetricsEndpoint(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveFuse("Lookup", time.Now(), nil)
+	m.ObserveFuse("Lookup", time.Now(), fuse.ENOENT)
+	m.ObserveHdfs("Stat", time.Now(), syscall.ENOENT)
+	m.ObserveCache("attrs", true)
+	m.OpenHandles.Inc()
+
+	recorder := httptest.NewRecorder()
+	promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	lines := strings.Split(recorder.Body.String(), "\n")
+	for _, line := range []string{
+		"# TYPE hopsfs_mount_fuse_requests_total counter",
+		`hopsfs_mount_fuse_requests_total{op="Lookup"} 2`,
+		`hopsfs_mount_fuse_errors_total{errno="ENOENT",op="Lookup"} 1`,
+		"# TYPE hopsfs_mount_fuse_request_duration_seconds histogram",
+		`hopsfs_mount_fuse_request_duration_seconds_count{op="Lookup"} 2`,
+		`hopsfs_mount_hdfs_errors_total{errno="ENOENT",method="Stat"} 1`,
+		`hopsfs_mount_cache_requests_total{cache="attrs",result="hit"} 1`,
+		"hopsfs_mount_open_handles 1",
+	} {
+		assert.Contains(t, lines, line)
+	}
+	assert.Equal(t, map[string]float64{"Lookup,ENOENT": 1}, metricValues(m.FuseErrors, "op", "errno"))
+}
+
+// Testing that HDFS RPCs are recorded
+func TestInstrumentedHdfsAccessor(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	instrumented := NewInstrumentedHdfsAccessor(hdfsAccessor)
+	count := histogramCount(metrics.HdfsLatency.WithLabelValues("Mkdir"))
+	errors := metricValue(metrics.HdfsErrors.WithLabelValues("Mkdir", "EEXIST"))
+
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", gomock.Any()).Return(nil)
+	assert.Nil(t, instrumented.Mkdir(nil, "/test/dir", 0755))
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", gomock.Any()).Return(syscall.EEXIST)
+	assert.Equal(t, syscall.EEXIST, instrumented.Mkdir(nil, "/test/dir", 0755))
+
+	assert.Equal(t, count+2, histogramCount(metrics.HdfsLatency.WithLabelValues("Mkdir")))
+	assert.Equal(t, errors+1, metricValue(metrics.HdfsErrors.WithLabelValues("Mkdir", "EEXIST")))
+}
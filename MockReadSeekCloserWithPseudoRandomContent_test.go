@@ -7,6 +7,8 @@ import (
 	"io"
 	"math/rand"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // This mock reader produces virtual 5G file with programmatically-generated pseudo-random content
@@ -33,7 +35,7 @@ func (mrs *MockReadSeekCloserWithPseudoRandomContent) Position() (int64, error)
 }
 
 // Reads chunk into the specified buffer
-func (mrs *MockReadSeekCloserWithPseudoRandomContent) Read(buf []byte) (int, error) {
+func (mrs *MockReadSeekCloserWithPseudoRandomContent) Read(ctx context.Context, buf []byte) (int, error) {
 	// Sleeping for 1ms to yield to other threads
 	time.Sleep(1 * time.Millisecond)
 	mrs.ReaderStats.IncrementRead()
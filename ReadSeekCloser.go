@@ -3,11 +3,24 @@
 // Licensed under the MIT license. See LICENSE file in the project root for details.
 package main
 
+import "golang.org/x/net/context"
+
 // Implements simple Read()/Seek()/Close() interface to read from a file or stream
 // Concurrency: not thread safe: at most on request at a time
 type ReadSeekCloser interface {
-	Seek(pos int64) error            // Seeks to a given position
-	Position() (int64, error)        // Returns current position
-	Read(buffer []byte) (int, error) // Read a chunk of data
-	Close() error                    // Closes the stream
+	Seek(pos int64) error                                 // Seeks to a given position
+	Position() (int64, error)                             // Returns current position
+	Read(ctx context.Context, buffer []byte) (int, error) // Read a chunk of data, fails with EINTR once ctx is cancelled
+	Close() error                                         // Closes the stream
+}
+
+// Adapts ReadSeekCloser to io.Reader, reading on behalf of the context
+type contextReader struct {
+	ctx    context.Context
+	reader ReadSeekCloser
+}
+
+// Reads a chunk of data
+func (r contextReader) Read(buffer []byte) (int, error) {
+	return r.reader.Read(r.ctx, buffer)
 }
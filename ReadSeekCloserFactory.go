@@ -3,7 +3,9 @@
 // Licensed under the MIT license. See LICENSE file in the project root for details.
 package main
 
+import "golang.org/x/net/context"
+
 // Interface to open a file for reading (create instance of ReadSeekCloser)
 type ReadSeekCloserFactory interface {
-	OpenRead() (ReadSeekCloser, error) // Opens a file to read with ReadSeekCloser interface
+	OpenRead(ctx context.Context) (ReadSeekCloser, error) // Opens a file to read with ReadSeekCloser interface
 }
@@ -5,6 +5,8 @@ package main
 import (
 	"errors"
 	"os"
+
+	"golang.org/x/net/context"
 )
 
 type RemoteROFileProxy struct {
@@ -28,7 +30,7 @@ func (p *RemoteROFileProxy) WriteAt(b []byte, off int64) (n int, err error) {
 	return 0, nil
 }
 
-func (p *RemoteROFileProxy) ReadAt(b []byte, off int64) (int, error) {
+func (p *RemoteROFileProxy) ReadAt(ctx context.Context, b []byte, off int64) (int, error) {
 	p.file.lockFileHandles()
 	defer p.file.unlockFileHandles()
 
@@ -43,7 +45,7 @@ func (p *RemoteROFileProxy) ReadAt(b []byte, off int64) (int, error) {
 	var err error = nil
 	var n int = 0
 	for len(b) > 0 {
-		m, e := p.hdfsReader.Read(b)
+		m, e := p.hdfsReader.Read(ctx, b)
 		if e != nil {
 			err = e
 			break
@@ -62,10 +64,10 @@ func (p *RemoteROFileProxy) SeekToStart() (err error) {
 	return p.hdfsReader.Seek(0)
 }
 
-func (p *RemoteROFileProxy) Read(b []byte) (n int, err error) {
+func (p *RemoteROFileProxy) Read(ctx context.Context, b []byte) (n int, err error) {
 	p.file.lockFileHandles()
 	defer p.file.unlockFileHandles()
-	return p.hdfsReader.Read(b)
+	return p.hdfsReader.Read(ctx, b)
 }
 
 func (p *RemoteROFileProxy) Close() error {
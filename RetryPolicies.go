@@ -0,0 +1,160 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Retry policies by class of operation: a Stat should fail fast while an
+// upload of a large file deserves patience
+type RetryPolicies struct {
+	MetadataRead     *RetryPolicy // Stat, ReadDir, StatFs, GetQuota and opening files for reading
+	MetadataMutation *RetryPolicy // Mkdir, Remove, Rename, Chmod, Chown, Truncate, SetTimes and snapshots
+	DataRead         *RetryPolicy // reads of the files opened for reading
+	Upload           *RetryPolicy // uploads of the staged files on flush and close
+}
+
+// Creates retry policies using the same policy for all classes of operations
+func NewRetryPolicies(retryPolicy *RetryPolicy) *RetryPolicies {
+	return &RetryPolicies{
+		MetadataRead:     retryPolicy,
+		MetadataMutation: retryPolicy,
+		DataRead:         retryPolicy,
+		Upload:           retryPolicy}
+}
+
+// Returns the distinct policies of all classes of operations
+func (rp *RetryPolicies) All() []*RetryPolicy {
+	var all []*RetryPolicy
+	for _, p := range []*RetryPolicy{rp.MetadataRead, rp.MetadataMutation, rp.DataRead, rp.Upload} {
+		found := false
+		for _, q := range all {
+			found = found || p == q
+		}
+		if !found {
+			all = append(all, p)
+		}
+	}
+	return all
+}
+
+// Configuration file of the mount
+type Config struct {
+	RetryPolicies RetryPoliciesConfig `json:"retryPolicies"`
+}
+
+// Retry policies of the configuration file by class of operation. Classes
+// without a section use the policy of the -retry* flags
+type RetryPoliciesConfig struct {
+	MetadataRead     *RetryPolicyConfig `json:"metadataRead"`
+	MetadataMutation *RetryPolicyConfig `json:"metadataMutation"`
+	DataRead         *RetryPolicyConfig `json:"dataRead"`
+	Upload           *RetryPolicyConfig `json:"upload"`
+}
+
+// Retry policy of the configuration file. Missing settings are taken from
+// the -retry* flags
+type RetryPolicyConfig struct {
+	MaxAttempts     *int            `json:"maxAttempts"`
+	TimeLimit       *ConfigDuration `json:"timeLimit"`
+	MinDelay        *ConfigDuration `json:"minDelay"`
+	MaxDelay        *ConfigDuration `json:"maxDelay"`
+	RandomizeDelays *bool           `json:"randomizeDelays"`
+	ExpBackoffBase  *float64        `json:"expBackoffBase"`
+}
+
+// Duration written as a string in the configuration file, e.g. "1m30s"
+type ConfigDuration time.Duration
+
+// Parses a duration string
+func (d *ConfigDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string like \"1m30s\"", b)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(duration)
+	return nil
+}
+
+// Reads the configuration file
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := &Config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Creates the retry policies of the configuration, based on the given default policy
+func (c *RetryPoliciesConfig) RetryPolicies(defaultPolicy *RetryPolicy) (*RetryPolicies, error) {
+	policies := &RetryPolicies{}
+	for _, class := range []struct {
+		name   string
+		config *RetryPolicyConfig
+		policy **RetryPolicy
+	}{
+		{"metadataRead", c.MetadataRead, &policies.MetadataRead},
+		{"metadataMutation", c.MetadataMutation, &policies.MetadataMutation},
+		{"dataRead", c.DataRead, &policies.DataRead},
+		{"upload", c.Upload, &policies.Upload},
+	} {
+		if class.config == nil {
+			*class.policy = defaultPolicy
+			continue
+		}
+		policy, err := class.config.RetryPolicy(defaultPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s retry policy: %v", class.name, err)
+		}
+		*class.policy = policy
+	}
+	return policies, nil
+}
+
+// Creates the retry policy of the configuration, based on the given default policy
+func (c *RetryPolicyConfig) RetryPolicy(defaultPolicy *RetryPolicy) (*RetryPolicy, error) {
+	policy := *defaultPolicy
+	if c.MaxAttempts != nil {
+		policy.MaxAttempts = *c.MaxAttempts
+	}
+	if c.TimeLimit != nil {
+		policy.TimeLimit = time.Duration(*c.TimeLimit)
+	}
+	if c.MinDelay != nil {
+		policy.MinDelay = time.Duration(*c.MinDelay)
+	}
+	if c.MaxDelay != nil {
+		policy.MaxDelay = time.Duration(*c.MaxDelay)
+	}
+	if c.RandomizeDelays != nil {
+		policy.RandomizeDelays = *c.RandomizeDelays
+	}
+	if c.ExpBackoffBase != nil {
+		policy.ExpBackoffBase = *c.ExpBackoffBase
+	}
+	if policy.MaxAttempts < 1 {
+		return nil, fmt.Errorf("maxAttempts must be at least 1")
+	}
+	if policy.TimeLimit < 0 || policy.MinDelay < 0 || policy.MaxDelay < policy.MinDelay {
+		return nil, fmt.Errorf("expected 0 <= minDelay <= maxDelay and a positive timeLimit")
+	}
+	if policy.ExpBackoffBase < 1 {
+		return nil, fmt.Errorf("expBackoffBase must be at least 1")
+	}
+	return &policy, nil
+}
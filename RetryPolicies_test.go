@@ -0,0 +1,71 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config*.json")
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	assert.Nil(t, err)
+	return f.Name()
+}
+
+// Testing the retry policies of the configuration file
+func TestLoadRetryPolicies(t *testing.T) {
+	path := writeConfig(t, `{
+  "retryPolicies": {
+    "metadataRead": {"maxAttempts": 2, "timeLimit": "10s", "maxDelay": "2s"},
+    "upload": {"maxAttempts": 30, "timeLimit": "1h", "randomizeDelays": false, "expBackoffBase": 2}
+  }
+}`)
+	defer os.Remove(path)
+	config, err := LoadConfig(path)
+	assert.Nil(t, err)
+	defaultPolicy := NewDefaultRetryPolicy(&MockClock{})
+	policies, err := config.RetryPolicies.RetryPolicies(defaultPolicy)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, policies.MetadataRead.MaxAttempts)
+	assert.Equal(t, 10*time.Second, policies.MetadataRead.TimeLimit)
+	assert.Equal(t, time.Second, policies.MetadataRead.MinDelay) // from the default policy
+	assert.Equal(t, 2*time.Second, policies.MetadataRead.MaxDelay)
+	assert.Equal(t, 30, policies.Upload.MaxAttempts)
+	assert.Equal(t, time.Hour, policies.Upload.TimeLimit)
+	assert.False(t, policies.Upload.RandomizeDelays)
+	assert.Equal(t, 2.0, policies.Upload.ExpBackoffBase)
+	assert.Equal(t, defaultPolicy, policies.MetadataMutation)
+	assert.Equal(t, defaultPolicy, policies.DataRead)
+	assert.Equal(t, 3, len(policies.All()))
+	assert.Equal(t, 10, defaultPolicy.MaxAttempts) // unchanged
+}
+
+// Testing that invalid configuration files are rejected
+func TestInvalidRetryPolicies(t *testing.T) {
+	for _, content := range []string{
+		`{"retryPolicies": {"metadataRead": {"timeLimit": 10}}}`,
+		`{"retryPolicies": {"metadataRead": {"timeLimit": "10 seconds"}}}`,
+		`{"retryPolicies": {"metadataWrite": {"maxAttempts": 3}}}`,
+	} {
+		path := writeConfig(t, content)
+		_, err := LoadConfig(path)
+		os.Remove(path)
+		assert.NotNil(t, err, content)
+	}
+
+	path := writeConfig(t, `{"retryPolicies": {"upload": {"maxAttempts": 0}}}`)
+	defer os.Remove(path)
+	config, err := LoadConfig(path)
+	assert.Nil(t, err)
+	_, err = config.RetryPolicies.RetryPolicies(NewDefaultRetryPolicy(&MockClock{}))
+	assert.NotNil(t, err)
+}
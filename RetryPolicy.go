@@ -6,7 +6,13 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"syscall"
 	"time"
+
+	"bazil.org/fuse"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
 )
 
 // Encapsulats policy and logic of handling retries
@@ -21,10 +27,13 @@ type RetryPolicy struct {
 }
 
 type Op struct {
-	RetryPolicy *RetryPolicy  // Pointed to the shared policy data structure
-	Attempt     int           // 1-based index of current attemmpt
-	Expires     time.Time     // point in time after which no retries are allowed
-	Delay       time.Duration // last delay (exponentially grows)
+	RetryPolicy *RetryPolicy    // Pointed to the shared policy data structure
+	Attempt     int             // 1-based index of current attemmpt
+	Expires     time.Time       // point in time after which no retries are allowed
+	Delay       time.Duration   // last delay (exponentially grows)
+	Span        trace.Span      // span of the operation, retries are recorded as its events
+	RequestID   fuse.RequestID  // FUSE request of the operation, logged with the retries
+	ctx         context.Context // no retries are done once the context is cancelled
 }
 
 // Creates trivial retry policy which disallows all retries
@@ -49,11 +58,14 @@ func NewDefaultRetryPolicy(clock Clock) *RetryPolicy {
 }
 
 // Starts a new operation (a retry context) and returns data structure to track operation retires
-func (retryPolicy *RetryPolicy) StartOperation() *Op {
+func (retryPolicy *RetryPolicy) StartOperation(ctx context.Context) *Op {
 	return &Op{
 		Attempt:     1,
 		RetryPolicy: retryPolicy,
-		Expires:     retryPolicy.Clock.Now().Add(retryPolicy.TimeLimit)}
+		Expires:     retryPolicy.Clock.Now().Add(retryPolicy.TimeLimit),
+		Span:        trace.SpanFromContext(ctx),
+		RequestID:   requestID(ctx),
+		ctx:         ctx}
 }
 
 // Prints diagnostic message (using Printf formatting semantic) and
@@ -62,13 +74,22 @@ func (retryPolicy *RetryPolicy) StartOperation() *Op {
 func (op *Op) ShouldRetry(message string, args ...interface{}) bool {
 	// Deciding whether to retry by # of attempts and time
 	diag := ""
+	if interrupted(op.ctx) != nil {
+		logdebug("Interrupted, not retrying", Fields{Operation: RetryingPolicy, Message: fmt.Sprintf(message, args...), Retries: op.Attempt, RequestID: op.RequestID})
+		return false
+	}
 	if op.Attempt >= op.RetryPolicy.MaxAttempts {
 		diag = "reached max # of attempts"
 	} else if op.RetryPolicy.Clock.Now().After(op.Expires) {
 		diag = "exceeded max configured time interval for retries"
 	}
 	if diag != "" {
-		logerror("Failed all retries.", Fields{Operation: RetryingPolicy, Message: fmt.Sprintf(message, args...), Retries: op.Attempt, Diag: diag})
+		logerror("Failed all retries.", Fields{Operation: RetryingPolicy, Message: fmt.Sprintf(message, args...), Retries: op.Attempt, Diag: diag, RequestID: op.RequestID})
+		metrics.RetriesFailed.Add(1)
+		op.Span.AddEvent("retries exhausted", trace.WithAttributes(
+			attribute.Int("attempt", op.Attempt),
+			attribute.String("diag", diag),
+			attribute.String("message", fmt.Sprintf(message, args...))))
 		return false
 	}
 	// Computing delay (exponential backoff)
@@ -87,12 +108,35 @@ func (op *Op) ShouldRetry(message string, args ...interface{}) bool {
 	}
 
 	// Logging information about failed attempt
-	logwarn("Failed try. Retrying", Fields{Operation: RetryingPolicy, Message: fmt.Sprintf(message, args...), Retries: op.Attempt, Delay: effectiveDelay})
+	logwarn("Failed try. Retrying", Fields{Operation: RetryingPolicy, Message: fmt.Sprintf(message, args...), Retries: op.Attempt, Delay: effectiveDelay, RequestID: op.RequestID})
+	op.Span.AddEvent("retry", trace.WithAttributes(
+		attribute.Int("attempt", op.Attempt),
+		attribute.String("delay", effectiveDelay.String()),
+		attribute.String("message", fmt.Sprintf(message, args...))))
 	op.Attempt++
+	metrics.Retries.Add(1)
 
-	// Sleeping
-	<-op.RetryPolicy.Clock.After(effectiveDelay)
+	// Sleeping, unless the FUSE request is interrupted
+	var done <-chan struct{}
+	if op.ctx != nil {
+		done = op.ctx.Done()
+	}
+	select {
+	case <-op.RetryPolicy.Clock.After(effectiveDelay):
+	case <-done:
+		logdebug("Interrupted, not retrying", Fields{Operation: RetryingPolicy, Message: fmt.Sprintf(message, args...), Retries: op.Attempt, RequestID: op.RequestID})
+		return false
+	}
 
 	// Allowing to retry
 	return true
 }
+
+// Returns the result of the operation once ShouldRetry returned false:
+// EINTR if the FUSE request was interrupted, otherwise the error of the last attempt
+func (op *Op) Error(err error) error {
+	if err != nil && interrupted(op.ctx) != nil {
+		return syscall.EINTR
+	}
+	return err
+}
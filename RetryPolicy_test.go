@@ -3,20 +3,23 @@
 package main
 
 import (
+	"io"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func TestNoRetryPolicy(t *testing.T) {
-	assert.False(t, NewNoRetryPolicy().StartOperation().ShouldRetry("TestDiagnostic"))
+	assert.False(t, NewNoRetryPolicy().StartOperation(nil).ShouldRetry("TestDiagnostic"))
 }
 
 func TestTreeAttempts(t *testing.T) {
 	rp := NewDefaultRetryPolicy(&MockClock{})
 	rp.MaxAttempts = 3
-	op := rp.StartOperation()
+	op := rp.StartOperation(nil)
 	assert.True(t, op.ShouldRetry("Attempt 1"))
 	assert.True(t, op.ShouldRetry("Attempt 2"))
 	assert.False(t, op.ShouldRetry("Attempt 3"))
@@ -27,7 +30,7 @@ func TestTreeMinutesLimit(t *testing.T) {
 	rp := NewDefaultRetryPolicy(clock)
 	rp.MaxAttempts = 9999999
 	rp.TimeLimit = 3 * time.Minute
-	op := rp.StartOperation()
+	op := rp.StartOperation(nil)
 	assert.True(t, op.ShouldRetry("Attempt 1"))
 	clock.NotifyTimeElapsed(time.Minute)
 	assert.True(t, op.ShouldRetry("Attempt 2"))
@@ -45,7 +48,7 @@ func TestExponentialBackoff(t *testing.T) {
 	rp.MaxDelay = time.Minute
 	rp.TimeLimit = time.Hour
 	rp.RandomizeDelays = false
-	op := rp.StartOperation()
+	op := rp.StartOperation(nil)
 	assert.True(t, op.ShouldRetry("Attempt 1"))
 	assert.Equal(t, time.Duration(0), clock.LastSleepDuration) // first retry is immediate
 	assert.True(t, op.ShouldRetry("Attempt 2"))
@@ -61,3 +64,14 @@ func TestExponentialBackoff(t *testing.T) {
 	}
 	assert.Equal(t, time.Minute, clock.LastSleepDuration) // MaxDelay
 }
+
+func TestInterruptedOperation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	op := NewDefaultRetryPolicy(&MockClock{}).StartOperation(ctx)
+	assert.True(t, op.ShouldRetry("Attempt 1"))
+	assert.Equal(t, io.EOF, op.Error(io.EOF))
+	cancel()
+	assert.False(t, op.ShouldRetry("Attempt 2"))
+	assert.Equal(t, syscall.EINTR, op.Error(io.EOF))
+	assert.Nil(t, op.Error(nil))
+}
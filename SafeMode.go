@@ -0,0 +1,101 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Tracks the safe mode of the namenode. Once a mutation is rejected because
+// the namenode is in safe mode, the mount becomes temporarily read-only:
+// mutations fail with EROFS without contacting the namenode, and the namenode
+// is probed periodically until it leaves safe mode.
+// Concurrency: thread safe
+type SafeMode struct {
+	Accessor     HdfsAccessor  // accessor used for probing, must not be guarded by the safe mode
+	Path         string        // directory holding the non-existent file renamed by the probe
+	Clock        Clock         // interface to clock
+	PollInterval time.Duration // interval between probes while in safe mode
+	active       bool          // true while the namenode is in safe mode
+	since        time.Time     // time the safe mode was detected
+	mutex        sync.Mutex
+}
+
+// Creates an instance of SafeMode
+func NewSafeMode(accessor HdfsAccessor, path string, clock Clock, pollInterval time.Duration) *SafeMode {
+	return &SafeMode{Accessor: accessor, Path: path, Clock: clock, PollInterval: pollInterval}
+}
+
+// Returns true and the time the safe mode was detected if the namenode is in safe mode
+func (s *SafeMode) Active() (bool, time.Time) {
+	if s == nil {
+		return false, time.Time{}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.active, s.since
+}
+
+// Returns EROFS while the namenode is in safe mode
+func (s *SafeMode) Check() error {
+	if active, _ := s.Active(); active {
+		return errSafeMode
+	}
+	return nil
+}
+
+// Records the result of a mutation. Other EROFS errors, e.g. writes into
+// snapshots, do not mean that the namenode is in safe mode
+func (s *SafeMode) Observe(err error) {
+	if s == nil || err != errSafeMode {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active {
+		return
+	}
+	s.active = true
+	s.since = s.Clock.Now()
+	logwarn("Namenode is in safe mode, the mount is read-only until it leaves safe mode", Fields{Operation: NamenodeSafeMode})
+}
+
+// Probes the namenode while it is in safe mode. Never returns
+func (s *SafeMode) Run() {
+	for {
+		<-s.Clock.After(s.PollInterval)
+		if active, _ := s.Active(); active {
+			s.Poll()
+		}
+	}
+}
+
+// Name of the file renamed by the probe, it is not expected to exist
+const safeModeProbeName = ".hopsfs-mount-safemode-probe"
+
+// Probes the namenode once and returns true if it has left safe mode. The
+// probe renames a non-existent file in Path to itself, which leaves the
+// namespace unchanged: the namenode checks for safe mode before validating
+// the rename, and then fails it with ENOENT. Path itself can not be renamed,
+// the namenode refuses to rename the root with a generic IOException
+func (s *SafeMode) Poll() bool {
+	probe := path.Join(s.Path, safeModeProbeName)
+	err := s.Accessor.Rename(context.Background(), probe, probe)
+	if err == errSafeMode || !IsSuccessOrNonRetriableError(err) {
+		logdebug("Namenode is still in safe mode", Fields{Operation: NamenodeSafeMode, Error: err})
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active {
+		s.active = false
+		loginfo(fmt.Sprintf("Namenode left safe mode after %v", s.Clock.Now().Sub(s.since)), Fields{Operation: NamenodeSafeMode})
+	}
+	return true
+}
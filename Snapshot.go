@@ -0,0 +1,85 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// Name of the virtual directory exposing the snapshots of a snapshottable directory.
+// The directory is not listed by ReadDirAll, but it can be looked up. Snapshots are
+// created and deleted using mkdir/rmdir inside the directory, the content of the
+// snapshots is read-only
+const SnapshotDirName = ".snapshot"
+
+// Returns true if the path points to a .snapshot directory or inside it
+func IsSnapshotPath(p string) bool {
+	return strings.Contains(p+"/", "/"+SnapshotDirName+"/")
+}
+
+// Returns true if this is the virtual .snapshot directory of a snapshottable directory
+func (dir *DirINode) isSnapshotDir() bool {
+	return dir.Parent != nil && dir.Attrs.Name == SnapshotDirName
+}
+
+// Returns true if this directory is the .snapshot directory or is inside a snapshot
+func (dir *DirINode) isInSnapshot() bool {
+	return IsSnapshotPath(dir.AbsolutePath())
+}
+
+// Adjusts the attributes of an entry of this directory returned by HDFS.
+// The .snapshot directory gets the permissions of the snapshottable directory
+// (HDFS checks if the user is allowed to create/delete snapshots), and
+// the content of the snapshots is read-only
+func (dir *DirINode) adjustSnapshotAttrs(attrs *Attrs) {
+	if attrs.Name == SnapshotDirName && !dir.isInSnapshot() {
+		attrs.Mode = dir.Attrs.Mode | os.ModeDir
+		attrs.Uid = dir.Attrs.Uid
+		attrs.Gid = dir.Attrs.Gid
+	} else if dir.isInSnapshot() {
+		attrs.Mode &^= 0222
+	}
+}
+
+// Creates a snapshot of the parent directory of this .snapshot directory
+func (dir *DirINode) createSnapshot(ctx context.Context, name string) (fs.Node, error) {
+	snapshottableDir := dir.Parent.AbsolutePath()
+	loginfo("Creating snapshot", Fields{Operation: CreateSnapshot, Path: snapshottableDir, Snapshot: name, RequestID: requestID(ctx)})
+	if err := dir.FileSystem.getDFSConnector().CreateSnapshot(ctx, snapshottableDir, name); err != nil {
+		logwarn("Failed to create snapshot", Fields{Operation: CreateSnapshot, Path: snapshottableDir, Snapshot: name, Error: err, RequestID: requestID(ctx)})
+		return nil, err
+	}
+
+	var attrs Attrs
+	if err := dir.LookupAttrs(ctx, name, &attrs); err != nil {
+		return nil, err
+	}
+	return dir.NodeFromAttrs(attrs), nil
+}
+
+// Deletes a snapshot of the parent directory of this .snapshot directory
+func (dir *DirINode) deleteSnapshot(ctx context.Context, name string) error {
+	snapshottableDir := dir.Parent.AbsolutePath()
+	loginfo("Deleting snapshot", Fields{Operation: DeleteSnapshot, Path: snapshottableDir, Snapshot: name, RequestID: requestID(ctx)})
+	if err := dir.FileSystem.getDFSConnector().DeleteSnapshot(ctx, snapshottableDir, name); err != nil {
+		logwarn("Failed to delete snapshot", Fields{Operation: DeleteSnapshot, Path: snapshottableDir, Snapshot: name, Error: err, RequestID: requestID(ctx)})
+		return err
+	}
+	dir.EntriesRemove(name)
+	return nil
+}
+
+// Returns EROFS if the path points inside a snapshot
+func checkNotInSnapshot(p string, operation string) error {
+	if IsSnapshotPath(path.Clean(p)) {
+		logdebug("Snapshots are read-only", Fields{Operation: operation, Path: p})
+		return syscall.EROFS
+	}
+	return nil
+}
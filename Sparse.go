@@ -0,0 +1,98 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Zero filled chunks of the staging file are not written, they are left as holes
+const sparseChunkSize = 64 * 1024
+
+// whence of lseek(2) seeking to the next data region, not defined by x/sys/unix
+const seekData = 3
+
+// Reads the next chunk of a sparse file at the current offset. Holes are
+// returned as zeroes without reading them from disk. Falls back to a normal
+// read if the local file system does not support SEEK_DATA
+func readSparse(f *os.File, b []byte) (int, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	data, err := unix.Seek(int(f.Fd()), pos, seekData)
+	if err == unix.ENXIO {
+		// no data after the offset, the rest of the file is a hole
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		data = fi.Size()
+	} else if err != nil {
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return f.Read(b)
+	}
+
+	if data <= pos {
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return f.Read(b)
+	}
+
+	n := len(b)
+	if int64(n) > data-pos {
+		n = int(data - pos)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	for i := range b[:n] {
+		b[i] = 0
+	}
+	if _, err := f.Seek(pos+int64(n), io.SeekStart); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Copies the reader to the staging file, zero filled chunks are skipped
+// so that they become holes in the staging file
+func copySparse(dst *os.File, src io.Reader) (int64, error) {
+	b := make([]byte, sparseChunkSize)
+	var written int64
+	for {
+		nr, err := io.ReadFull(src, b)
+		if nr > 0 {
+			if isZero(b[:nr]) {
+				if _, err := dst.Seek(int64(nr), io.SeekCurrent); err != nil {
+					return written, err
+				}
+			} else if _, err := dst.Write(b[:nr]); err != nil {
+				return written, err
+			}
+			written += int64(nr)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return written, err
+		}
+	}
+	// trailing holes are not allocated by the seeks
+	return written, dst.Truncate(written)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Testing that zero filled chunks are staged as holes and read back as zeroes
+func TestSparseStaging(t *testing.T) {
+	content := make([]byte, 4*sparseChunkSize+100)
+	copy(content, []byte("head"))
+	copy(content[3*sparseChunkSize:], []byte("tail"))
+
+	stagingFile, err := ioutil.TempFile(stagingDir, "sparse")
+	assert.Nil(t, err)
+	defer os.Remove(stagingFile.Name())
+	defer stagingFile.Close()
+
+	n, err := copySparse(stagingFile, bytes.NewReader(content))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), n)
+
+	_, err = stagingFile.Seek(0, io.SeekStart)
+	assert.Nil(t, err)
+	var read []byte
+	b := make([]byte, 10000)
+	for {
+		n, err := readSparse(stagingFile, b)
+		read = append(read, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, content, read)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Watches the TLS material (root CA bundle, client certificate and key) on disk.
+// Every time any of the files changes the generation number is incremented,
+// HdfsAccessors compare it with the generation they connected with and
+// rebuild their connections when the material has been rotated.
+// Concurrency: thread safe
+type TLSCertWatcher struct {
+	Clock         Clock         // interface to get wall clock time
+	TLSConfig     TLSConfig     // files to watch
+	CheckInterval time.Duration // how often the files are checked for changes
+	ExpiryWarning time.Duration // warn when the client certificate expires within this interval
+
+	generation        uint64               // incremented on every change of the TLS material
+	modTimes          map[string]time.Time // last seen modification times of the watched files
+	lastExpiryWarning time.Time            // last time the expiry warning was logged
+	mutex             sync.Mutex           // serializes checks
+}
+
+// Creates an instance of TLSCertWatcher and records the current state of the watched files
+func NewTLSCertWatcher(tlsConfig TLSConfig, clock Clock, checkInterval time.Duration, expiryWarning time.Duration) *TLSCertWatcher {
+	w := &TLSCertWatcher{
+		Clock:         clock,
+		TLSConfig:     tlsConfig,
+		CheckInterval: checkInterval,
+		ExpiryWarning: expiryWarning,
+		modTimes:      make(map[string]time.Time),
+	}
+	for _, f := range w.files() {
+		w.modTimes[f] = modTime(f)
+	}
+	w.checkExpiry(true)
+	return w
+}
+
+// Returns the current generation of the TLS material
+func (w *TLSCertWatcher) Generation() uint64 {
+	if w == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&w.generation)
+}
+
+// Periodically checks the TLS material for changes. Never returns
+func (w *TLSCertWatcher) Run() {
+	for {
+		<-w.Clock.After(w.CheckInterval)
+		w.Check()
+	}
+}
+
+// Checks the watched files once. Returns true if the TLS material has changed
+func (w *TLSCertWatcher) Check() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	changed := false
+	for _, f := range w.files() {
+		mtime := modTime(f)
+		if !mtime.Equal(w.modTimes[f]) {
+			loginfo("TLS file has changed", Fields{Operation: TLSReload, Path: f})
+			w.modTimes[f] = mtime
+			changed = true
+		}
+	}
+
+	if changed {
+		// the files are usually replaced one by one, make sure that the
+		// new certificate is readable before asking for reconnection
+		if _, err := w.clientCertificate(); err != nil {
+			logwarn("New client certificate is not readable yet", Fields{Operation: TLSReload, Path: w.TLSConfig.ClientCertificate, Error: err})
+			w.modTimes[w.TLSConfig.ClientCertificate] = time.Time{}
+			return false
+		}
+		gen := atomic.AddUint64(&w.generation, 1)
+		loginfo(fmt.Sprintf("TLS material reloaded. Generation: %d", gen), Fields{Operation: TLSReload})
+	}
+	w.checkExpiry(changed)
+	return changed
+}
+
+// Logs the expiry date of the client certificate. If the certificate is about
+// to expire then a warning is logged (at most once per hour or on change)
+func (w *TLSCertWatcher) checkExpiry(force bool) {
+	cert, err := w.clientCertificate()
+	if err != nil {
+		logerror("Unable to read client certificate", Fields{Operation: TLSReload, Path: w.TLSConfig.ClientCertificate, Error: err})
+		return
+	}
+
+	now := w.Clock.Now()
+	remaining := cert.NotAfter.Sub(now)
+	fields := Fields{Operation: TLSReload, Path: w.TLSConfig.ClientCertificate, Expires: cert.NotAfter}
+	if remaining <= 0 {
+		logerror("Client certificate has expired", fields)
+	} else if remaining < w.ExpiryWarning {
+		if force || now.Sub(w.lastExpiryWarning) >= time.Hour {
+			logwarn(fmt.Sprintf("Client certificate expires in %v", remaining.Round(time.Minute)), fields)
+			w.lastExpiryWarning = now
+		}
+	} else if force {
+		loginfo("Client certificate loaded", fields)
+	}
+}
+
+// Parses the first certificate in the client certificate bundle
+func (w *TLSCertWatcher) clientCertificate() (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(w.TLSConfig.ClientCertificate)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func (w *TLSCertWatcher) files() []string {
+	return []string{w.TLSConfig.RootCABundle, w.TLSConfig.ClientCertificate, w.TLSConfig.ClientKey}
+}
+
+// Returns modification time of the file or zero time if the file is not accessible
+func modTime(file string) time.Time {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSCertWatcherDetectsRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlswatcher")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tlsConfig := TLSConfig{
+		TLS:               true,
+		RootCABundle:      filepath.Join(dir, "ca.pem"),
+		ClientCertificate: filepath.Join(dir, "cert.pem"),
+		ClientKey:         filepath.Join(dir, "key.pem"),
+	}
+	writeTestCertificate(t, tlsConfig.ClientCertificate, time.Now().Add(time.Hour))
+	assert.Nil(t, ioutil.WriteFile(tlsConfig.RootCABundle, []byte("ca"), 0600))
+	assert.Nil(t, ioutil.WriteFile(tlsConfig.ClientKey, []byte("key"), 0600))
+
+	clock := &MockClock{}
+	watcher := NewTLSCertWatcher(tlsConfig, clock, time.Minute, 24*time.Hour)
+	assert.Equal(t, uint64(0), watcher.Generation())
+
+	// nothing has changed
+	assert.False(t, watcher.Check())
+	assert.Equal(t, uint64(0), watcher.Generation())
+
+	// rotating the certificate
+	writeTestCertificate(t, tlsConfig.ClientCertificate, time.Now().Add(48*time.Hour))
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(tlsConfig.ClientCertificate, future, future))
+	assert.True(t, watcher.Check())
+	assert.Equal(t, uint64(1), watcher.Generation())
+
+	// unreadable certificate must not trigger reconnection
+	assert.Nil(t, ioutil.WriteFile(tlsConfig.ClientCertificate, []byte("garbage"), 0600))
+	future = future.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(tlsConfig.ClientCertificate, future, future))
+	assert.False(t, watcher.Check())
+	assert.Equal(t, uint64(1), watcher.Generation())
+}
+
+func TestTLSCertWatcherNil(t *testing.T) {
+	var watcher *TLSCertWatcher
+	assert.Equal(t, uint64(0), watcher.Generation())
+}
+
+// writes a self-signed PEM certificate valid until notAfter
+func writeTestCertificate(t *testing.T, file string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hopsfs-mount-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.Nil(t, ioutil.WriteFile(file, data, 0600))
+}
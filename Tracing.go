@@ -0,0 +1,88 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// Tracer provider of the mount, nil if tracing is disabled
+var tracer *sdktrace.TracerProvider
+
+// Creates a tracer provider exporting the spans in batches to the exporters
+func NewTracer(exporters ...sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	hostname, _ := os.Hostname()
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String("hopsfs-mount"),
+		semconv.ServiceVersionKey.String(VERSION),
+		semconv.HostNameKey.String(hostname)))}
+	for _, exporter := range exporters {
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	return sdktrace.NewTracerProvider(options...)
+}
+
+// Starts a span as a child of the span of the context, or a new trace if the
+// context has no span. Returns the context of the new span. If tracing is
+// disabled the context is returned unchanged with a span recording nothing
+func StartSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if tracer == nil {
+		return ctx, trace.SpanFromContext(nil)
+	}
+	return tracer.Tracer("hopsfs-mount", trace.WithInstrumentationVersion(VERSION)).Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// Ends the span, err is the result of the operation
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Creates an exporter appending the spans to a file, one JSON object per
+// span and line
+func NewFileSpanExporter(path string) (*stdouttrace.Exporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return stdouttrace.New(stdouttrace.WithWriter(f))
+}
+
+// Creates an exporter sending the spans to an OTLP/HTTP endpoint, e.g. an
+// OpenTelemetry collector. The default path /v1/traces is used if the
+// endpoint has no path
+func NewOTLPSpanExporter(endpoint string) (*otlptrace.Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported OTLP endpoint %q, expected http(s)://host:port", endpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(context.Background(), options...)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// Testing that the HDFS calls of a FUSE request are traced as its children,
+// with the retries as events
+func TestTracingFuseRequest(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer func() { tracer = nil }()
+
+	mockCtrl := gomock.NewController(t)
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	ftHdfsAccessor := NewFaultTolerantHdfsAccessor(NewInstrumentedHdfsAccessor(hdfsAccessor), atMost2Attempts())
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", os.FileMode(0755)).Return(errors.New("Injected failure"))
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/test/dir", os.FileMode(0755)).Return(nil)
+	hdfsAccessor.EXPECT().Close().Return(nil)
+
+	req := &fuse.MkdirRequest{Header: fuse.Header{ID: 7, Uid: 1000}, Name: "dir", Mode: 0755}
+	ctx, done := observeFuse(withFuseRequest(context.Background(), req), "Mkdir")
+	assert.Nil(t, ftHdfsAccessor.Mkdir(ctx, "/test/dir", 0755))
+	done(nil)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+	var request sdktrace.ReadOnlySpan
+	var calls []sdktrace.ReadOnlySpan
+	for _, s := range spans {
+		if s.Name() == "fuse.Mkdir" {
+			request = s
+		} else {
+			calls = append(calls, s)
+		}
+	}
+	assert.NotNil(t, request)
+	assert.Equal(t, trace.SpanKindServer, request.SpanKind())
+	assert.Contains(t, request.Attributes(), attribute.Int64("fuse.uid", 1000))
+	assert.Equal(t, 1, len(request.Events()))
+	assert.Equal(t, "retry", request.Events()[0].Name)
+	for _, call := range calls {
+		assert.Equal(t, "hdfs.Mkdir", call.Name())
+		assert.Equal(t, trace.SpanKindClient, call.SpanKind())
+		assert.Equal(t, request.SpanContext().TraceID(), call.SpanContext().TraceID())
+		assert.Equal(t, request.SpanContext().SpanID(), call.Parent().SpanID())
+		assert.Contains(t, call.Attributes(), attribute.String("hdfs.path", "/test/dir"))
+	}
+	assert.Equal(t, codes.Error, calls[0].Status().Code)
+	assert.Equal(t, "Injected failure", calls[0].Status().Description)
+	assert.Equal(t, codes.Unset, calls[1].Status().Code)
+}
+
+// Testing the spans written by the file exporter
+func TestFileSpanExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	exporter, err := NewFileSpanExporter(dir + "/traces.json")
+	assert.Nil(t, err)
+
+	tracer = NewTracer(exporter)
+	defer func() { tracer = nil }()
+	ctx, parent := StartSpan(nil, "parent", trace.SpanKindInternal)
+	_, child := StartSpan(ctx, "child", trace.SpanKindClient)
+	child.SetAttributes(attribute.Int64("bytes", 42))
+	EndSpan(child, errors.New("failed"))
+	EndSpan(parent, nil)
+	assert.Nil(t, tracer.Shutdown(context.Background()))
+
+	f, err := os.Open(dir + "/traces.json")
+	assert.Nil(t, err)
+	defer f.Close()
+	type spanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	type exportedSpan struct {
+		Name        string
+		SpanContext spanContext
+		Parent      spanContext
+		Attributes  []struct {
+			Key   string
+			Value struct{ Value interface{} }
+		}
+		Status struct {
+			Code        string
+			Description string
+		}
+	}
+	var spans []exportedSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span exportedSpan
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &span))
+		spans = append(spans, span)
+	}
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, spans[1].SpanContext.TraceID, spans[0].SpanContext.TraceID)
+	assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].Parent.SpanID)
+	assert.Equal(t, "0000000000000000", spans[1].Parent.SpanID)
+	assert.Equal(t, "Error", spans[0].Status.Code)
+	assert.Equal(t, "failed", spans[0].Status.Description)
+	assert.Equal(t, "bytes", spans[0].Attributes[0].Key)
+	assert.Equal(t, float64(42), spans[0].Attributes[0].Value.Value)
+}
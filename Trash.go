@@ -0,0 +1,112 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Environment variable of the calling process which bypasses the trash, like `hdfs dfs -rm -skipTrash`
+const SkipTrashEnv = "HOPSFS_SKIP_TRASH"
+
+// Returns HDFS trash directory of the user the mount is acting as
+func trashRoot() string {
+	return path.Join("/user", hadoopUserName, ".Trash")
+}
+
+// Returns true if removal of the given path should be translated into a move to the trash
+func (filesystem *FileSystem) shouldMoveToTrash(absPath string, pid uint32) bool {
+	if len(filesystem.TrashPrefixes) == 0 || !hasPathPrefix(absPath, filesystem.TrashPrefixes) {
+		return false
+	}
+	root := trashRoot()
+	if absPath == root || strings.HasPrefix(absPath, root+"/") {
+		// removing files from the trash deletes them permanently
+		return false
+	}
+	if skipTrashRequested(pid) {
+		logdebug("Trash is bypassed by the calling process", Fields{Operation: Remove, Path: absPath, Pid: pid})
+		return false
+	}
+	return true
+}
+
+// Moves a file or directory to the trash, using the standard HDFS checkpoint layout,
+// i.e. /a/b/c is moved to /user/<user>/.Trash/Current/a/b/c
+// If rmdir is set, the directory must be empty
+func (filesystem *FileSystem) moveToTrash(ctx context.Context, absPath string, rmdir bool) error {
+	hdfsAccessor := filesystem.getDFSConnector()
+	if rmdir {
+		entries, err := hdfsAccessor.ReadDir(ctx, absPath)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	current := path.Join(trashRoot(), "Current")
+	target := path.Join(current, absPath)
+
+	if err := mkdirAll(ctx, hdfsAccessor, path.Dir(target)); err != nil {
+		logwarn("Failed to create trash directory", Fields{Operation: Remove, Path: path.Dir(target), Error: err, RequestID: requestID(ctx)})
+		return err
+	}
+
+	if _, err := hdfsAccessor.Stat(ctx, target); err == nil {
+		if rmdir {
+			// rmdir succeeds only on empty directories, their content has already
+			// been moved to the trash under the same name
+			return hdfsAccessor.Remove(ctx, absPath)
+		}
+		// same as in HDFS, the name gets a timestamp suffix if the target already exists
+		target = fmt.Sprintf("%s%d", target, filesystem.Clock.Now().UnixNano()/1000000)
+	} else if err != syscall.ENOENT {
+		return err
+	}
+
+	loginfo("Moving to trash "+target, Fields{Operation: Remove, Path: absPath, RequestID: requestID(ctx)})
+	return hdfsAccessor.Rename(ctx, absPath, target)
+}
+
+// Creates a directory and all its missing parents
+func mkdirAll(ctx context.Context, hdfsAccessor HdfsAccessor, dir string) error {
+	if _, err := hdfsAccessor.Stat(ctx, dir); err == nil {
+		return nil
+	}
+	if dir != "/" {
+		if err := mkdirAll(ctx, hdfsAccessor, path.Dir(dir)); err != nil {
+			return err
+		}
+	}
+	err := hdfsAccessor.Mkdir(ctx, dir, 0700)
+	if err != nil && err != syscall.EEXIST && err != fuse.EEXIST {
+		return err
+	}
+	return nil
+}
+
+// Returns true if the process has SkipTrashEnv set in its environment
+func skipTrashRequested(pid uint32) bool {
+	if pid == 0 {
+		return false
+	}
+	environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return false
+	}
+	for _, v := range bytes.Split(environ, []byte{0}) {
+		if string(v) == SkipTrashEnv+"=1" || string(v) == SkipTrashEnv+"=true" {
+			return true
+		}
+	}
+	return false
+}
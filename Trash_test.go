@@ -0,0 +1,79 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Testing that removals under trash prefixes are moved to the trash
+func TestRemoveMovesToTrash(t *testing.T) {
+	hadoopUserName = "alice"
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{now: time.Unix(1600000000, 0)}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	fs.TrashPrefixes = []string{"Projects"}
+	root, _ := fs.Root()
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/Projects").Return(Attrs{Name: "Projects", Mode: os.ModeDir | 0755}, nil)
+	projects, err := root.(*DirINode).Lookup(nil, "Projects")
+	assert.Nil(t, err)
+
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/user/alice/.Trash/Current/Projects").Return(Attrs{}, syscall.ENOENT)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/user/alice/.Trash/Current").Return(Attrs{}, syscall.ENOENT)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/user/alice/.Trash").Return(Attrs{Name: ".Trash", Mode: os.ModeDir | 0700}, nil)
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/user/alice/.Trash/Current", os.FileMode(0700)).Return(nil)
+	hdfsAccessor.EXPECT().Mkdir(gomock.Any(), "/user/alice/.Trash/Current/Projects", os.FileMode(0700)).Return(nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/user/alice/.Trash/Current/Projects/file").Return(Attrs{}, syscall.ENOENT)
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/Projects/file", "/user/alice/.Trash/Current/Projects/file").Return(nil)
+	err = projects.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "file"})
+	assert.Nil(t, err)
+
+	// the name gets a timestamp suffix if it is already in the trash
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/user/alice/.Trash/Current/Projects").Return(Attrs{Name: "Projects", Mode: os.ModeDir | 0700}, nil)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/user/alice/.Trash/Current/Projects/file").Return(Attrs{Name: "file"}, nil)
+	hdfsAccessor.EXPECT().Rename(gomock.Any(), "/Projects/file", "/user/alice/.Trash/Current/Projects/file1600000000000").Return(nil)
+	err = projects.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "file"})
+	assert.Nil(t, err)
+}
+
+// Testing that rmdir of a non-empty directory under a trash prefix fails
+// instead of moving the whole subtree to the trash
+func TestRmdirNotEmptyInTrashPrefixes(t *testing.T) {
+	hadoopUserName = "alice"
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	fs.TrashPrefixes = []string{"*"}
+	root, _ := fs.Root()
+
+	hdfsAccessor.EXPECT().ReadDir(gomock.Any(), "/dir").Return([]Attrs{{Name: "file"}}, nil)
+	err := root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "dir", Dir: true})
+	assert.Equal(t, syscall.ENOTEMPTY, err)
+}
+
+// Testing that removals outside of the trash prefixes are permanent
+func TestRemoveOutsideTrashPrefixes(t *testing.T) {
+	hadoopUserName = "alice"
+	mockCtrl := gomock.NewController(t)
+	mockClock := &MockClock{}
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	fs, _ := NewFileSystem([]HdfsAccessor{hdfsAccessor}, "/", []string{"*"}, false, NewDefaultRetryPolicy(mockClock), mockClock)
+	fs.TrashPrefixes = []string{"Projects"}
+	root, _ := fs.Root()
+
+	hdfsAccessor.EXPECT().Remove(gomock.Any(), "/tmp").Return(nil)
+	err := root.(*DirINode).Remove(nil, &fuse.RemoveRequest{Name: "tmp"})
+	assert.Nil(t, err)
+
+	assert.False(t, fs.shouldMoveToTrash("/user/alice/.Trash/Current/Projects/file", 0))
+	assert.True(t, fs.shouldMoveToTrash("/Projects/file", 0))
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Watchdog of the in-flight operations, nil if disabled
+var watchdog *Watchdog
+
+// Kinds of the operations tracked by the watchdog
+const (
+	WatchdogFuse = "fuse"
+	WatchdogHdfs = "hdfs"
+)
+
+// Operation in progress, a FUSE request or an HDFS RPC
+type InFlightOp struct {
+	Kind      string         // fuse or hdfs
+	Name      string         // FUSE operation or HDFS method
+	Details   string         // FUSE request or HDFS path
+	RequestID fuse.RequestID `json:",omitempty"` // FUSE request of the operation
+	Start     time.Time
+	Duration  string // time spent so far, when reported as slow
+	warned    bool   // the operation was logged as slow
+}
+
+// Tracks the in-flight FUSE requests and HDFS RPCs, and logs the operations
+// taking longer than the threshold with the stacks of all goroutines, e.g.
+// while the namenode hangs
+// Concurrency: thread safe
+type Watchdog struct {
+	Threshold time.Duration
+	Clock     Clock
+	ops       map[uint64]*InFlightOp
+	nextID    uint64
+	mutex     sync.Mutex
+	done      chan struct{}
+}
+
+// Creates a watchdog of the operations exceeding the threshold
+func NewWatchdog(threshold time.Duration, clock Clock) *Watchdog {
+	return &Watchdog{
+		Threshold: threshold,
+		Clock:     clock,
+		ops:       make(map[uint64]*InFlightOp),
+		done:      make(chan struct{})}
+}
+
+// Checks the in-flight operations until the watchdog is closed
+func (w *Watchdog) Run() {
+	interval := w.Threshold / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Check()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Stops checking the in-flight operations
+func (w *Watchdog) Close() {
+	close(w.done)
+}
+
+// Starts tracking an operation. The returned function ends it. Does nothing if the watchdog is disabled
+func (w *Watchdog) Start(ctx context.Context, kind string, name string, details string) func() {
+	if w == nil {
+		return func() {}
+	}
+	id := w.start(&InFlightOp{Kind: kind, Name: name, Details: details, RequestID: requestID(ctx)})
+	return func() { w.end(id) }
+}
+
+func (w *Watchdog) start(op *InFlightOp) uint64 {
+	op.Start = w.Clock.Now()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.nextID++
+	w.ops[w.nextID] = op
+	return w.nextID
+}
+
+func (w *Watchdog) end(id uint64) {
+	w.mutex.Lock()
+	op := w.ops[id]
+	delete(w.ops, id)
+	w.mutex.Unlock()
+	if op != nil && op.warned {
+		loginfo("Slow operation completed", Fields{Operation: op.Kind + "." + op.Name, Message: op.Details,
+			Delay: w.Clock.Now().Sub(op.Start), RequestID: op.RequestID})
+	}
+}
+
+// Logs each operation which exceeded the threshold since the last check,
+// followed by the stacks of all goroutines. Slow operations are logged as
+// errors, so that they are reported with the default log level
+func (w *Watchdog) Check() {
+	now := w.Clock.Now()
+	var slow []InFlightOp
+	w.mutex.Lock()
+	for _, op := range w.ops {
+		if !op.warned && now.Sub(op.Start) > w.Threshold {
+			op.warned = true
+			slow = append(slow, *op)
+		}
+	}
+	w.mutex.Unlock()
+	if len(slow) == 0 {
+		return
+	}
+
+	for _, op := range slow {
+		logerror("Slow operation in progress", Fields{Operation: op.Kind + "." + op.Name, Message: op.Details,
+			Delay: now.Sub(op.Start), RequestID: op.RequestID})
+	}
+	logerror("Stacks of the goroutines while operations are slow", Fields{Stack: goroutineStacks()})
+}
+
+// Returns the in-flight operations exceeding the threshold, oldest first
+func (w *Watchdog) SlowOperations() []InFlightOp {
+	if w == nil {
+		return nil
+	}
+	now := w.Clock.Now()
+	var slow []InFlightOp
+	w.mutex.Lock()
+	for _, op := range w.ops {
+		if now.Sub(op.Start) > w.Threshold {
+			slow = append(slow, *op)
+		}
+	}
+	w.mutex.Unlock()
+	sort.Slice(slow, func(i, j int) bool { return slow[i].Start.Before(slow[j].Start) })
+	for i := range slow {
+		slow[i].Duration = now.Sub(slow[i].Start).String()
+	}
+	return slow
+}
+
+// Returns the stack traces of all goroutines
+func goroutineStacks() string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 64<<20 {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Hopsworks AB. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for details.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// Testing that HDFS RPCs exceeding the threshold are reported as slow
+// operations of their FUSE request
+func TestWatchdogSlowHdfsCall(t *testing.T) {
+	mockClock := &MockClock{}
+	watchdog = NewWatchdog(30*time.Second, mockClock)
+	defer func() { watchdog = nil }()
+
+	mockCtrl := gomock.NewController(t)
+	hdfsAccessor := NewMockHdfsAccessor(mockCtrl)
+	instrumented := NewInstrumentedHdfsAccessor(hdfsAccessor)
+	hdfsAccessor.EXPECT().Stat(gomock.Any(), "/test/file").DoAndReturn(func(ctx context.Context, path string) (Attrs, error) {
+		mockClock.NotifyTimeElapsed(10 * time.Second)
+		assert.Empty(t, watchdog.SlowOperations())
+
+		// the namenode hangs
+		mockClock.NotifyTimeElapsed(time.Minute)
+		watchdog.Check()
+		slow := watchdog.SlowOperations()
+		assert.Equal(t, 2, len(slow))
+		assert.Equal(t, WatchdogFuse, slow[0].Kind)
+		assert.Equal(t, "Getattr", slow[0].Name)
+		assert.Equal(t, WatchdogHdfs, slow[1].Kind)
+		assert.Equal(t, "Stat", slow[1].Name)
+		assert.Equal(t, "/test/file", slow[1].Details)
+		assert.Equal(t, fuse.RequestID(7), slow[1].RequestID)
+		assert.Equal(t, "1m10s", slow[1].Duration)
+		return Attrs{Name: "file"}, nil
+	})
+
+	req := &fuse.GetattrRequest{Header: fuse.Header{ID: 7}}
+	ctx, done := observeFuse(withFuseRequest(context.Background(), req), "Getattr")
+	mockClock.NotifyTimeElapsed(time.Second)
+	_, err := instrumented.Stat(ctx, "/test/file")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(watchdog.SlowOperations()))
+	assert.Equal(t, 1, len(watchdog.ops))
+	done(err)
+	assert.Empty(t, watchdog.ops)
+}
+
+// Testing that the stacks of all goroutines are captured
+func TestGoroutineStacks(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		close(started)
+		waitForRelease(release)
+	}()
+	<-started
+	defer close(release)
+
+	stacks := goroutineStacks()
+	assert.True(t, strings.HasPrefix(stacks, "goroutine "), stacks)
+	assert.Contains(t, stacks, "TestGoroutineStacks")
+	assert.Contains(t, stacks, "waitForRelease")
+}
+
+func waitForRelease(release chan struct{}) {
+	<-release
+}
@@ -8,12 +8,13 @@ import (
 	"time"
 
 	"bazil.org/fuse"
+	"golang.org/x/net/context"
 	"logicalclocks.com/hopsfs-mount/ugcache"
 )
 
-func ChmodOp(attrs *Attrs, fileSystem *FileSystem, path string, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	loginfo("Setting attributes", Fields{Operation: Chmod, Path: path, Mode: req.Mode})
-	err := fileSystem.getDFSConnector().Chmod(path, req.Mode)
+func ChmodOp(ctx context.Context, attrs *Attrs, fileSystem *FileSystem, path string, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	loginfo("Setting attributes", Fields{Operation: Chmod, Path: path, Mode: req.Mode, RequestID: requestID(ctx)})
+	err := fileSystem.getDFSConnector().Chmod(ctx, path, req.Mode)
 	if err != nil {
 		return err
 	} else {
@@ -23,7 +24,7 @@ func ChmodOp(attrs *Attrs, fileSystem *FileSystem, path string, req *fuse.Setatt
 	}
 }
 
-func SetAttrChownOp(attrs *Attrs, fileSystem *FileSystem, path string, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+func SetAttrChownOp(ctx context.Context, attrs *Attrs, fileSystem *FileSystem, path string, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
 	var uid = attrs.Uid
 	var gid = attrs.Gid
 
@@ -35,10 +36,10 @@ func SetAttrChownOp(attrs *Attrs, fileSystem *FileSystem, path string, req *fuse
 		gid = req.Gid
 	}
 
-	return ChownOp(attrs, fileSystem, path, uid, gid)
+	return ChownOp(ctx, attrs, fileSystem, path, uid, gid)
 }
 
-func ChownOp(attrs *Attrs, fileSystem *FileSystem, path string, uid uint32, gid uint32) error {
+func ChownOp(ctx context.Context, attrs *Attrs, fileSystem *FileSystem, path string, uid uint32, gid uint32) error {
 	var userName = ""
 	var groupName = ""
 
@@ -52,8 +53,8 @@ func ChownOp(attrs *Attrs, fileSystem *FileSystem, path string, uid uint32, gid
 		return fmt.Errorf(fmt.Sprintf("Setattr failed. Unable to find group information. Path %s", path))
 	}
 
-	loginfo("Setting attributes", Fields{Operation: Chown, Path: path, UID: uid, User: userName, GID: gid, Group: groupName})
-	err := fileSystem.getDFSConnector().Chown(path, userName, groupName)
+	loginfo("Setting attributes", Fields{Operation: Chown, Path: path, UID: uid, User: userName, GID: gid, Group: groupName, RequestID: requestID(ctx)})
+	err := fileSystem.getDFSConnector().Chown(ctx, path, userName, groupName)
 
 	if err != nil {
 		return err
@@ -64,32 +65,53 @@ func ChownOp(attrs *Attrs, fileSystem *FileSystem, path string, uid uint32, gid
 	}
 }
 
-func UpdateTS(attrs *Attrs, fileSystem *FileSystem, path string, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+// Persists atime and mtime requested by utimens(2) to HDFS
+func UpdateTS(ctx context.Context, attrs *Attrs, fileSystem *FileSystem, path string, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Handle() {
+		logdebug("Setattr Handle is ignored", Fields{Operation: Setattr, Path: path, RequestID: requestID(ctx)})
+	}
 
-	// in future if we need access time then we can update the file system client to support it
-	if req.Valid.Atime() {
-		logdebug("The stat op in hopsfs client returns os.FileInfo which does not have access time. Ignoring atime for now", nil)
+	if req.Valid.LockOwner() {
+		logdebug("Setattr LockOwner is ignored", Fields{Operation: Setattr, Path: path, RequestID: requestID(ctx)})
 	}
 
-	if req.Valid.Mtime() {
-		attrs.Mtime = time.Unix(int64(req.Mtime.Second()), 0)
+	atime, mtime, changed := requestedTimes(attrs, fileSystem.Clock, req)
+	if !changed {
+		return nil
 	}
 
-	if req.Valid.Handle() {
-		logwarn("Setattr Handle is not implemented yet.", nil)
+	logdebug("Setting times", Fields{Operation: SetTimes, Path: path, Atime: atime, Mtime: mtime, RequestID: requestID(ctx)})
+	err := fileSystem.getDFSConnector().SetTimes(ctx, path, atime, mtime)
+	if err != nil {
+		logwarn("Setattr (utimens) failed", Fields{Operation: SetTimes, Path: path, Error: err, RequestID: requestID(ctx)})
+		return err
 	}
+	attrs.Atime = atime
+	attrs.Mtime = mtime
+	return nil
+}
+
+// Returns atime and mtime requested by setattr. Times which are not requested
+// are taken from the cached attributes, as HDFS sets both of them at once
+func requestedTimes(attrs *Attrs, clock Clock, req *fuse.SetattrRequest) (time.Time, time.Time, bool) {
+	atime := attrs.Atime
+	mtime := attrs.Mtime
+	changed := false
 
 	if req.Valid.AtimeNow() {
-		logdebug("Setattr AtimeNow is not implemented yet.", nil)
+		atime = clock.Now()
+		changed = true
+	} else if req.Valid.Atime() {
+		atime = req.Atime
+		changed = true
 	}
 
 	if req.Valid.MtimeNow() {
-		logdebug("Setattr MtimeNow is not implemented yet.", nil)
+		mtime = clock.Now()
+		changed = true
+	} else if req.Valid.Mtime() {
+		mtime = req.Mtime
+		changed = true
 	}
-
-	if req.Valid.LockOwner() {
-		logwarn("Setattr LockOwner is not implemented yet.", nil)
-	}
-
-	return nil
+	return atime, mtime, changed
 }
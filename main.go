@@ -17,26 +17,51 @@ import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	_ "bazil.org/fuse/fs/fstestutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/context"
 )
 
 var stagingDir string
 var mntSrcDir string
 var logFile string
 var logLevel string
+var logFormat string
 var rootCABundle string
 var clientCertificate string
 var clientKey string
+var tlsReloadInterval time.Duration
+var certExpiryWarning time.Duration
 var lazyMount *bool
 var allowedPrefixesString *string
 var readOnly *bool
 var tls *bool
 var connectors int
 var version *bool
+var quotaStatfs *bool
+var trashPrefixesString *string
+var lockLeaseDir *string
+var hardLinks *string
+var lockLeaseTTL *time.Duration
+var safeModePollInterval *time.Duration
+var circuitBreakerThreshold *time.Duration
+var circuitBreakerProbeInterval *time.Duration
+var metricsAddr *string
+var otlpEndpoint *string
+var traceFile *string
+var auditLogFile *string
+var slowOpThreshold *time.Duration
+var controlDir *string
+var configFile *string
 
 func main() {
 
+	if len(os.Args) > 1 && isControlCommand(os.Args[1]) {
+		os.Exit(runControlCommand(os.Args[1], os.Args[2:]))
+	}
+
 	retryPolicy := NewDefaultRetryPolicy(WallClock{})
 	parseArgsAndInitLogger(retryPolicy)
+	retryPolicies := loadRetryPolicies(retryPolicy)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -54,14 +79,58 @@ func main() {
 		ClientKey:         clientKey,
 	}
 
+	if tlsConfig.TLS && tlsReloadInterval > 0 {
+		tlsConfig.CertWatcher = NewTLSCertWatcher(tlsConfig, WallClock{}, tlsReloadInterval, certExpiryWarning)
+		go tlsConfig.CertWatcher.Run()
+	}
+
+	tracer = newTracerFromFlags()
+	if tracer != nil {
+		defer tracer.Shutdown(context.Background()) // exports the remaining spans
+	}
+
+	if *auditLogFile != "" {
+		var err error
+		if auditLog, err = NewAuditLog(*auditLogFile); err != nil {
+			logfatal(fmt.Sprintf("Failed to open the audit log. Error: %v", err), nil)
+		}
+		defer auditLog.Close()
+	}
+
+	if *slowOpThreshold > 0 {
+		watchdog = NewWatchdog(*slowOpThreshold, WallClock{})
+		go watchdog.Run()
+		defer watchdog.Close()
+	}
+
 	ftHdfsAccessors := make([]HdfsAccessor, connectors)
+	var safeMode *SafeMode
+	var circuitBreaker *CircuitBreaker
 
 	for i := 0; i < connectors; i++ {
+		var hdfsAccessor HdfsAccessor
 		hdfsAccessor, err := NewHdfsAccessor(hopsRpcAddress, WallClock{}, tlsConfig)
 		if err != nil {
 			logfatal(fmt.Sprintf("Error/NewHopsFSAccessor: %v ", err), nil)
 		}
-		ftHdfsAccessors[i] = NewFaultTolerantHdfsAccessor(hdfsAccessor, retryPolicy)
+		if *metricsAddr != "" || tracer != nil || watchdog != nil {
+			hdfsAccessor = NewInstrumentedHdfsAccessor(hdfsAccessor)
+		}
+		if safeMode == nil {
+			safeMode = NewSafeMode(hdfsAccessor, mntSrcDir, WallClock{}, *safeModePollInterval)
+			go safeMode.Run()
+		}
+		if *circuitBreakerThreshold > 0 {
+			if circuitBreaker == nil {
+				circuitBreaker = NewCircuitBreaker(hdfsAccessor, mntSrcDir, WallClock{}, *circuitBreakerThreshold, *circuitBreakerProbeInterval)
+				go circuitBreaker.Run()
+			}
+			hdfsAccessor = NewCircuitBreakerHdfsAccessor(hdfsAccessor, circuitBreaker)
+		}
+		ftHdfsAccessor := NewFaultTolerantHdfsAccessor(hdfsAccessor, retryPolicy)
+		ftHdfsAccessor.RetryPolicies = retryPolicies
+		ftHdfsAccessor.SafeMode = safeMode
+		ftHdfsAccessors[i] = ftHdfsAccessor
 	}
 	loginfo(fmt.Sprintf("Create %d file system clients", len(ftHdfsAccessors)), nil)
 
@@ -83,6 +152,36 @@ func main() {
 	if err != nil {
 		logfatal(fmt.Sprintf("Error/NewFileSystem: %v ", err), nil)
 	}
+	fileSystem.RetryPolicies = retryPolicies
+	fileSystem.QuotaStatfs = *quotaStatfs
+	if *trashPrefixesString != "" {
+		fileSystem.TrashPrefixes = strings.Split(*trashPrefixesString, ",")
+	}
+	fileSystem.HardLinks = *hardLinks
+	fileSystem.SafeMode = safeMode
+	fileSystem.CircuitBreaker = circuitBreaker
+	fileSystem.MountPoint = mountPoint
+	fileSystem.Config = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { fileSystem.Config[f.Name] = f.Value.String() })
+	if *metricsAddr != "" {
+		metrics.AddGaugeFunc("hopsfs_mount_namenode_safe_mode", "1 while the namenode is in safe mode", func() float64 {
+			if active, _ := safeMode.Active(); active {
+				return 1
+			}
+			return 0
+		})
+		metrics.AddGaugeFunc("hopsfs_mount_circuit_breaker_open", "1 while operations fail fast because the namenode is unreachable", func() float64 {
+			if state, _ := circuitBreaker.State(); state != CircuitClosed {
+				return 1
+			}
+			return 0
+		})
+		go metrics.ListenAndServe(*metricsAddr)
+	}
+	if *lockLeaseDir != "" {
+		fileSystem.LockLeases = NewLockLeases(fileSystem, *lockLeaseDir, *lockLeaseTTL)
+		go fileSystem.LockLeases.Run()
+	}
 
 	mountOptions := getMountOptions(*readOnly)
 	c, err := fileSystem.Mount(mountPoint, mountOptions...)
@@ -91,6 +190,16 @@ func main() {
 	}
 	loginfo(fmt.Sprintf("Mounted successfully. HopsFS src dir: %s ", mntSrcDir), nil)
 
+	if *controlDir != "" {
+		controlServer, err := NewControlServer(fileSystem, controlSocketPath(*controlDir, mountPoint))
+		if err != nil {
+			logerror(fmt.Sprintf("Failed to create the control socket. Error: %v", err), nil)
+		} else {
+			go controlServer.Serve()
+			defer controlServer.Close()
+		}
+	}
+
 	// Increase the maximum number of file descriptor from 1K to 1M in Linux
 	rLimit := syscall.Rlimit{
 		Cur: 1024 * 1024,
@@ -114,11 +223,15 @@ func main() {
 			loginfo(fmt.Sprintf("Received signal: %s", x.String()), nil)
 			fileSystem.Unmount(mountPoint) // this will cause Serve() call below to exit
 			// Also reseting retry policy properties to stop useless retries
-			retryPolicy.MaxAttempts = 0
-			retryPolicy.MaxDelay = 0
+			for _, p := range retryPolicies.All() {
+				p.MaxAttempts = 0
+				p.MaxDelay = 0
+			}
 		}
 	}()
-	err = fs.Serve(c, fileSystem)
+	serverConfig := &fs.Config{WithContext: withFuseRequest}
+	fileSystem.Server = fs.New(c, serverConfig)
+	err = fileSystem.Server.Serve(fileSystem)
 	if err != nil {
 		logfatal(fmt.Sprintf("Failed to serve FS. Error: %v", err), nil)
 	}
@@ -133,6 +246,7 @@ func main() {
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s [Options] Namenode:Port MountPoint\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s status|list-open-files|flush|drop-caches|set-loglevel [-controlDir Dir] MountPoint [Args]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  \nOptions:\n")
 	flag.PrintDefaults()
 }
@@ -143,16 +257,37 @@ func parseArgsAndInitLogger(retryPolicy *RetryPolicy) {
 	flag.IntVar(&retryPolicy.MaxAttempts, "retryMaxAttempts", 10, "Maxumum retry attempts for failed operations")
 	flag.DurationVar(&retryPolicy.MinDelay, "retryMinDelay", 1*time.Second, "minimum delay between retries (note, first retry always happens immediatelly)")
 	flag.DurationVar(&retryPolicy.MaxDelay, "retryMaxDelay", 60*time.Second, "maximum delay between retries")
+	configFile = flag.String("config", "", "JSON configuration file with the retry policies of metadata reads, metadata mutations, data reads and uploads. Settings missing from the file are taken from the -retry* flags")
 	allowedPrefixesString = flag.String("allowedPrefixes", "*", "Comma-separated list of allowed path prefixes on the remote file system, if specified the mount point will expose access to those prefixes only")
 	readOnly = flag.Bool("readOnly", false, "Enables mount with readonly")
+	trashPrefixesString = flag.String("trashPrefixes", "", "Comma-separated list of path prefixes on the remote file system where removed files and directories are moved to the HDFS trash of the user instead of being deleted. Use * for all paths. Processes with "+SkipTrashEnv+"=1 in their environment bypass the trash")
+	hardLinks = flag.String("hardLinks", HardLinksEPERM, "Hard link policy, HopsFS does not support hard links. "+HardLinksEPERM+" and "+HardLinksENOTSUP+" fail link(2) with the given error, "+HardLinksCopy+" creates a copy of the file")
+	lockLeaseDir = flag.String("lockLeaseDir", "", "HDFS directory for lock lease files. If set, file locks are coordinated with the mounts on other hosts using lease files")
+	lockLeaseTTL = flag.Duration("lockLeaseTTL", 1*time.Minute, "lock leases which are not refreshed within this interval are considered expired (e.g. the mount holding them has crashed)")
+	safeModePollInterval = flag.Duration("safeModePollInterval", 10*time.Second, "how often the namenode is probed while it is in safe mode. Mutations fail with EROFS until it leaves safe mode")
+	circuitBreakerThreshold = flag.Duration("circuitBreakerThreshold", 30*time.Second, "once the connections to the namenode keep failing for longer than this, operations fail with ENOTCONN without being retried until the namenode is back. 0 disables the circuit breaker")
+	circuitBreakerProbeInterval = flag.Duration("circuitBreakerProbeInterval", 10*time.Second, "how often the namenode is probed while operations fail because it is unreachable")
+	controlDir = flag.String("controlDir", defaultControlDir(), "directory of the control socket used by the status, list-open-files, flush, drop-caches and set-loglevel subcommands. Empty disables the control socket")
+	metricsAddr = flag.String("metricsAddr", "", "Address (e.g. localhost:9100) of an HTTP listener serving Prometheus metrics on /metrics. Disabled by default")
+	otlpEndpoint = flag.String("otlpEndpoint", "", "OTLP/HTTP endpoint (e.g. http://localhost:4318) receiving traces of the FUSE requests and of the HDFS calls they make. Disabled by default")
+	traceFile = flag.String("traceFile", "", "File receiving traces of the FUSE requests and of the HDFS calls they make, one JSON span per line. Disabled by default")
+	auditLogFile = flag.String("auditLog", "", "File receiving an append-only audit log of the mutations (create, flush, remove, rmtree, rename, mkdir, mknod, link, chmod, chown, setattr) done through the mount, one JSON object per line. Disabled by default")
+	slowOpThreshold = flag.Duration("slowOpThreshold", 30*time.Second, "FUSE requests and HDFS RPCs in progress for longer than this are logged as errors with the goroutine stacks, and reported by the status subcommand. 0 disables it")
+	quotaStatfs = flag.Bool("quotaStatfs", false, "Report the space and namespace quota of srcDir (or its closest ancestor with a quota) in statfs/df")
 	flag.StringVar(&logLevel, "logLevel", "error", "logs to be printed. error, warn, info, debug, trace")
 	flag.StringVar(&stagingDir, "stageDir", "/tmp", "stage directory for writing files")
 	tls = flag.Bool("tls", false, "Enables tls connections")
 	flag.StringVar(&rootCABundle, "rootCABundle", "/srv/hops/super_crypto/hdfs/hops_root_ca.pem", "Root CA bundle location ")
 	flag.StringVar(&clientCertificate, "clientCertificate", "/srv/hops/super_crypto/hdfs/hdfs_certificate_bundle.pem", "Client certificate location")
 	flag.StringVar(&clientKey, "clientKey", "/srv/hops/super_crypto/hdfs/hdfs_priv.pem", "Client key location")
+	flag.DurationVar(&tlsReloadInterval, "tlsReloadInterval", 1*time.Minute, "how often the TLS files are checked for changes. Connections are rebuilt when the files change. 0 disables reloading")
+	flag.DurationVar(&certExpiryWarning, "certExpiryWarning", 7*24*time.Hour, "log a warning when the client certificate expires within this interval")
 	flag.StringVar(&mntSrcDir, "srcDir", "/", "HopsFS src directory")
 	flag.StringVar(&logFile, "logFile", "", "Log file path. By default the log is written to console")
+	flag.StringVar(&logFormat, "logFormat", "text", "format of the log entries. text, json")
+	flag.IntVar(&logMaxSize, "logMaxSize", logMaxSize, "maximum size in megabytes of the log file before it gets rotated")
+	flag.IntVar(&logMaxBackups, "logMaxBackups", logMaxBackups, "maximum number of rotated log files to retain. 0 retains all of them")
+	flag.IntVar(&logMaxAge, "logMaxAge", logMaxAge, "maximum number of days to retain rotated log files. 0 retains them regardless of their age")
 	flag.IntVar(&connectors, "numConnections", 1, "Number of connections with the namenode")
 	version = flag.Bool("version", false, "Print version")
 
@@ -169,15 +304,41 @@ func parseArgsAndInitLogger(retryPolicy *RetryPolicy) {
 		os.Exit(2)
 	}
 
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("Invalid log format %s, expected text or json", logFormat)
+	}
 	if err := checkLogFileCreation(); err != nil {
 		log.Fatalf("Error creating log file. Error: %v", err)
 	}
-	initLogger(logLevel, false, logFile)
+	initLogger(logLevel, false, logFile, logFormat)
+
+	if err := ValidateHardLinks(*hardLinks); err != nil {
+		logfatal(err.Error(), nil)
+	}
 
 	loginfo(fmt.Sprintf("Staging dir is:%s, Using TLS: %v, RetryAttempts: %d,  LogFile: %s", stagingDir, *tls, retryPolicy.MaxAttempts, logFile), nil)
 	loginfo(fmt.Sprintf("hopsfs-mount: current head GITCommit: %s Built time: %s Built by: %s ", GITCOMMIT, BUILDTIME, HOSTNAME), nil)
 }
 
+// Loads the retry policies of the classes of operations from the
+// configuration file, the policy of the -retry* flags is used by default
+func loadRetryPolicies(retryPolicy *RetryPolicy) *RetryPolicies {
+	if *configFile == "" {
+		return NewRetryPolicies(retryPolicy)
+	}
+	config, err := LoadConfig(*configFile)
+	if err != nil {
+		logfatal(err.Error(), nil)
+	}
+	retryPolicies, err := config.RetryPolicies.RetryPolicies(retryPolicy)
+	if err != nil {
+		logfatal(fmt.Sprintf("%s: %v", *configFile, err), nil)
+	}
+	loginfo(fmt.Sprintf("Retry policies: metadata reads %+v, metadata mutations %+v, data reads %+v, uploads %+v",
+		*retryPolicies.MetadataRead, *retryPolicies.MetadataMutation, *retryPolicies.DataRead, *retryPolicies.Upload), nil)
+	return retryPolicies
+}
+
 // check that we can create / open the log file
 func checkLogFileCreation() error {
 	if logFile != "" {
@@ -211,6 +372,8 @@ func getMountOptions(ro bool) []fuse.MountOption {
 		fuse.WritebackCache(),
 		fuse.MaxReadahead(1024 * 64), //TODO: make configurable
 		fuse.DefaultPermissions(),
+		fuse.LockingFlock(),
+		fuse.LockingPOSIX(),
 	}
 
 	if ro {
@@ -225,8 +388,32 @@ func createStagingDir() {
 	}
 }
 
+// Creates the tracer for the -otlpEndpoint and -traceFile flags, or returns
+// nil if tracing is disabled
+func newTracerFromFlags() *sdktrace.TracerProvider {
+	var exporters []sdktrace.SpanExporter
+	if *otlpEndpoint != "" {
+		exporter, err := NewOTLPSpanExporter(*otlpEndpoint)
+		if err != nil {
+			logfatal(fmt.Sprintf("Invalid OTLP endpoint. Error: %v", err), nil)
+		}
+		exporters = append(exporters, exporter)
+	}
+	if *traceFile != "" {
+		exporter, err := NewFileSpanExporter(*traceFile)
+		if err != nil {
+			logfatal(fmt.Sprintf("Failed to open the trace file. Error: %v", err), nil)
+		}
+		exporters = append(exporters, exporter)
+	}
+	if len(exporters) == 0 {
+		return nil
+	}
+	return NewTracer(exporters...)
+}
+
 func checkSrcMountPath(hdfsAccessor HdfsAccessor) error {
-	_, err := hdfsAccessor.Stat(mntSrcDir)
+	_, err := hdfsAccessor.Stat(context.Background(), mntSrcDir)
 	if err != nil {
 		return err
 	}
@@ -151,3 +151,13 @@ func lockUGCache() {
 func unlockUGCache() {
 	ugMutex.Unlock()
 }
+
+// Drops all cached users and groups
+func Clear() {
+	lockUGCache()
+	defer unlockUGCache()
+	userNameToUidCache = make(map[string]ugID)
+	groupNameToUidCache = make(map[string]ugID)
+	userIdToNameCache = make(map[uint32]ugName)
+	groupIdToNameCache = make(map[uint32]ugName)
+}